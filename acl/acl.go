@@ -0,0 +1,161 @@
+package acl
+
+import (
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/duratarskeyk/proxymux/corestructs"
+)
+
+// Rule matches a destination when every set condition matches. Prefix rules
+// only match known IPs, Host and Domain rules only match hostname targets.
+// Domain matches the domain itself and all of its subdomains. A zero port
+// range matches any port.
+type Rule struct {
+	Allow bool
+
+	Prefix netip.Prefix
+	Host   string
+	Domain string
+
+	PortFrom uint16
+	PortTo   uint16
+}
+
+// List is an ordered set of rules, the first matching rule wins. Unless
+// AllowPrivate is set, loopback, private, link-local and cloud metadata
+// addresses are always denied.
+type List struct {
+	Rules        []Rule
+	DefaultDeny  bool
+	AllowPrivate bool
+}
+
+// Check checks a parsed request's destination. Call it again after
+// resolution so the rules see the address that is going to be dialed.
+// Hostnames that are IP literals, zoned IPv6 ones included, are checked as
+// the IP.
+func (l *List) Check(fields *corestructs.Fields) error {
+	var ip netip.Addr
+	ok := true
+	if fields.HostIP != nil {
+		ip, ok = netip.AddrFromSlice(fields.HostIP)
+	}
+	host := ""
+	if fields.HostType == corestructs.HostTypeHostname {
+		host = strings.ToLower(strings.TrimSuffix(fields.Host, "."))
+		if literal, err := netip.ParseAddr(host); err == nil && fields.HostIP == nil {
+			ip = literal.WithZone("")
+		}
+	}
+
+	if !ok || !l.allowed(host, ip.Unmap(), fields.PortNum) {
+		return &ErrACL{Destination: net.JoinHostPort(fields.Host, fields.Port), err: ErrDenied}
+	}
+
+	return nil
+}
+
+// CheckAddr checks an address about to be connected or sent to, anything
+// but a valid IP is denied.
+func (l *List) CheckAddr(ip net.IP, port uint16) error {
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok || !l.allowed("", addr.Unmap(), port) {
+		return &ErrACL{Destination: net.JoinHostPort(ip.String(), strconv.Itoa(int(port))), err: ErrDenied}
+	}
+
+	return nil
+}
+
+// Control checks the address a dialer is about to connect to, so hostnames
+// resolved during the dial can't point to denied addresses.
+func (l *List) Control(network, address string, c syscall.RawConn) error {
+	return checkAddress(l, address)
+}
+
+// Guard returns a copy of d that runs Control before every connect.
+func (l *List) Guard(d *net.Dialer) *net.Dialer {
+	return Guard(l, d)
+}
+
+// Guard returns a copy of d that checks every address with check before
+// connecting.
+func Guard(check corestructs.AddrChecker, d *net.Dialer) *net.Dialer {
+	var guarded net.Dialer
+	if d != nil {
+		guarded = *d
+	}
+	control := guarded.Control
+	guarded.Control = func(network, address string, c syscall.RawConn) error {
+		if err := checkAddress(check, address); err != nil {
+			return err
+		}
+		if control != nil {
+			return control(network, address, c)
+		}
+		return nil
+	}
+
+	return &guarded
+}
+
+// checkAddress checks a dial address with check. The zone of IPv6
+// addresses is dropped, addresses that don't parse are denied.
+func checkAddress(check corestructs.AddrChecker, address string) error {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return err
+	}
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		return &ErrACL{Destination: address, err: ErrDenied}
+	}
+
+	return check.CheckAddr(ip.WithZone("").AsSlice(), uint16(port))
+}
+
+func (l *List) allowed(host string, ip netip.Addr, port uint16) bool {
+	if ip.IsValid() && !l.AllowPrivate && isBuiltinDenied(ip) {
+		return false
+	}
+	for i := range l.Rules {
+		if l.Rules[i].match(host, ip, port) {
+			return l.Rules[i].Allow
+		}
+	}
+
+	return !l.DefaultDeny
+}
+
+func (r *Rule) match(host string, ip netip.Addr, port uint16) bool {
+	if r.PortFrom != 0 || r.PortTo != 0 {
+		to := r.PortTo
+		if to == 0 {
+			to = r.PortFrom
+		}
+		if port < r.PortFrom || port > to {
+			return false
+		}
+	}
+	if r.Prefix.IsValid() && (!ip.IsValid() || !r.Prefix.Contains(ip)) {
+		return false
+	}
+	if r.Host != "" && host != strings.ToLower(r.Host) {
+		return false
+	}
+	if r.Domain != "" {
+		domain := strings.ToLower(strings.Trim(r.Domain, "."))
+		if host != domain && !strings.HasSuffix(host, "."+domain) {
+			return false
+		}
+	}
+
+	return true
+}
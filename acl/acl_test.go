@@ -0,0 +1,102 @@
+package acl
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"strconv"
+	"testing"
+
+	"github.com/duratarskeyk/proxymux/corestructs"
+)
+
+func TestCheck(t *testing.T) {
+	list := &List{
+		Rules: []Rule{
+			{Allow: false, Domain: "blocked.example"},
+			{Allow: false, Host: "exact.example"},
+			{Allow: false, Prefix: netip.MustParsePrefix("198.51.100.0/24")},
+			{Allow: false, PortFrom: 25, PortTo: 26},
+			{Allow: true, Prefix: netip.MustParsePrefix("203.0.113.0/24"), PortFrom: 443},
+			{Allow: false, Prefix: netip.MustParsePrefix("203.0.113.0/24")},
+		},
+	}
+	testCases := []struct {
+		fields  corestructs.Fields
+		allowed bool
+	}{
+		{corestructs.Fields{Host: "example.org", HostType: corestructs.HostTypeHostname, PortNum: 80}, true},
+		{corestructs.Fields{Host: "blocked.example", HostType: corestructs.HostTypeHostname, PortNum: 80}, false},
+		{corestructs.Fields{Host: "WWW.Blocked.Example.", HostType: corestructs.HostTypeHostname, PortNum: 80}, false},
+		{corestructs.Fields{Host: "notblocked.example", HostType: corestructs.HostTypeHostname, PortNum: 80}, true},
+		{corestructs.Fields{Host: "exact.example", HostType: corestructs.HostTypeHostname, PortNum: 80}, false},
+		{corestructs.Fields{Host: "sub.exact.example", HostType: corestructs.HostTypeHostname, PortNum: 80}, true},
+		{corestructs.Fields{Host: "198.51.100.7", HostIP: net.ParseIP("198.51.100.7"), PortNum: 80}, false},
+		{corestructs.Fields{Host: "example.org", HostType: corestructs.HostTypeHostname, PortNum: 25}, false},
+		{corestructs.Fields{Host: "example.org", HostType: corestructs.HostTypeHostname, PortNum: 27}, true},
+		{corestructs.Fields{Host: "203.0.113.1", HostIP: net.ParseIP("203.0.113.1"), PortNum: 443}, true},
+		{corestructs.Fields{Host: "203.0.113.1", HostIP: net.ParseIP("203.0.113.1"), PortNum: 80}, false},
+		// built-in deny set
+		{corestructs.Fields{Host: "127.0.0.1", HostIP: net.ParseIP("127.0.0.1"), PortNum: 80}, false},
+		{corestructs.Fields{Host: "10.1.2.3", HostIP: net.ParseIP("10.1.2.3"), PortNum: 80}, false},
+		{corestructs.Fields{Host: "169.254.169.254", HostIP: net.ParseIP("169.254.169.254"), PortNum: 80}, false},
+		{corestructs.Fields{Host: "::ffff:192.168.1.1", HostIP: net.ParseIP("::ffff:192.168.1.1"), PortNum: 80}, false},
+		{corestructs.Fields{Host: "fe80::1", HostIP: net.ParseIP("fe80::1"), PortNum: 80}, false},
+		// zoned literals sent as hostnames
+		{corestructs.Fields{Host: "fe80::1%lo", HostType: corestructs.HostTypeHostname, PortNum: 80}, false},
+		{corestructs.Fields{Host: "::1%eth0", HostType: corestructs.HostTypeHostname, PortNum: 80}, false},
+		// rebinding: the name is fine, the resolved address is not
+		{corestructs.Fields{Host: "example.org", HostType: corestructs.HostTypeHostname, HostIP: net.ParseIP("127.0.0.1"), PortNum: 80}, false},
+	}
+	for nr, testCase := range testCases {
+		fields := testCase.fields
+		fields.Port = strconv.Itoa(int(fields.PortNum))
+		err := list.Check(&fields)
+		if testCase.allowed && err != nil {
+			t.Errorf("Test #%d: Expected destination to be allowed, got %s", nr+1, err)
+		} else if !testCase.allowed && !errors.Is(err, ErrDenied) {
+			t.Errorf("Test #%d: Expected %s, got %v", nr+1, ErrDenied, err)
+		}
+	}
+}
+
+func TestDefaults(t *testing.T) {
+	fields := &corestructs.Fields{Host: "127.0.0.1", HostIP: net.ParseIP("127.0.0.1"), Port: "80", PortNum: 80}
+	if err := (&List{AllowPrivate: true}).Check(fields); err != nil {
+		t.Errorf("Expected AllowPrivate to disable built-in rules, got %s", err)
+	}
+	if err := (&List{AllowPrivate: true, DefaultDeny: true}).Check(fields); !errors.Is(err, ErrDenied) {
+		t.Errorf("Expected DefaultDeny to deny, got %v", err)
+	}
+}
+
+func TestGuard(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	dialer := (&List{}).Guard(&net.Dialer{})
+	_, err = dialer.DialContext(context.Background(), "tcp", ln.Addr().String())
+	if !errors.Is(err, ErrDenied) {
+		t.Errorf("Expected %s, got %v", ErrDenied, err)
+	}
+
+	for _, address := range []string{"[fe80::1%lo]:80", "[fe80::1]:80", "not-an-ip:80"} {
+		if err = (&List{}).Control("tcp", address, nil); !errors.Is(err, ErrDenied) {
+			t.Errorf("%s: Expected %s, got %v", address, ErrDenied, err)
+		}
+	}
+	if err = (&List{}).CheckAddr(nil, 80); !errors.Is(err, ErrDenied) {
+		t.Errorf("nil IP: Expected %s, got %v", ErrDenied, err)
+	}
+
+	dialer = (&List{AllowPrivate: true}).Guard(&net.Dialer{})
+	conn, err := dialer.DialContext(context.Background(), "tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("Expected successful dial, got %s", err)
+	}
+	conn.Close()
+}
@@ -0,0 +1,29 @@
+package acl
+
+import "net/netip"
+
+// Cloud metadata endpoints (169.254.169.254, 100.100.100.200, fd00:ec2::254)
+// fall into the link-local, shared and unique local ranges.
+var builtinDenied = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("10.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("127.0.0.0/8"),
+	netip.MustParsePrefix("169.254.0.0/16"),
+	netip.MustParsePrefix("172.16.0.0/12"),
+	netip.MustParsePrefix("192.168.0.0/16"),
+	netip.MustParsePrefix("::/128"),
+	netip.MustParsePrefix("::1/128"),
+	netip.MustParsePrefix("fc00::/7"),
+	netip.MustParsePrefix("fe80::/10"),
+}
+
+func isBuiltinDenied(ip netip.Addr) bool {
+	for _, prefix := range builtinDenied {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
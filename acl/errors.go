@@ -0,0 +1,21 @@
+package acl
+
+import (
+	"errors"
+	"fmt"
+)
+
+var ErrDenied = errors.New("destination denied")
+
+type ErrACL struct {
+	Destination string
+	err         error
+}
+
+func (e *ErrACL) Error() string {
+	return fmt.Sprintf("ACL error: %s: %s", e.Destination, e.err)
+}
+
+func (e *ErrACL) Unwrap() error {
+	return e.err
+}
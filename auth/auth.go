@@ -0,0 +1,65 @@
+package auth
+
+import (
+	"context"
+
+	"github.com/duratarskeyk/go-common-utils/authorizer"
+)
+
+// Authorizer is the context-aware counterpart of authorizer.Authorizer. A
+// non-nil error means the backend couldn't decide, a bad IP or bad
+// credentials are reported with a result that isn't OK.
+type Authorizer interface {
+	IPAuth(ctx context.Context, proxyIP, userIP string) (authorizer.AuthResult, error)
+	CredentialsAuth(ctx context.Context, proxyIP, username, password string) (authorizer.AuthResult, error)
+}
+
+type legacy struct {
+	a authorizer.Authorizer
+}
+
+// Legacy adapts an authorizer.Authorizer. Its calls can't be interrupted,
+// ctx is only checked before them.
+func Legacy(a authorizer.Authorizer) Authorizer {
+	return legacy{a: a}
+}
+
+func (l legacy) IPAuth(ctx context.Context, proxyIP, userIP string) (authorizer.AuthResult, error) {
+	if err := ctx.Err(); err != nil {
+		return authorizer.BadAuthResult, err
+	}
+
+	return l.a.IPAuth(proxyIP, userIP), nil
+}
+
+func (l legacy) CredentialsAuth(ctx context.Context, proxyIP, username, password string) (authorizer.AuthResult, error) {
+	if err := ctx.Err(); err != nil {
+		return authorizer.BadAuthResult, err
+	}
+
+	return l.a.CredentialsAuth(proxyIP, username, password), nil
+}
+
+type missing struct{}
+
+func (missing) IPAuth(ctx context.Context, proxyIP, userIP string) (authorizer.AuthResult, error) {
+	return authorizer.BadAuthResult, ErrNoAuthorizer
+}
+
+func (missing) CredentialsAuth(ctx context.Context, proxyIP, username, password string) (authorizer.AuthResult, error) {
+	return authorizer.BadAuthResult, ErrNoAuthorizer
+}
+
+// From returns the Authorizer stored in Fields.ProxyConfig, adapting an
+// authorizer.Authorizer with Legacy. Any other config gets an Authorizer
+// failing with ErrNoAuthorizer.
+func From(config interface{}) Authorizer {
+	switch a := config.(type) {
+	case Authorizer:
+		return a
+	case authorizer.Authorizer:
+		return legacy{a: a}
+	}
+
+	return missing{}
+}
@@ -0,0 +1,60 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/duratarskeyk/go-common-utils/authorizer"
+	"github.com/duratarskeyk/proxymux/internal/authmock"
+)
+
+func TestFrom(t *testing.T) {
+	mock := &authmock.Mock{
+		IPAuthRet:          authorizer.AuthResult{OK: true, UserID: 1},
+		CredentialsAuthRet: authorizer.AuthResult{OK: true, UserID: 2},
+	}
+	backend := &authmock.Backend{IPAuthErr: errors.New("down")}
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	tests := []struct {
+		config interface{}
+		ctx    context.Context
+		ipUser int
+		err    error
+	}{
+		{mock, context.Background(), 1, nil},
+		{mock, canceled, 0, context.Canceled},
+		{backend, context.Background(), 0, backend.IPAuthErr},
+		{nil, context.Background(), 0, ErrNoAuthorizer},
+		{struct{}{}, context.Background(), 0, ErrNoAuthorizer},
+	}
+	for nr, test := range tests {
+		a := From(test.config)
+		result, err := a.IPAuth(test.ctx, "1.2.3.4", "4.3.2.1")
+		if !errors.Is(err, test.err) || result.UserID != test.ipUser {
+			t.Errorf("Test #%d: Expected user %d and error %v, got %d and %v", nr+1, test.ipUser, test.err, result.UserID, err)
+		}
+	}
+
+	result, err := Legacy(mock).CredentialsAuth(context.Background(), "1.2.3.4", "a", "b")
+	if err != nil || result.UserID != 2 {
+		t.Errorf("Expected adapted CredentialsAuth result, got %v, %v", result, err)
+	}
+	if _, err = Legacy(mock).CredentialsAuth(canceled, "1.2.3.4", "a", "b"); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+}
+
+func TestErrBackend(t *testing.T) {
+	down := errors.New("down")
+	err := fmt.Errorf("wrapped: %w", NewErrBackend(down))
+	if !errors.Is(err, ErrBackendUnavailable) || !errors.Is(err, down) {
+		t.Errorf("Expected %v to match ErrBackendUnavailable and its cause", err)
+	}
+	if errors.Is(down, ErrBackendUnavailable) {
+		t.Error("Expected plain errors not to match ErrBackendUnavailable")
+	}
+}
@@ -0,0 +1,190 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/duratarskeyk/go-common-utils/authorizer"
+)
+
+const defaultMaxCacheEntries = 1 << 16
+
+type cacheKey struct {
+	credentials bool
+	proxyIP     string
+	// user IP for IP auth, username for credentials auth
+	user   string
+	secret [sha256.Size]byte
+}
+
+type cacheEntry struct {
+	result  authorizer.AuthResult
+	expires time.Time
+}
+
+type cacheCall struct {
+	done   chan struct{}
+	result authorizer.AuthResult
+	err    error
+}
+
+// Cache is an Authorizer caching the results of Backend, OK ones for TTL
+// and the others for NegativeTTL, zero disables negative caching. Errors
+// aren't cached. Concurrent lookups of the same key share one Backend call.
+// Passwords are only kept hashed. At most MaxEntries, 1<<16 when zero,
+// results are kept, arbitrary ones are evicted when it's full.
+type Cache struct {
+	Backend     Authorizer
+	TTL         time.Duration
+	NegativeTTL time.Duration
+	MaxEntries  int
+
+	mu      sync.Mutex
+	entries map[cacheKey]*cacheEntry
+	calls   map[cacheKey]*cacheCall
+	// bumped by invalidations so lookups started before them aren't stored
+	generation uint64
+}
+
+func NewCache(backend Authorizer, ttl, negativeTTL time.Duration, maxEntries int) *Cache {
+	return &Cache{
+		Backend:     backend,
+		TTL:         ttl,
+		NegativeTTL: negativeTTL,
+		MaxEntries:  maxEntries,
+		entries:     make(map[cacheKey]*cacheEntry),
+	}
+}
+
+func (c *Cache) IPAuth(ctx context.Context, proxyIP, userIP string) (authorizer.AuthResult, error) {
+	key := cacheKey{proxyIP: proxyIP, user: userIP}
+	return c.lookup(ctx, key, func(ctx context.Context) (authorizer.AuthResult, error) {
+		return c.Backend.IPAuth(ctx, proxyIP, userIP)
+	})
+}
+
+func (c *Cache) CredentialsAuth(ctx context.Context, proxyIP, username, password string) (authorizer.AuthResult, error) {
+	key := cacheKey{credentials: true, proxyIP: proxyIP, user: username, secret: sha256.Sum256([]byte(password))}
+	return c.lookup(ctx, key, func(ctx context.Context) (authorizer.AuthResult, error) {
+		return c.Backend.CredentialsAuth(ctx, proxyIP, username, password)
+	})
+}
+
+func (c *Cache) InvalidateUser(userID int) {
+	c.invalidate(func(key cacheKey, entry *cacheEntry) bool {
+		return entry.result.OK && entry.result.UserID == userID
+	})
+}
+
+func (c *Cache) InvalidatePackage(packageID int) {
+	c.invalidate(func(key cacheKey, entry *cacheEntry) bool {
+		return entry.result.OK && entry.result.PackageID == packageID
+	})
+}
+
+// InvalidateLogin drops the results of every password tried for username.
+func (c *Cache) InvalidateLogin(username string) {
+	c.invalidate(func(key cacheKey, entry *cacheEntry) bool {
+		return key.credentials && key.user == username
+	})
+}
+
+func (c *Cache) Flush() {
+	c.invalidate(func(key cacheKey, entry *cacheEntry) bool {
+		return true
+	})
+}
+
+func (c *Cache) lookup(ctx context.Context, key cacheKey, fetch func(ctx context.Context) (authorizer.AuthResult, error)) (authorizer.AuthResult, error) {
+	for {
+		now := time.Now()
+		c.mu.Lock()
+		if entry, ok := c.entries[key]; ok && now.Before(entry.expires) {
+			c.mu.Unlock()
+			return entry.result, nil
+		}
+		if call, ok := c.calls[key]; ok {
+			c.mu.Unlock()
+			select {
+			case <-call.done:
+			case <-ctx.Done():
+				return authorizer.BadAuthResult, ctx.Err()
+			}
+			if isContextErr(call.err) && ctx.Err() == nil {
+				// the caller that made the call gave up, try again
+				continue
+			}
+			return call.result, call.err
+		}
+		call := &cacheCall{done: make(chan struct{})}
+		if c.calls == nil {
+			c.calls = make(map[cacheKey]*cacheCall)
+		}
+		c.calls[key] = call
+		generation := c.generation
+		c.mu.Unlock()
+
+		call.result, call.err = fetch(ctx)
+		ttl := c.TTL
+		if !call.result.OK {
+			ttl = c.NegativeTTL
+		}
+
+		c.mu.Lock()
+		delete(c.calls, key)
+		if call.err == nil && ttl > 0 && generation == c.generation {
+			c.storeLocked(key, &cacheEntry{result: call.result, expires: now.Add(ttl)})
+		}
+		c.mu.Unlock()
+		close(call.done)
+
+		return call.result, call.err
+	}
+}
+
+func (c *Cache) invalidate(match func(key cacheKey, entry *cacheEntry) bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generation++
+	for key, entry := range c.entries {
+		if match(key, entry) {
+			delete(c.entries, key)
+		}
+	}
+}
+
+func (c *Cache) storeLocked(key cacheKey, entry *cacheEntry) {
+	if c.entries == nil {
+		c.entries = make(map[cacheKey]*cacheEntry)
+	}
+	if maxEntries := c.maxEntries(); len(c.entries) >= maxEntries {
+		now := time.Now()
+		for k, v := range c.entries {
+			if now.After(v.expires) {
+				delete(c.entries, k)
+			}
+		}
+		for k := range c.entries {
+			if len(c.entries) < maxEntries {
+				break
+			}
+			delete(c.entries, k)
+		}
+	}
+	c.entries[key] = entry
+}
+
+func (c *Cache) maxEntries() int {
+	if c.MaxEntries > 0 {
+		return c.MaxEntries
+	}
+
+	return defaultMaxCacheEntries
+}
+
+func isContextErr(err error) bool {
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
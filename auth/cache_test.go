@@ -0,0 +1,160 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/duratarskeyk/go-common-utils/authorizer"
+)
+
+type countingBackend struct {
+	calls int64
+	gate  chan struct{}
+	err   error
+}
+
+func (b *countingBackend) IPAuth(ctx context.Context, proxyIP, userIP string) (authorizer.AuthResult, error) {
+	atomic.AddInt64(&b.calls, 1)
+	if b.gate != nil {
+		<-b.gate
+	}
+	if b.err != nil {
+		return authorizer.BadAuthResult, b.err
+	}
+	if userIP == "bad" {
+		return authorizer.BadAuthResult, nil
+	}
+
+	return authorizer.AuthResult{OK: true, UserID: 1, PackageID: 10}, nil
+}
+
+func (b *countingBackend) CredentialsAuth(ctx context.Context, proxyIP, username, password string) (authorizer.AuthResult, error) {
+	atomic.AddInt64(&b.calls, 1)
+	if password != "pass" {
+		return authorizer.BadAuthResult, nil
+	}
+
+	return authorizer.AuthResult{OK: true, UserID: 2, PackageID: 20}, nil
+}
+
+func TestCache(t *testing.T) {
+	backend := &countingBackend{}
+	c := NewCache(backend, time.Minute, 50*time.Millisecond, 0)
+	ctx := context.Background()
+
+	steps := []struct {
+		do    func() (authorizer.AuthResult, error)
+		ok    bool
+		calls int64
+	}{
+		{func() (authorizer.AuthResult, error) { return c.IPAuth(ctx, "p", "good") }, true, 1},
+		{func() (authorizer.AuthResult, error) { return c.IPAuth(ctx, "p", "good") }, true, 1},
+		{func() (authorizer.AuthResult, error) { return c.IPAuth(ctx, "p", "bad") }, false, 2},
+		{func() (authorizer.AuthResult, error) { return c.IPAuth(ctx, "p", "bad") }, false, 2},
+		{func() (authorizer.AuthResult, error) { return c.CredentialsAuth(ctx, "p", "user", "pass") }, true, 3},
+		{func() (authorizer.AuthResult, error) { return c.CredentialsAuth(ctx, "p", "user", "pass") }, true, 3},
+		{func() (authorizer.AuthResult, error) { return c.CredentialsAuth(ctx, "p", "user", "wrong") }, false, 4},
+		{func() (authorizer.AuthResult, error) { return c.CredentialsAuth(ctx, "q", "user", "pass") }, true, 5},
+	}
+	for nr, step := range steps {
+		result, err := step.do()
+		if err != nil || result.OK != step.ok {
+			t.Errorf("Test #%d: Expected OK %v, got %v, %v", nr+1, step.ok, result.OK, err)
+		}
+		if calls := atomic.LoadInt64(&backend.calls); calls != step.calls {
+			t.Errorf("Test #%d: Expected %d backend calls, got %d", nr+1, step.calls, calls)
+		}
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	c.IPAuth(ctx, "p", "bad")
+	if calls := atomic.LoadInt64(&backend.calls); calls != 6 {
+		t.Errorf("Expected negative entry to expire, got %d calls", calls)
+	}
+
+	c.InvalidateUser(1)
+	c.IPAuth(ctx, "p", "good")
+	c.InvalidatePackage(20)
+	c.CredentialsAuth(ctx, "p", "user", "pass")
+	c.CredentialsAuth(ctx, "q", "user", "pass")
+	if calls := atomic.LoadInt64(&backend.calls); calls != 9 {
+		t.Errorf("Expected invalidated entries to be fetched again, got %d calls", calls)
+	}
+	c.InvalidateLogin("user")
+	c.CredentialsAuth(ctx, "p", "user", "wrong")
+	c.IPAuth(ctx, "p", "good")
+	if calls := atomic.LoadInt64(&backend.calls); calls != 10 {
+		t.Errorf("Expected only the login's entries to be invalidated, got %d calls", calls)
+	}
+}
+
+func TestCacheBounded(t *testing.T) {
+	c := NewCache(&countingBackend{}, time.Minute, time.Minute, 10)
+	for i := 0; i < 100; i++ {
+		c.CredentialsAuth(context.Background(), "p", "user", fmt.Sprint("spray", i))
+		if len(c.entries) > 10 {
+			t.Fatalf("Expected at most 10 entries, got %d", len(c.entries))
+		}
+	}
+	if n := NewCache(&countingBackend{}, time.Minute, time.Minute, 0).maxEntries(); n != defaultMaxCacheEntries {
+		t.Errorf("Expected a default bound of %d, got %d", defaultMaxCacheEntries, n)
+	}
+}
+
+func TestCacheSingleFlight(t *testing.T) {
+	backend := &countingBackend{gate: make(chan struct{})}
+	c := NewCache(backend, time.Minute, 0, 0)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if result, err := c.IPAuth(context.Background(), "p", "good"); err != nil || !result.OK {
+				t.Errorf("Expected OK result, got %v, %v", result, err)
+			}
+		}()
+	}
+	for atomic.LoadInt64(&backend.calls) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(10 * time.Millisecond)
+	// results of lookups started before an invalidation aren't cached
+	c.InvalidateUser(1)
+	close(backend.gate)
+	wg.Wait()
+	if calls := atomic.LoadInt64(&backend.calls); calls != 1 {
+		t.Errorf("Expected one backend call, got %d", calls)
+	}
+	c.IPAuth(context.Background(), "p", "good")
+	if calls := atomic.LoadInt64(&backend.calls); calls != 2 {
+		t.Errorf("Expected result to not be cached, got %d calls", calls)
+	}
+}
+
+func TestCacheErrors(t *testing.T) {
+	down := errors.New("down")
+	backend := &countingBackend{err: down}
+	c := NewCache(backend, time.Minute, time.Minute, 2)
+	for i := 0; i < 2; i++ {
+		if _, err := c.IPAuth(context.Background(), "p", "good"); !errors.Is(err, down) {
+			t.Errorf("Expected backend error, got %v", err)
+		}
+	}
+	if calls := atomic.LoadInt64(&backend.calls); calls != 2 {
+		t.Errorf("Expected errors to not be cached, got %d calls", calls)
+	}
+
+	backend.err = nil
+	for _, user := range []string{"a", "b", "c", "d"} {
+		c.CredentialsAuth(context.Background(), "p", user, "pass")
+	}
+	if len(c.entries) > 2 {
+		t.Errorf("Expected at most 2 entries, got %d", len(c.entries))
+	}
+}
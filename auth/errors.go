@@ -0,0 +1,32 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+)
+
+var ErrBackendUnavailable = errors.New("auth backend unavailable")
+var ErrNoAuthorizer = errors.New("no authorizer configured")
+var ErrNotToken = errors.New("not a token")
+
+// ErrBackend wraps errors returned by an Authorizer, it matches
+// ErrBackendUnavailable.
+type ErrBackend struct {
+	err error
+}
+
+func NewErrBackend(err error) *ErrBackend {
+	return &ErrBackend{err: err}
+}
+
+func (e *ErrBackend) Error() string {
+	return fmt.Sprintf("auth backend unavailable: %s", e.err)
+}
+
+func (e *ErrBackend) Unwrap() error {
+	return e.err
+}
+
+func (e *ErrBackend) Is(target error) bool {
+	return target == ErrBackendUnavailable
+}
@@ -0,0 +1,53 @@
+package auth
+
+import (
+	"context"
+
+	"github.com/duratarskeyk/go-common-utils/authorizer"
+	"github.com/duratarskeyk/proxymux/loginparams"
+)
+
+// TokenResult is the identity a verified token carries. Login, when not
+// empty, replaces the username and Options take precedence over the login
+// options.
+type TokenResult struct {
+	authorizer.AuthResult
+
+	Login   string
+	Options loginparams.Options
+}
+
+// TokenVerifier checks tokens sent in place of passwords. IsToken tells
+// them apart from passwords, which keep going to the Authorizer. An invalid
+// token is reported with an error.
+type TokenVerifier interface {
+	IsToken(s string) bool
+	VerifyToken(ctx context.Context, proxyIP, token string) (TokenResult, error)
+}
+
+// TokenVerifiers is a TokenVerifier trying each one in order, a token goes
+// to the first one it looks like a token to.
+type TokenVerifiers []TokenVerifier
+
+func (tv TokenVerifiers) IsToken(s string) bool {
+	return tv.match(s) != nil
+}
+
+func (tv TokenVerifiers) VerifyToken(ctx context.Context, proxyIP, token string) (TokenResult, error) {
+	v := tv.match(token)
+	if v == nil {
+		return TokenResult{}, ErrNotToken
+	}
+
+	return v.VerifyToken(ctx, proxyIP, token)
+}
+
+func (tv TokenVerifiers) match(s string) TokenVerifier {
+	for _, v := range tv {
+		if v.IsToken(s) {
+			return v
+		}
+	}
+
+	return nil
+}
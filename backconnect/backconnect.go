@@ -0,0 +1,327 @@
+package backconnect
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/duratarskeyk/proxymux/internal/backconnect"
+)
+
+// Header is the HTTP header carrying the base64url encoded envelope, every
+// request of a keep-alive connection needs its own.
+const Header = "X-Backconnect"
+
+// Magic starts every envelope, it tells them apart from the legacy format.
+const Magic = "\xffBC"
+
+const (
+	Version = 1
+
+	AlgHMACSHA256 = 1
+	AlgEd25519    = 2
+)
+
+const (
+	// Magic, version, algorithm and key ID, signing time and nonce
+	headerSize = 3 + 3 + 8 + nonceSize
+	nonceSize  = 16
+	// MaxSize is the size of the largest envelope, one with an IPv6 user IP
+	// and an Ed25519 signature.
+	MaxSize = headerSize + 28 + ed25519.SignatureSize
+
+	defaultMaxAge = 30 * time.Second
+)
+
+// Key is a key envelopes are verified with, either an HMAC-SHA256 secret
+// or an Ed25519 public key, picked by the key ID of the envelope.
+type Key struct {
+	ID      byte
+	HMAC    []byte
+	Ed25519 ed25519.PublicKey
+}
+
+func (k *Key) valid() bool {
+	if k.HMAC != nil {
+		return len(k.HMAC) > 0 && k.Ed25519 == nil
+	}
+
+	return len(k.Ed25519) == ed25519.PublicKeySize
+}
+
+// Verifier checks backconnect envelopes. Envelopes signed more than MaxAge
+// away from now, 30 seconds by default, are stale and nonces seen within
+// that window are replays. Legacy opts into the unsigned format too, 12 or
+// 28 raw bytes after SOCKS requests and the X-Packageid, X-Userid and
+// X-Clientip HTTP headers, while envelopes keep being verified.
+type Verifier struct {
+	Keys   []Key
+	MaxAge time.Duration
+	Legacy bool
+
+	mu        sync.Mutex
+	nonces    map[[nonceSize]byte]time.Time
+	nextSweep time.Time
+	now       func() time.Time
+}
+
+// NewVerifier returns a Verifier of keys, ErrBadKey when one isn't a
+// non-empty HMAC secret or an Ed25519 public key, or shares its ID.
+func NewVerifier(keys ...Key) (*Verifier, error) {
+	for i := range keys {
+		if !keys[i].valid() {
+			return nil, fmt.Errorf("%w %d", ErrBadKey, keys[i].ID)
+		}
+		for j := 0; j < i; j++ {
+			if keys[j].ID == keys[i].ID {
+				return nil, fmt.Errorf("%w %d", ErrBadKey, keys[i].ID)
+			}
+		}
+	}
+
+	return &Verifier{Keys: append([]Key(nil), keys...)}, nil
+}
+
+// Read reads the envelope appended to SOCKS requests.
+func (v *Verifier) Read(r io.Reader) (packageID, userID int, userIP string, err error) {
+	if v == nil {
+		return 0, 0, "", ErrNotConfigured
+	}
+	magic := make([]byte, len(Magic))
+	if _, err = io.ReadFull(r, magic); err != nil {
+		return 0, 0, "", err
+	}
+	if string(magic) != Magic {
+		if v.Legacy {
+			return backconnect.Read(io.MultiReader(bytes.NewReader(magic), r))
+		}
+		return 0, 0, "", ErrMalformed
+	}
+	e, err := v.read(r)
+	if err != nil {
+		return 0, 0, "", err
+	}
+	if err = v.useNonce(e); err != nil {
+		return 0, 0, "", err
+	}
+
+	return e.packageID, e.userID, e.userIP, nil
+}
+
+// ReadHeader verifies the value of the Header header.
+func (v *Verifier) ReadHeader(value string) (packageID, userID int, userIP string, err error) {
+	if v == nil {
+		return 0, 0, "", ErrNotConfigured
+	}
+	data, err := base64.RawURLEncoding.DecodeString(strings.TrimSpace(value))
+	if err != nil || len(data) > MaxSize {
+		return 0, 0, "", ErrMalformed
+	}
+	if !bytes.HasPrefix(data, []byte(Magic)) {
+		if len(data) == 0 {
+			return 0, 0, "", io.EOF
+		}
+		return 0, 0, "", ErrMalformed
+	}
+	r := bytes.NewReader(data[len(Magic):])
+	e, err := v.read(r)
+	if err != nil {
+		return 0, 0, "", err
+	}
+	if r.Len() != 0 {
+		return 0, 0, "", ErrMalformed
+	}
+	if err = v.useNonce(e); err != nil {
+		return 0, 0, "", err
+	}
+
+	return e.packageID, e.userID, e.userIP, nil
+}
+
+type envelope struct {
+	packageID int
+	userID    int
+	userIP    string
+	signedAt  time.Time
+	nonce     [nonceSize]byte
+}
+
+// read reads an envelope following Magic: the version, algorithm and key ID
+// bytes, the big endian unix time it was signed at, a random nonce, the
+// package ID, user ID and user IP in the legacy format, and the signature of
+// everything before, Magic included.
+func (v *Verifier) read(r io.Reader) (*envelope, error) {
+	var signed bytes.Buffer
+	signed.Grow(MaxSize)
+	header := make([]byte, headerSize)
+	copy(header, Magic)
+	if _, err := io.ReadFull(r, header[len(Magic):]); err != nil {
+		return nil, err
+	}
+	fixed := header[len(Magic):]
+	if fixed[0] != Version {
+		return nil, ErrBadVersion
+	}
+	signed.Write(header)
+	e := &envelope{signedAt: time.Unix(int64(binary.BigEndian.Uint64(fixed[3:11])), 0)}
+	copy(e.nonce[:], fixed[11:])
+	var err error
+	if e.packageID, e.userID, e.userIP, err = backconnect.Read(io.TeeReader(r, &signed)); err != nil {
+		return nil, err
+	}
+
+	// keys not checked by NewVerifier are unknown rather than panic
+	key := v.key(fixed[2])
+	if key == nil || !key.valid() {
+		return nil, ErrUnknownKey
+	}
+	var sig []byte
+	switch {
+	case fixed[1] == AlgHMACSHA256 && key.HMAC != nil:
+		sig = make([]byte, sha256.Size)
+	case fixed[1] == AlgEd25519 && key.Ed25519 != nil:
+		sig = make([]byte, ed25519.SignatureSize)
+	default:
+		return nil, ErrUnknownKey
+	}
+	if _, err = io.ReadFull(r, sig); err != nil {
+		return nil, err
+	}
+	if !key.verify(fixed[1], signed.Bytes(), sig) {
+		return nil, ErrBadSignature
+	}
+
+	return e, nil
+}
+
+func (v *Verifier) key(id byte) *Key {
+	for i := range v.Keys {
+		if v.Keys[i].ID == id {
+			return &v.Keys[i]
+		}
+	}
+
+	return nil
+}
+
+func (k *Key) verify(alg byte, signed, sig []byte) bool {
+	if alg == AlgHMACSHA256 {
+		return hmac.Equal(signHMAC(k.HMAC, signed), sig)
+	}
+
+	return ed25519.Verify(k.Ed25519, signed, sig)
+}
+
+func (v *Verifier) useNonce(e *envelope) error {
+	maxAge := v.maxAge()
+	now := v.clock()
+	if e.signedAt.Before(now.Add(-maxAge)) || e.signedAt.After(now.Add(maxAge)) {
+		return &ErrRejected{Timestamp: e.signedAt, err: ErrStale}
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.sweepLocked(now)
+	if v.nonces == nil {
+		v.nonces = make(map[[nonceSize]byte]time.Time)
+	}
+	if _, ok := v.nonces[e.nonce]; ok {
+		return &ErrRejected{Timestamp: e.signedAt, err: ErrReplayed}
+	}
+	// the envelope is stale once this passes, so is any replay of it
+	v.nonces[e.nonce] = e.signedAt.Add(maxAge)
+
+	return nil
+}
+
+// sweepLocked drops nonces of envelopes gone stale at most once per MaxAge.
+func (v *Verifier) sweepLocked(now time.Time) {
+	if now.Before(v.nextSweep) {
+		return
+	}
+	for nonce, expires := range v.nonces {
+		if now.After(expires) {
+			delete(v.nonces, nonce)
+		}
+	}
+	v.nextSweep = now.Add(v.maxAge())
+}
+
+func (v *Verifier) maxAge() time.Duration {
+	if v.MaxAge > 0 {
+		return v.MaxAge
+	}
+
+	return defaultMaxAge
+}
+
+func (v *Verifier) clock() time.Time {
+	if v.now != nil {
+		return v.now()
+	}
+
+	return time.Now()
+}
+
+// Signer makes the envelopes a Verifier with the same key accepts, signing
+// with HMAC when set and Ed25519 otherwise.
+type Signer struct {
+	KeyID   byte
+	HMAC    []byte
+	Ed25519 ed25519.PrivateKey
+}
+
+// Append appends an envelope signed now to b, for SOCKS requests.
+func (s *Signer) Append(b []byte, packageID, userID int, userIP net.IP) ([]byte, error) {
+	return s.append(b, time.Now(), packageID, userID, userIP)
+}
+
+// Header returns the value of the Header header for HTTP requests.
+func (s *Signer) Header(packageID, userID int, userIP net.IP) (string, error) {
+	b, err := s.Append(nil, packageID, userID, userIP)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func (s *Signer) append(b []byte, signedAt time.Time, packageID, userID int, userIP net.IP) ([]byte, error) {
+	start := len(b)
+	alg := byte(AlgEd25519)
+	if s.HMAC != nil {
+		alg = AlgHMACSHA256
+	}
+	b = append(b, Magic...)
+	b = append(b, Version, alg, s.KeyID)
+	b = binary.BigEndian.AppendUint64(b, uint64(signedAt.Unix()))
+	nonce := make([]byte, nonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return b[:start], err
+	}
+	b = append(b, nonce...)
+	b = backconnect.Append(b, packageID, userID, userIP)
+
+	if s.HMAC != nil {
+		return append(b, signHMAC(s.HMAC, b[start:])...), nil
+	}
+
+	return append(b, ed25519.Sign(s.Ed25519, b[start:])...), nil
+}
+
+func signHMAC(secret, signed []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(signed)
+
+	return mac.Sum(nil)
+}
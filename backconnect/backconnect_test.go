@@ -0,0 +1,174 @@
+package backconnect
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestVerifier(t *testing.T) {
+	edPub, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret := []byte("0123456789abcdef0123456789abcdef")
+	v := &Verifier{Keys: []Key{{ID: 1, HMAC: secret}, {ID: 2, Ed25519: edPub}}}
+	now := time.Unix(1700000000, 0)
+	v.now = func() time.Time { return now }
+
+	hmacSigner := &Signer{KeyID: 1, HMAC: secret}
+	edSigner := &Signer{KeyID: 2, Ed25519: edKey}
+	envelope := func(s *Signer, signedAt time.Time, userIP string) []byte {
+		b, err := s.append(nil, signedAt, 5, 55, net.ParseIP(userIP))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	replayed := envelope(hmacSigner, now, "5.5.5.5")
+	tampered := envelope(edSigner, now, "5.5.5.5")
+	tampered[len(tampered)-ed25519.SignatureSize-1]++
+
+	tests := []struct {
+		data   []byte
+		userIP string
+		err    error
+	}{
+		{replayed, "5.5.5.5", nil},
+		{replayed, "", ErrReplayed},
+		{envelope(edSigner, now.Add(-20*time.Second), "2001:db8::5"), "2001:db8::5", nil},
+		{envelope(hmacSigner, now.Add(-31*time.Second), "5.5.5.5"), "", ErrStale},
+		{envelope(hmacSigner, now.Add(31*time.Second), "5.5.5.5"), "", ErrStale},
+		{tampered, "", ErrBadSignature},
+		{envelope(&Signer{KeyID: 1, HMAC: []byte("another secret")}, now, "5.5.5.5"), "", ErrBadSignature},
+		{envelope(&Signer{KeyID: 3, HMAC: secret}, now, "5.5.5.5"), "", ErrUnknownKey},
+		{envelope(&Signer{KeyID: 2, HMAC: secret}, now, "5.5.5.5"), "", ErrUnknownKey},
+		{append([]byte(Magic+"\x02"), replayed[len(Magic)+1:]...), "", ErrBadVersion},
+		{replayed[1:], "", ErrMalformed},
+		{replayed[:len(replayed)-1], "", io.ErrUnexpectedEOF},
+	}
+	for nr, test := range tests {
+		packageID, userID, userIP, err := v.Read(bytes.NewReader(test.data))
+		if !errors.Is(err, test.err) {
+			t.Errorf("Test #%d: Expected %v, got %v", nr+1, test.err, err)
+			continue
+		}
+		var rejected *ErrRejected
+		if errors.Is(err, ErrStale) || errors.Is(err, ErrReplayed) {
+			if !errors.As(err, &rejected) {
+				t.Errorf("Test #%d: Expected ErrRejected, got %T", nr+1, err)
+			}
+		} else if errors.As(err, &rejected) {
+			t.Errorf("Test #%d: Unexpected ErrRejected %v", nr+1, err)
+		}
+		if err == nil && (packageID != 5 || userID != 55 || userIP != test.userIP) {
+			t.Errorf("Test #%d: Expected 5 55 %s, got %d %d %s", nr+1, test.userIP, packageID, userID, userIP)
+		}
+	}
+
+	// replays are forgotten once stale
+	now = now.Add(time.Minute)
+	if _, _, _, err = v.Read(bytes.NewReader(replayed)); !errors.Is(err, ErrStale) {
+		t.Errorf("Expected ErrStale, got %v", err)
+	}
+	if _, _, _, err = v.Read(bytes.NewReader(envelope(hmacSigner, now, "5.5.5.5"))); err != nil || len(v.nonces) != 1 {
+		t.Errorf("Expected the old nonces to be swept, got %v with %d nonces", err, len(v.nonces))
+	}
+}
+
+func TestReadHeader(t *testing.T) {
+	secret := []byte("0123456789abcdef0123456789abcdef")
+	v := &Verifier{Keys: []Key{{ID: 1, HMAC: secret}}}
+	signer := &Signer{KeyID: 1, HMAC: secret}
+	header, err := signer.Header(5, 55, net.ParseIP("5.5.5.5"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := base64.RawURLEncoding.DecodeString(header)
+	trailing := base64.RawURLEncoding.EncodeToString(append(data, 0))
+
+	tests := []struct {
+		value string
+		err   error
+	}{
+		{trailing, ErrMalformed},
+		{header + "AA", ErrMalformed},
+		{"not base64!", ErrMalformed},
+		{"", io.EOF},
+		{" " + header, nil},
+		{header, ErrReplayed},
+	}
+	for nr, test := range tests {
+		packageID, userID, userIP, err := v.ReadHeader(test.value)
+		if !errors.Is(err, test.err) {
+			t.Errorf("Test #%d: Expected %v, got %v", nr+1, test.err, err)
+		} else if err == nil && (packageID != 5 || userID != 55 || userIP != "5.5.5.5") {
+			t.Errorf("Test #%d: Expected 5 55 5.5.5.5, got %d %d %s", nr+1, packageID, userID, userIP)
+		}
+	}
+}
+
+func TestLegacy(t *testing.T) {
+	var v *Verifier
+	data := []byte{0, 0, 0, 5, 0, 0, 0, 55, 5, 5, 5, 5}
+	if _, _, _, err := v.Read(bytes.NewReader(data)); !errors.Is(err, ErrNotConfigured) {
+		t.Errorf("Expected ErrNotConfigured, got %v", err)
+	}
+	secret := []byte("0123456789abcdef0123456789abcdef")
+	signed, err := (&Signer{KeyID: 1, HMAC: secret}).Append(nil, 5, 55, net.ParseIP("5.5.5.5"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	v = &Verifier{Keys: []Key{{ID: 1, HMAC: secret}}, Legacy: true}
+	// envelopes are still verified while migrating
+	for nr, data := range [][]byte{data, signed, signed} {
+		packageID, userID, userIP, err := v.Read(bytes.NewReader(data))
+		if nr == 2 {
+			if !errors.Is(err, ErrReplayed) {
+				t.Errorf("Test #%d: Expected ErrReplayed, got %v", nr+1, err)
+			}
+		} else if err != nil || packageID != 5 || userID != 55 || userIP != "5.5.5.5" {
+			t.Errorf("Test #%d: Expected 5 55 5.5.5.5, got %d %d %s %v", nr+1, packageID, userID, userIP, err)
+		}
+	}
+}
+
+func TestNewVerifier(t *testing.T) {
+	edPub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		keys []Key
+		err  error
+	}{
+		{[]Key{{ID: 1, HMAC: []byte("secret")}, {ID: 2, Ed25519: edPub}}, nil},
+		{[]Key{{ID: 1, Ed25519: edPub[:31]}}, ErrBadKey},
+		{[]Key{{ID: 1, HMAC: []byte{}}}, ErrBadKey},
+		{[]Key{{ID: 1}}, ErrBadKey},
+		{[]Key{{ID: 1, HMAC: []byte("secret"), Ed25519: edPub}}, ErrBadKey},
+		{[]Key{{ID: 1, HMAC: []byte("secret")}, {ID: 1, Ed25519: edPub}}, ErrBadKey},
+	}
+	for nr, test := range tests {
+		if _, err := NewVerifier(test.keys...); !errors.Is(err, test.err) {
+			t.Errorf("Test #%d: Expected %v, got %v", nr+1, test.err, err)
+		}
+	}
+
+	// keys set without NewVerifier don't panic
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	data, err := (&Signer{KeyID: 1, Ed25519: edKey}).Append(nil, 5, 55, net.ParseIP("5.5.5.5"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := &Verifier{Keys: []Key{{ID: 1, Ed25519: edPub[:31]}}}
+	if _, _, _, err = v.Read(bytes.NewReader(data)); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("Expected ErrUnknownKey, got %v", err)
+	}
+}
@@ -0,0 +1,31 @@
+package backconnect
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+var ErrNotConfigured = errors.New("backconnect verifier not configured")
+var ErrMalformed = errors.New("malformed backconnect envelope")
+var ErrBadKey = errors.New("bad backconnect key")
+var ErrBadVersion = errors.New("unsupported backconnect envelope version")
+var ErrUnknownKey = errors.New("unknown backconnect key")
+var ErrBadSignature = errors.New("bad backconnect signature")
+var ErrStale = errors.New("stale backconnect envelope")
+var ErrReplayed = errors.New("replayed backconnect envelope")
+
+// ErrRejected is returned for correctly signed envelopes that are stale or
+// replayed, it matches ErrStale or ErrReplayed.
+type ErrRejected struct {
+	Timestamp time.Time
+	err       error
+}
+
+func (e *ErrRejected) Error() string {
+	return fmt.Sprintf("%s (signed at %s)", e.err, e.Timestamp.UTC().Format(time.RFC3339))
+}
+
+func (e *ErrRejected) Unwrap() error {
+	return e.err
+}
@@ -1,8 +1,14 @@
 package corestructs
 
 import (
+	"context"
 	"net"
+	"net/netip"
 
+	"github.com/duratarskeyk/go-common-utils/authorizer"
+	"github.com/duratarskeyk/proxymux/auth"
+	"github.com/duratarskeyk/proxymux/backconnect"
+	"github.com/duratarskeyk/proxymux/loginparams"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 )
@@ -13,6 +19,16 @@ const (
 	HostTypeHostname
 )
 
+// Resolver looks up the addresses of a hostname, see the resolver package.
+type Resolver interface {
+	LookupIP(ctx context.Context, host string) ([]net.IP, error)
+}
+
+// AddrChecker checks an address before it is connected or sent to.
+type AddrChecker interface {
+	CheckAddr(ip net.IP, port uint16) error
+}
+
 type Fields struct {
 	Conn        net.Conn
 	ProxyConfig interface{}
@@ -23,15 +39,43 @@ type Fields struct {
 
 	UserIP string
 
+	// ProxyIPNum is the IPv4 proxy IP as a number and 0 for IPv6 ones,
+	// ProxyAddr holds the proxy IP of either family.
 	ProxyIP    string
 	ProxyIPNum uint32
+	ProxyAddr  netip.Addr
+
+	IPv6Policy IPv6Policy
+
+	// Resolver, when set, resolves hostname targets before they are dialed
+	// and connections to the addresses ResolverFamily, a resolver.Family,
+	// allows are raced.
+	Resolver       Resolver
+	ResolverFamily int
+
+	// Destinations, when set, checks every address connected or sent to,
+	// after resolution.
+	Destinations AddrChecker
+
+	// LoginParser, when set, splits options off Login before credentials
+	// auth, Login is then the base username and LoginOptions the options.
+	LoginParser *loginparams.Parser
 
-	Login       string
-	Password    string
-	PackageID   int
-	UserID      int
-	Backconnect bool
-	SystemUser  bool
+	// TokenVerifier, when set, checks passwords that are tokens instead
+	// of the auth backend.
+	TokenVerifier auth.TokenVerifier
+
+	// BackconnectVerifier checks the package, user and user IP backconnect
+	// accounts send, they are rejected without one.
+	BackconnectVerifier *backconnect.Verifier
+
+	Login        string
+	LoginOptions loginparams.Options
+	Password     string
+	PackageID    int
+	UserID       int
+	Backconnect  bool
+	SystemUser   bool
 
 	HostType int
 	Host     string
@@ -52,9 +96,73 @@ func (f *Fields) Clean() {
 	f.DialerUDP = nil
 	f.Timeouts = nil
 	f.HostIP = nil
+	f.LoginParser = nil
+	f.TokenVerifier = nil
+	f.BackconnectVerifier = nil
+	f.Destinations = nil
+	f.Resolver = nil
+	f.ResolverFamily = 0
+	f.LoginOptions = f.LoginOptions[:0]
 	f.LogFields = f.LogFields[:0]
 }
 
+// ParseLogin runs LoginParser over Login.
+func (f *Fields) ParseLogin() error {
+	f.LoginOptions = f.LoginOptions[:0]
+	if f.LoginParser == nil {
+		return nil
+	}
+	login, opts, err := f.LoginParser.Parse(f.Login, f.LoginOptions)
+	if err != nil {
+		return err
+	}
+	f.Login, f.LoginOptions = login, opts
+
+	return nil
+}
+
+// TokenAuth verifies Password with TokenVerifier when it's a token, false
+// otherwise. The token's login and options are merged into Login and
+// LoginOptions.
+func (f *Fields) TokenAuth(ctx context.Context) (authorizer.AuthResult, bool, error) {
+	if f.TokenVerifier == nil || !f.TokenVerifier.IsToken(f.Password) {
+		return authorizer.BadAuthResult, false, nil
+	}
+	token, err := f.TokenVerifier.VerifyToken(ctx, f.ProxyIP, f.Password)
+	if err != nil {
+		return authorizer.BadAuthResult, true, err
+	}
+
+	if token.Login != "" {
+		f.Login = token.Login
+	}
+	for _, opt := range f.LoginOptions {
+		if _, ok := token.Options.Get(opt.Key); !ok {
+			token.Options = append(token.Options, opt)
+		}
+	}
+	f.LoginOptions = token.Options
+
+	return token.AuthResult, true, nil
+}
+
+// SetProxyAddr fills ProxyAddr and ProxyIPNum from ProxyIP.
+func (f *Fields) SetProxyAddr() {
+	addr, err := netip.ParseAddr(f.ProxyIP)
+	if err != nil {
+		f.ProxyAddr = netip.Addr{}
+		f.ProxyIPNum = 0
+		return
+	}
+	f.ProxyAddr = addr.Unmap()
+	if f.ProxyAddr.Is4() {
+		octets := f.ProxyAddr.As4()
+		f.ProxyIPNum = uint32(octets[0])<<24 | uint32(octets[1])<<16 | uint32(octets[2])<<8 | uint32(octets[3])
+	} else {
+		f.ProxyIPNum = 0
+	}
+}
+
 func (f *Fields) FillLogFields() {
 	if f.SystemUser {
 		f.LogFields = append(f.LogFields, zap.Bool("system_user", true), zap.String("package_type", "proxy"))
@@ -90,3 +90,23 @@ func TestFillLogFields(t *testing.T) {
 		}
 	}
 }
+
+func TestSetProxyAddr(t *testing.T) {
+	tests := []struct {
+		proxyIP string
+		addr    string
+		num     uint32
+	}{
+		{"1.2.3.4", "1.2.3.4", 0x01020304},
+		{"::ffff:10.0.0.1", "10.0.0.1", 0x0a000001},
+		{"2001:db8::1", "2001:db8::1", 0},
+		{"pipe", "invalid IP", 0},
+	}
+	for nr, test := range tests {
+		f := &Fields{ProxyIP: test.proxyIP, ProxyIPNum: 7}
+		f.SetProxyAddr()
+		if f.ProxyAddr.String() != test.addr || f.ProxyIPNum != test.num {
+			t.Errorf("Test #%d: Expected %s and %x, got %s and %x", nr+1, test.addr, test.num, f.ProxyAddr, f.ProxyIPNum)
+		}
+	}
+}
@@ -0,0 +1,17 @@
+package corestructs
+
+// IPv6Policy decides what happens to requests for IPv6 destinations.
+type IPv6Policy int
+
+const (
+	// IPv6Allow dials IPv6 destinations like any other.
+	IPv6Allow IPv6Policy = iota
+	// IPv6Deny rejects IPv6 literals during the handshake and dials
+	// hostnames over IPv4 only.
+	IPv6Deny
+)
+
+// IPv6Denied reports whether the parsed destination is refused by the policy.
+func (f *Fields) IPv6Denied() bool {
+	return f.IPv6Policy == IPv6Deny && f.HostType == HostTypeIPv6
+}
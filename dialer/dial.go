@@ -0,0 +1,54 @@
+package dialer
+
+import (
+	"context"
+	"net"
+
+	"github.com/duratarskeyk/proxymux/acl"
+	"github.com/duratarskeyk/proxymux/corestructs"
+	"github.com/duratarskeyk/proxymux/resolver"
+)
+
+// Dial connects to the target of a parsed request using fields.DialerTCP
+// within Timeouts.Connect. Hostname targets go through DialResolved when
+// fields.Resolver is set. Errors are returned as *ErrDial.
+func Dial(ctx context.Context, fields *corestructs.Fields) (net.Conn, error) {
+	if fields.Resolver != nil && fields.HostType == corestructs.HostTypeHostname && fields.HostIP == nil {
+		return DialResolved(ctx, fields, fields.Resolver, resolver.Family(fields.ResolverFamily))
+	}
+	dialer := TCPDialer(fields)
+	if fields.Timeouts != nil && fields.Timeouts.Connect > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, fields.Timeouts.Connect)
+		defer cancel()
+	}
+
+	host := fields.Host
+	if fields.HostIP != nil {
+		host = fields.HostIP.String()
+	}
+	network := "tcp"
+	if fields.IPv6Policy == corestructs.IPv6Deny {
+		network = "tcp4"
+	}
+	conn, err := dialer.DialContext(ctx, network, net.JoinHostPort(host, fields.Port))
+	if err != nil {
+		return nil, &ErrDial{Kind: Classify(err), err: err}
+	}
+
+	return conn, nil
+}
+
+// TCPDialer returns fields.DialerTCP, or a copy of it that checks every
+// address with fields.Destinations before connecting when that is set.
+func TCPDialer(fields *corestructs.Fields) *net.Dialer {
+	d := fields.DialerTCP
+	if d == nil {
+		d = &net.Dialer{}
+	}
+	if fields.Destinations == nil {
+		return d
+	}
+
+	return acl.Guard(fields.Destinations, d)
+}
@@ -0,0 +1,80 @@
+package dialer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/duratarskeyk/proxymux/acl"
+	"github.com/duratarskeyk/proxymux/corestructs"
+)
+
+func TestClassify(t *testing.T) {
+	errs := []error{
+		&net.DNSError{Err: "no such host", Name: "example.invalid", IsNotFound: true},
+		&net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)},
+		&net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ENETUNREACH)},
+		&net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.EHOSTUNREACH)},
+		fmt.Errorf("dial: %w", context.DeadlineExceeded),
+		&net.OpError{Op: "dial", Err: os.ErrDeadlineExceeded},
+		&ErrDial{Kind: KindHostUnreachable, err: errors.New("wrapped")},
+		&net.OpError{Op: "dial", Err: (&acl.List{}).CheckAddr(net.IPv4(127, 0, 0, 1), 80)},
+		errors.New("something else"),
+	}
+	kinds := []ErrorKind{
+		KindResolution,
+		KindConnectionRefused,
+		KindNetworkUnreachable,
+		KindHostUnreachable,
+		KindTimeout,
+		KindTimeout,
+		KindHostUnreachable,
+		KindDenied,
+		KindUnknown,
+	}
+	for nr, err := range errs {
+		if kind := Classify(err); kind != kinds[nr] {
+			t.Errorf("Test #%d: Expected kind %d, got %d", nr+1, kinds[nr], kind)
+		}
+	}
+}
+
+func TestDial(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := fmt.Sprint(ln.Addr().(*net.TCPAddr).Port)
+
+	fields := &corestructs.Fields{
+		Host:     "127.0.0.1",
+		HostIP:   net.IPv4(127, 0, 0, 1),
+		Port:     port,
+		Timeouts: &corestructs.Timeouts{Connect: time.Second},
+	}
+	conn, err := Dial(context.Background(), fields)
+	if err != nil {
+		t.Fatalf("Expected successful dial, got %s", err)
+	}
+	conn.Close()
+
+	// a hostname resolving to a denied address is caught while dialing
+	fields.Host, fields.HostIP, fields.HostType = "localhost", nil, corestructs.HostTypeHostname
+	fields.Destinations = &acl.List{}
+	if _, err = Dial(context.Background(), fields); Classify(err) != KindDenied {
+		t.Errorf("Expected denied, got %v", err)
+	}
+	fields.Host, fields.HostIP, fields.Destinations = "127.0.0.1", net.IPv4(127, 0, 0, 1), nil
+
+	ln.Close()
+	_, err = Dial(context.Background(), fields)
+	var dialErr *ErrDial
+	if !errors.As(err, &dialErr) || dialErr.Kind != KindConnectionRefused {
+		t.Errorf("Expected connection refused, got %v", err)
+	}
+}
@@ -0,0 +1,72 @@
+package dialer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+
+	"github.com/duratarskeyk/proxymux/acl"
+)
+
+type ErrorKind int
+
+const (
+	KindUnknown ErrorKind = iota
+	KindResolution
+	KindConnectionRefused
+	KindNetworkUnreachable
+	KindHostUnreachable
+	KindTimeout
+	KindDenied
+)
+
+type ErrDial struct {
+	Kind ErrorKind
+	err  error
+}
+
+func NewErrDial(kind ErrorKind, err error) *ErrDial {
+	return &ErrDial{Kind: kind, err: err}
+}
+
+func (e *ErrDial) Error() string {
+	return fmt.Sprintf("dial error: %s", e.err)
+}
+
+func (e *ErrDial) Unwrap() error {
+	return e.err
+}
+
+// Classify returns the kind of a dial error. Errors returned by Dial carry
+// their kind already, anything else is inspected.
+func Classify(err error) ErrorKind {
+	var dialErr *ErrDial
+	if errors.As(err, &dialErr) {
+		return dialErr.Kind
+	}
+
+	var dnsErr *net.DNSError
+	switch {
+	case errors.Is(err, acl.ErrDenied):
+		return KindDenied
+	case errors.As(err, &dnsErr):
+		return KindResolution
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return KindConnectionRefused
+	case errors.Is(err, syscall.ENETUNREACH):
+		return KindNetworkUnreachable
+	case errors.Is(err, syscall.EHOSTUNREACH):
+		return KindHostUnreachable
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, os.ErrDeadlineExceeded):
+		return KindTimeout
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return KindTimeout
+	}
+
+	return KindUnknown
+}
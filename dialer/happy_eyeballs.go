@@ -0,0 +1,158 @@
+package dialer
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/duratarskeyk/proxymux/corestructs"
+	"github.com/duratarskeyk/proxymux/resolver"
+)
+
+// RFC 8305 section 5 recommended Connection Attempt Delay
+const attemptDelay = 250 * time.Millisecond
+
+var dialContext = func(d *net.Dialer, ctx context.Context, network, address string) (net.Conn, error) {
+	return d.DialContext(ctx, network, address)
+}
+
+type attempt struct {
+	conn net.Conn
+	ip   net.IP
+	err  error
+}
+
+// DialResolved resolves a hostname target with r and races connections to
+// the addresses allowed by family, IPv4 only under IPv6Deny, all within
+// Timeouts.Connect. Other targets are dialed directly.
+func DialResolved(ctx context.Context, fields *corestructs.Fields, r resolver.Resolver, family resolver.Family) (net.Conn, error) {
+	if fields.HostType != corestructs.HostTypeHostname || fields.HostIP != nil {
+		return Dial(ctx, fields)
+	}
+	if fields.Timeouts != nil && fields.Timeouts.Connect > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, fields.Timeouts.Connect)
+		defer cancel()
+	}
+	if fields.IPv6Policy == corestructs.IPv6Deny {
+		family = resolver.FamilyIPv4Only
+	}
+
+	ips, err := resolver.LookupFamily(ctx, r, fields, family)
+	if err != nil {
+		return nil, &ErrDial{Kind: KindResolution, err: err}
+	}
+
+	return DialAny(ctx, fields, ips)
+}
+
+// DialAny races connection attempts to ips following RFC 8305: families are
+// interleaved starting with the family of ips[0] and a new attempt starts
+// every attemptDelay or as soon as the previous one fails, all within
+// Timeouts.Connect. The winning address is stored in fields.HostIP and
+// fields.HostType.
+func DialAny(ctx context.Context, fields *corestructs.Fields, ips []net.IP) (net.Conn, error) {
+	if len(ips) == 0 {
+		return Dial(ctx, fields)
+	}
+	dialer := TCPDialer(fields)
+	if fields.Timeouts != nil && fields.Timeouts.Connect > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, fields.Timeouts.Connect)
+		defer cancel()
+	}
+	attemptCtx, cancelAttempts := context.WithCancel(ctx)
+	defer cancelAttempts()
+
+	ips = interleave(ips)
+	results := make(chan attempt)
+	next, pending := 0, 0
+	start := func() {
+		ip := ips[next]
+		next++
+		pending++
+		go func() {
+			conn, err := dialContext(dialer, attemptCtx, "tcp", net.JoinHostPort(ip.String(), fields.Port))
+			results <- attempt{conn: conn, ip: ip, err: err}
+		}()
+	}
+
+	start()
+	timer := time.NewTimer(attemptDelay)
+	defer timer.Stop()
+	var firstErr error
+	for pending > 0 {
+		select {
+		case res := <-results:
+			pending--
+			if res.err == nil {
+				cancelAttempts()
+				go closeLosers(results, pending)
+				fields.HostIP = res.ip
+				if res.ip.To4() != nil {
+					fields.HostType = corestructs.HostTypeIPv4
+				} else {
+					fields.HostType = corestructs.HostTypeIPv6
+				}
+				return res.conn, nil
+			}
+			if firstErr == nil {
+				firstErr = res.err
+			}
+			if next < len(ips) {
+				start()
+				resetTimer(timer)
+			}
+		case <-timer.C:
+			if next < len(ips) {
+				start()
+				timer.Reset(attemptDelay)
+			}
+		}
+	}
+
+	return nil, &ErrDial{Kind: Classify(firstErr), err: firstErr}
+}
+
+func closeLosers(results chan attempt, pending int) {
+	for i := 0; i < pending; i++ {
+		if res := <-results; res.conn != nil {
+			res.conn.Close()
+		}
+	}
+}
+
+func resetTimer(timer *time.Timer) {
+	if !timer.Stop() {
+		select {
+		case <-timer.C:
+		default:
+		}
+	}
+	timer.Reset(attemptDelay)
+}
+
+// interleave alternates address families, RFC 8305 section 4.
+func interleave(ips []net.IP) []net.IP {
+	var first, second []net.IP
+	firstIs4 := ips[0].To4() != nil
+	for _, ip := range ips {
+		if (ip.To4() != nil) == firstIs4 {
+			first = append(first, ip)
+		} else {
+			second = append(second, ip)
+		}
+	}
+
+	res := make([]net.IP, 0, len(ips))
+	for i := 0; i < len(first) || i < len(second); i++ {
+		if i < len(first) {
+			res = append(res, first[i])
+		}
+		if i < len(second) {
+			res = append(res, second[i])
+		}
+	}
+
+	return res
+}
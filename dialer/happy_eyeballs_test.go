@@ -0,0 +1,132 @@
+package dialer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/duratarskeyk/proxymux/corestructs"
+	"github.com/duratarskeyk/proxymux/resolver"
+)
+
+func TestInterleave(t *testing.T) {
+	ips := []net.IP{
+		net.ParseIP("2001:db8::1"),
+		net.ParseIP("2001:db8::2"),
+		net.ParseIP("2001:db8::3"),
+		net.ParseIP("192.0.2.1"),
+	}
+	expected := []string{"2001:db8::1", "192.0.2.1", "2001:db8::2", "2001:db8::3"}
+	res := interleave(ips)
+	for i, ip := range res {
+		if ip.String() != expected[i] {
+			t.Errorf("Address %d: expected %s, got %s", i+1, expected[i], ip)
+		}
+	}
+}
+
+func TestDialAnyBrokenIPv6(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	origDial := dialContext
+	defer func() { dialContext = origDial }()
+	dialContext = func(d *net.Dialer, ctx context.Context, network, address string) (net.Conn, error) {
+		host, _, _ := net.SplitHostPort(address)
+		if net.ParseIP(host).To4() == nil {
+			// blackholed IPv6 path
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}
+		return d.DialContext(ctx, network, "127.0.0.1:"+fmt.Sprint(ln.Addr().(*net.TCPAddr).Port))
+	}
+
+	fields := &corestructs.Fields{
+		Host:     "dual.example",
+		Port:     "80",
+		HostType: corestructs.HostTypeHostname,
+		Timeouts: &corestructs.Timeouts{Connect: 5 * time.Second},
+	}
+	start := time.Now()
+	conn, err := DialAny(context.Background(), fields, []net.IP{net.ParseIP("2001:db8::1"), net.ParseIP("192.0.2.1")})
+	if err != nil {
+		t.Fatalf("Expected successful dial, got %s", err)
+	}
+	conn.Close()
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Fallback took %s", elapsed)
+	}
+	if fields.HostIP.String() != "192.0.2.1" || fields.HostType != corestructs.HostTypeIPv4 {
+		t.Errorf("Expected winner 192.0.2.1/IPv4, got %s/%d", fields.HostIP, fields.HostType)
+	}
+}
+
+func TestDialAnyAllFail(t *testing.T) {
+	origDial := dialContext
+	defer func() { dialContext = origDial }()
+	attempts := 0
+	dialContext = func(d *net.Dialer, ctx context.Context, network, address string) (net.Conn, error) {
+		attempts++
+		return nil, &net.OpError{Op: "dial", Err: errors.New("connection refused")}
+	}
+
+	fields := &corestructs.Fields{
+		Port:     "80",
+		Timeouts: &corestructs.Timeouts{Connect: time.Second},
+	}
+	_, err := DialAny(context.Background(), fields, []net.IP{net.ParseIP("192.0.2.1"), net.ParseIP("192.0.2.2"), net.ParseIP("2001:db8::1")})
+	var dialErr *ErrDial
+	if !errors.As(err, &dialErr) {
+		t.Errorf("Expected *ErrDial, got %v", err)
+	}
+	if attempts != 3 {
+		t.Errorf("Expected 3 attempts, got %d", attempts)
+	}
+}
+
+type testResolver map[string][]net.IP
+
+func (r testResolver) LookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	ips, ok := r[host]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return ips, nil
+}
+
+func TestDialResolver(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	// the first address refuses, the next one is tried
+	fields := &corestructs.Fields{
+		Host:           "dual.example",
+		HostType:       corestructs.HostTypeHostname,
+		Port:           fmt.Sprint(ln.Addr().(*net.TCPAddr).Port),
+		Timeouts:       &corestructs.Timeouts{Connect: 5 * time.Second},
+		Resolver:       testResolver{"dual.example": {net.ParseIP("2001:db8::1"), net.IPv4(127, 0, 0, 2), net.IPv4(127, 0, 0, 1)}},
+		ResolverFamily: int(resolver.FamilyIPv4Only),
+	}
+	conn, err := Dial(context.Background(), fields)
+	if err != nil {
+		t.Fatalf("Expected successful dial, got %s", err)
+	}
+	conn.Close()
+	if !fields.HostIP.Equal(net.IPv4(127, 0, 0, 1)) || fields.HostType != corestructs.HostTypeIPv4 {
+		t.Errorf("Expected winner 127.0.0.1/IPv4, got %s/%d", fields.HostIP, fields.HostType)
+	}
+
+	fields.Host, fields.HostIP, fields.HostType = "missing.example", nil, corestructs.HostTypeHostname
+	if _, err = Dial(context.Background(), fields); Classify(err) != KindResolution {
+		t.Errorf("Expected resolution error, got %v", err)
+	}
+}
@@ -0,0 +1,103 @@
+package egress
+
+import (
+	"net"
+	"sync"
+	"syscall"
+
+	"github.com/duratarskeyk/proxymux/corestructs"
+)
+
+type dialers struct {
+	tcp *net.Dialer
+	udp *net.Dialer
+}
+
+// Binder hands out dialers bound to the egress IP of a proxy IP: the
+// Overrides entry for it if there is one, the proxy IP itself otherwise.
+// Dialers are built once per egress IP and shared, they must not be
+// modified. Base, when set, is the template for all of them.
+//
+// Freebind and Transparent set IP_FREEBIND and IP_TRANSPARENT on outgoing
+// sockets, allowing to bind addresses not configured on the host. They are
+// only supported on Linux.
+type Binder struct {
+	Base        *net.Dialer
+	Overrides   map[string]string
+	Freebind    bool
+	Transparent bool
+
+	cache sync.Map
+}
+
+func (b *Binder) EgressIP(proxyIP string) string {
+	if ip, ok := b.Overrides[proxyIP]; ok {
+		return ip
+	}
+
+	return proxyIP
+}
+
+func (b *Binder) TCP(proxyIP string) *net.Dialer {
+	return b.get(proxyIP).tcp
+}
+
+func (b *Binder) UDP(proxyIP string) *net.Dialer {
+	return b.get(proxyIP).udp
+}
+
+// Bind sets fields.DialerTCP and fields.DialerUDP for fields.ProxyIP.
+func (b *Binder) Bind(fields *corestructs.Fields) {
+	d := b.get(fields.ProxyIP)
+	fields.DialerTCP = d.tcp
+	fields.DialerUDP = d.udp
+}
+
+// BindIP sets fields.DialerTCP and fields.DialerUDP for egressIP, which is
+// used as is, bypassing Overrides.
+func (b *Binder) BindIP(fields *corestructs.Fields, egressIP string) {
+	d := b.lookup(egressIP)
+	fields.DialerTCP = d.tcp
+	fields.DialerUDP = d.udp
+}
+
+func (b *Binder) get(proxyIP string) *dialers {
+	return b.lookup(b.EgressIP(proxyIP))
+}
+
+func (b *Binder) lookup(egressIP string) *dialers {
+	if d, ok := b.cache.Load(egressIP); ok {
+		return d.(*dialers)
+	}
+
+	d := &dialers{}
+	var tcp, udp net.Dialer
+	if b.Base != nil {
+		tcp = *b.Base
+		udp = *b.Base
+	}
+	if ip := net.ParseIP(egressIP); ip != nil {
+		tcp.LocalAddr = &net.TCPAddr{IP: ip}
+		udp.LocalAddr = &net.UDPAddr{IP: ip}
+	}
+	if b.Freebind || b.Transparent {
+		tcp.Control = b.chainControl(tcp.Control)
+		udp.Control = b.chainControl(udp.Control)
+	}
+	d.tcp, d.udp = &tcp, &udp
+
+	actual, _ := b.cache.LoadOrStore(egressIP, d)
+	return actual.(*dialers)
+}
+
+func (b *Binder) chainControl(next func(network, address string, c syscall.RawConn) error) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		if err := setSockopts(c, b.Freebind, b.Transparent); err != nil {
+			return err
+		}
+		if next != nil {
+			return next(network, address, c)
+		}
+		return nil
+	}
+}
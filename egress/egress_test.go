@@ -0,0 +1,73 @@
+package egress
+
+import (
+	"net"
+	"testing"
+
+	"github.com/duratarskeyk/proxymux/corestructs"
+)
+
+func TestBinder(t *testing.T) {
+	b := &Binder{Overrides: map[string]string{"10.0.0.1": "127.0.0.1", "10.0.0.2": "bad"}}
+	tests := []struct {
+		proxyIP string
+		egress  string
+	}{
+		{"127.0.0.1", "127.0.0.1"},
+		{"10.0.0.1", "127.0.0.1"},
+		{"::1", "::1"},
+		{"10.0.0.2", ""},
+	}
+	for nr, test := range tests {
+		tcp, udp := b.TCP(test.proxyIP), b.UDP(test.proxyIP)
+		if test.egress == "" {
+			if tcp.LocalAddr != nil || udp.LocalAddr != nil {
+				t.Errorf("Test #%d: Expected no local address, got %v and %v", nr+1, tcp.LocalAddr, udp.LocalAddr)
+			}
+			continue
+		}
+		tcpAddr, ok := tcp.LocalAddr.(*net.TCPAddr)
+		if !ok || tcpAddr.IP.String() != test.egress || tcpAddr.Port != 0 {
+			t.Errorf("Test #%d: Expected TCP local address %s, got %v", nr+1, test.egress, tcp.LocalAddr)
+		}
+		udpAddr, ok := udp.LocalAddr.(*net.UDPAddr)
+		if !ok || udpAddr.IP.String() != test.egress || udpAddr.Port != 0 {
+			t.Errorf("Test #%d: Expected UDP local address %s, got %v", nr+1, test.egress, udp.LocalAddr)
+		}
+	}
+
+	if b.TCP("10.0.0.1") != b.TCP("127.0.0.1") {
+		t.Error("Expected dialers to be shared per egress IP")
+	}
+
+	fields := &corestructs.Fields{ProxyIP: "10.0.0.1"}
+	b.Bind(fields)
+	if fields.DialerTCP != b.TCP("127.0.0.1") || fields.DialerUDP != b.UDP("127.0.0.1") {
+		t.Error("Expected Bind to set both dialers")
+	}
+	b.BindIP(fields, "10.0.0.1")
+	if ip := fields.DialerTCP.LocalAddr.(*net.TCPAddr).IP.String(); ip != "10.0.0.1" {
+		t.Errorf("Expected BindIP to bypass overrides, got %s", ip)
+	}
+}
+
+func TestBinderDial(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	b := &Binder{Base: &net.Dialer{}, Overrides: map[string]string{"192.0.2.1": "127.0.0.1"}}
+	conn, err := b.TCP("192.0.2.1").Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if ip := conn.LocalAddr().(*net.TCPAddr).IP.String(); ip != "127.0.0.1" {
+		t.Errorf("Expected connection from 127.0.0.1, got %s", ip)
+	}
+	if b.Base.LocalAddr != nil {
+		t.Error("Expected Base to be left untouched")
+	}
+}
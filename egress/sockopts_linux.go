@@ -0,0 +1,37 @@
+package egress
+
+import "syscall"
+
+const (
+	ipFreebind      = 15
+	ipTransparent   = 19
+	ipv6Transparent = 75
+	ipv6Freebind    = 78
+)
+
+func setSockopts(c syscall.RawConn, freebind, transparent bool) error {
+	var err error
+	cerr := c.Control(func(fd uintptr) {
+		// the socket family isn't known here, set both and keep the first
+		// error that isn't caused by a family mismatch
+		set := func(level, opt int) {
+			serr := syscall.SetsockoptInt(int(fd), level, opt, 1)
+			if serr != nil && serr != syscall.ENOPROTOOPT && err == nil {
+				err = serr
+			}
+		}
+		if freebind {
+			set(syscall.IPPROTO_IP, ipFreebind)
+			set(syscall.IPPROTO_IPV6, ipv6Freebind)
+		}
+		if transparent {
+			set(syscall.IPPROTO_IP, ipTransparent)
+			set(syscall.IPPROTO_IPV6, ipv6Transparent)
+		}
+	})
+	if cerr != nil {
+		return cerr
+	}
+
+	return err
+}
@@ -0,0 +1,27 @@
+package egress
+
+import (
+	"context"
+	"net"
+	"testing"
+)
+
+func TestFreebind(t *testing.T) {
+	// 192.0.2.1 isn't configured on the host, binding it needs IP_FREEBIND
+	d := (&Binder{Freebind: true}).UDP("192.0.2.1")
+	lc := net.ListenConfig{Control: d.Control}
+	conn, err := lc.ListenPacket(context.Background(), "udp", d.LocalAddr.String())
+	if err != nil {
+		t.Fatalf("Expected freebind bind to succeed, got %s", err)
+	}
+	conn.Close()
+
+	d = (&Binder{}).UDP("192.0.2.1")
+	if d.Control != nil {
+		t.Error("Expected no Control without socket options")
+	}
+	if conn, err := net.ListenPacket("udp", d.LocalAddr.String()); err == nil {
+		conn.Close()
+		t.Error("Expected bind without freebind to fail")
+	}
+}
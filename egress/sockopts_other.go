@@ -0,0 +1,14 @@
+//go:build !linux
+
+package egress
+
+import (
+	"errors"
+	"syscall"
+)
+
+var ErrUnsupported = errors.New("freebind and transparent sockets are only supported on linux")
+
+func setSockopts(c syscall.RawConn, freebind, transparent bool) error {
+	return ErrUnsupported
+}
@@ -0,0 +1,38 @@
+package fileauth
+
+import (
+	"errors"
+	"fmt"
+)
+
+var ErrEmptyUsername = errors.New("empty username")
+var ErrDuplicateUser = errors.New("duplicate user")
+var ErrUnknownHash = errors.New("unknown password hash format")
+var ErrBadHash = errors.New("malformed password hash")
+var ErrBadLine = errors.New("malformed htpasswd line")
+
+type ErrUser struct {
+	Username string
+	err      error
+}
+
+func (e *ErrUser) Error() string {
+	return fmt.Sprintf("user %q: %s", e.Username, e.err)
+}
+
+func (e *ErrUser) Unwrap() error {
+	return e.err
+}
+
+type ErrLine struct {
+	Line int
+	err  error
+}
+
+func (e *ErrLine) Error() string {
+	return fmt.Sprintf("line %d: %s", e.Line, e.err)
+}
+
+func (e *ErrLine) Unwrap() error {
+	return e.err
+}
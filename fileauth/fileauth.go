@@ -0,0 +1,208 @@
+package fileauth
+
+import (
+	"context"
+	"net/netip"
+	"os"
+	"os/signal"
+	"sort"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/duratarskeyk/go-common-utils/authorizer"
+)
+
+type User struct {
+	Username    string   `json:"username" yaml:"username"`
+	Password    string   `json:"password" yaml:"password"`
+	PackageID   int      `json:"package_id" yaml:"package_id"`
+	UserID      int      `json:"user_id" yaml:"user_id"`
+	SystemUser  bool     `json:"system_user" yaml:"system_user"`
+	Backconnect bool     `json:"backconnect" yaml:"backconnect"`
+	AllowedIPs  []string `json:"allowed_ips" yaml:"allowed_ips"`
+
+	hash     hash
+	prefixes []netip.Prefix
+}
+
+func (u *User) result() authorizer.AuthResult {
+	return authorizer.AuthResult{
+		OK:          true,
+		PackageID:   u.PackageID,
+		UserID:      u.UserID,
+		SystemUser:  u.SystemUser,
+		Backconnect: u.Backconnect,
+	}
+}
+
+type ipEntry struct {
+	prefix netip.Prefix
+	user   *User
+}
+
+type db struct {
+	users map[string]*User
+	// longest prefixes first
+	ips []ipEntry
+
+	modTime time.Time
+	size    int64
+}
+
+// Authorizer is an authorizer.Authorizer backed by a users file. Files
+// ending in .json and .yaml or .yml hold a users list, anything else is read
+// as htpasswd lines, see ParseHtpasswd. Passwords are bcrypt or argon2 PHC
+// hashes, users without one can only be IP authorized through AllowedIPs,
+// a list of IPs and CIDRs.
+//
+// Reload swaps the users atomically, handshakes already running keep
+// the users they started with. Checking bcrypt and argon2 hashes is slow
+// on purpose, put an auth.Cache in front of it for busy proxies.
+type Authorizer struct {
+	Path string
+
+	db atomic.Pointer[db]
+}
+
+func Load(path string) (*Authorizer, error) {
+	a := &Authorizer{Path: path}
+	if err := a.Reload(); err != nil {
+		return nil, err
+	}
+
+	return a, nil
+}
+
+// Reload reads Path again, keeping the current users when it fails.
+func (a *Authorizer) Reload() error {
+	info, err := os.Stat(a.Path)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(a.Path)
+	if err != nil {
+		return err
+	}
+	users, err := parse(a.Path, data)
+	if err != nil {
+		return err
+	}
+	d, err := build(users)
+	if err != nil {
+		return err
+	}
+	d.modTime, d.size = info.ModTime(), info.Size()
+	a.db.Store(d)
+
+	return nil
+}
+
+// Watch reloads the file on SIGHUP and when its modification time or size
+// changes, checked every interval, until ctx is done. Reload errors are
+// passed to onError when it's not nil.
+func (a *Authorizer) Watch(ctx context.Context, interval time.Duration, onError func(err error)) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+		case <-ticker.C:
+			info, err := os.Stat(a.Path)
+			if err == nil {
+				d := a.db.Load()
+				if d != nil && info.ModTime().Equal(d.modTime) && info.Size() == d.size {
+					continue
+				}
+			}
+		}
+		if err := a.Reload(); err != nil && onError != nil {
+			onError(err)
+		}
+	}
+}
+
+func (a *Authorizer) IPAuth(proxyIP, userIP string) authorizer.AuthResult {
+	d := a.db.Load()
+	ip, err := netip.ParseAddr(userIP)
+	if d == nil || err != nil {
+		return authorizer.BadAuthResult
+	}
+	ip = ip.Unmap()
+	for _, entry := range d.ips {
+		if entry.prefix.Contains(ip) {
+			return entry.user.result()
+		}
+	}
+
+	return authorizer.BadAuthResult
+}
+
+func (a *Authorizer) CredentialsAuth(proxyIP, username, password string) authorizer.AuthResult {
+	d := a.db.Load()
+	var user *User
+	if d != nil {
+		user = d.users[username]
+	}
+	if user == nil || user.hash == nil {
+		// spend the same time as for a wrong password
+		dummyHash.verify(password)
+		return authorizer.BadAuthResult
+	}
+	if !user.hash.verify(password) {
+		return authorizer.BadAuthResult
+	}
+
+	return user.result()
+}
+
+func build(users []*User) (*db, error) {
+	d := &db{users: make(map[string]*User, len(users))}
+	for _, u := range users {
+		if u.Username == "" {
+			return nil, ErrEmptyUsername
+		}
+		if _, ok := d.users[u.Username]; ok {
+			return nil, &ErrUser{Username: u.Username, err: ErrDuplicateUser}
+		}
+		if u.Password != "" {
+			var err error
+			if u.hash, err = parseHash(u.Password); err != nil {
+				return nil, &ErrUser{Username: u.Username, err: err}
+			}
+		}
+		for _, s := range u.AllowedIPs {
+			prefix, err := parsePrefix(s)
+			if err != nil {
+				return nil, &ErrUser{Username: u.Username, err: err}
+			}
+			u.prefixes = append(u.prefixes, prefix)
+			d.ips = append(d.ips, ipEntry{prefix: prefix, user: u})
+		}
+		d.users[u.Username] = u
+	}
+	sort.SliceStable(d.ips, func(i, j int) bool {
+		return d.ips[i].prefix.Bits() > d.ips[j].prefix.Bits()
+	})
+
+	return d, nil
+}
+
+func parsePrefix(s string) (netip.Prefix, error) {
+	if ip, err := netip.ParseAddr(s); err == nil {
+		ip = ip.Unmap()
+		return netip.PrefixFrom(ip, ip.BitLen()), nil
+	}
+	prefix, err := netip.ParsePrefix(s)
+	if err != nil {
+		return prefix, err
+	}
+
+	return prefix.Masked(), nil
+}
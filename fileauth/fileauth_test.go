@@ -0,0 +1,166 @@
+package fileauth
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/duratarskeyk/go-common-utils/authorizer"
+)
+
+const (
+	bcryptSecret   = "$2a$04$dkivXWUwNbsJVnIoRBgWhORYAiVhrbHPeGSx1YSBjx8Uxd1bGN1fO"
+	argon2idHunter = "$argon2id$v=19$m=1024,t=1,p=1$c2FsdHNhbHRzYWx0c2FsdA$TG3TNh0UlIp7ZkGKbHzVmoKy3QnTx9+peBju9GgIUrQ"
+	argon2iHunter  = "$argon2i$v=19$m=1024,t=1,p=1$c2FsdHNhbHRzYWx0c2FsdA$eVgK7CSpJurpbh6hhOFujADP7T5hbkVVC2LWEoKmJC8"
+)
+
+var testFiles = map[string]string{
+	"users": "# comment\n" +
+		"alice:" + bcryptSecret + ":1:11\n" +
+		"bob:" + argon2idHunter + ":2:22:backconnect:10.0.0.0/8,2001:db8::/32\n" +
+		"carol:" + argon2iHunter + ":3:33:system\n" +
+		"office::4:44::10.1.2.3\n",
+	"users.json": `{"users": [
+		{"username": "alice", "password": "` + bcryptSecret + `", "package_id": 1, "user_id": 11},
+		{"username": "bob", "password": "` + argon2idHunter + `", "package_id": 2, "user_id": 22, "backconnect": true, "allowed_ips": ["10.0.0.0/8", "2001:db8::/32"]},
+		{"username": "carol", "password": "` + argon2iHunter + `", "package_id": 3, "user_id": 33, "system_user": true},
+		{"username": "office", "package_id": 4, "user_id": 44, "allowed_ips": ["10.1.2.3"]}
+	]}`,
+	"users.yaml": "users:\n" +
+		"  - {username: alice, password: '" + bcryptSecret + "', package_id: 1, user_id: 11}\n" +
+		"  - username: bob\n" +
+		"    password: '" + argon2idHunter + "'\n" +
+		"    package_id: 2\n" +
+		"    user_id: 22\n" +
+		"    backconnect: true\n" +
+		"    allowed_ips: [10.0.0.0/8, '2001:db8::/32']\n" +
+		"  - {username: carol, password: '" + argon2iHunter + "', package_id: 3, user_id: 33, system_user: true}\n" +
+		"  - {username: office, package_id: 4, user_id: 44, allowed_ips: [10.1.2.3]}\n",
+}
+
+func writeFile(t *testing.T, dir, name, data string) string {
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func TestAuthorizer(t *testing.T) {
+	credentials := []struct {
+		username string
+		password string
+		result   authorizer.AuthResult
+	}{
+		{"alice", "secret", authorizer.AuthResult{OK: true, PackageID: 1, UserID: 11}},
+		{"alice", "wrong", authorizer.BadAuthResult},
+		{"bob", "hunter2", authorizer.AuthResult{OK: true, PackageID: 2, UserID: 22, Backconnect: true}},
+		{"carol", "hunter3", authorizer.AuthResult{OK: true, PackageID: 3, UserID: 33, SystemUser: true}},
+		{"office", "", authorizer.BadAuthResult},
+		{"nobody", "secret", authorizer.BadAuthResult},
+	}
+	ips := []struct {
+		userIP string
+		userID int
+	}{
+		{"10.1.2.3", 44},
+		{"10.9.9.9", 22},
+		{"::ffff:10.9.9.9", 22},
+		{"2001:db8::1", 22},
+		{"192.168.0.1", 0},
+		{"pipe", 0},
+	}
+	dir := t.TempDir()
+	for name, data := range testFiles {
+		a, err := Load(writeFile(t, dir, name, data))
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		for nr, c := range credentials {
+			if result := a.CredentialsAuth("1.2.3.4", c.username, c.password); result != c.result {
+				t.Errorf("%s: Test #%d: Expected %+v, got %+v", name, nr+1, c.result, result)
+			}
+		}
+		for nr, ip := range ips {
+			result := a.IPAuth("1.2.3.4", ip.userIP)
+			if result.OK != (ip.userID != 0) || result.UserID != ip.userID {
+				t.Errorf("%s: IP test #%d: Expected user %d, got %+v", name, nr+1, ip.userID, result)
+			}
+		}
+	}
+}
+
+func TestBadFiles(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		err  error
+	}{
+		{"users", "alice:plaintext\n", ErrUnknownHash},
+		{"users", "alice:$2a$04$short\n", ErrBadHash},
+		{"users", "alice:$argon2id$v=19$m=0,t=1,p=1$c2FsdA$a2V5\n", ErrBadHash},
+		{"users", "alice:" + bcryptSecret + ":x\n", ErrBadLine},
+		{"users", "alice:" + bcryptSecret + "::::\n" + "alice::1\n", ErrDuplicateUser},
+		{"users", "office::1:1:admin\n", ErrBadLine},
+		{"users.json", `{"users": [{"username": ""}]}`, ErrEmptyUsername},
+		{"users.yaml", "users:\n  - {username: office, allowed_ips: [10.0.0.0/33]}\n", nil},
+	}
+	dir := t.TempDir()
+	for nr, test := range tests {
+		_, err := Load(writeFile(t, dir, test.name, test.data))
+		if err == nil || (test.err != nil && !errors.Is(err, test.err)) {
+			t.Errorf("Test #%d: Expected error %v, got %v", nr+1, test.err, err)
+		}
+	}
+}
+
+func TestWatch(t *testing.T) {
+	dir := t.TempDir()
+	path := writeFile(t, dir, "users", "office::1:11::10.0.0.1\n")
+	a, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	errs := make(chan error, 10)
+	go a.Watch(ctx, 10*time.Millisecond, func(err error) {
+		errs <- err
+	})
+
+	waitFor := func(userIP string, ok bool) {
+		t.Helper()
+		deadline := time.Now().Add(2 * time.Second)
+		for a.IPAuth("1.2.3.4", userIP).OK != ok {
+			if time.Now().After(deadline) {
+				t.Fatalf("Expected IPAuth of %s to be %v after reload", userIP, ok)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+
+	writeFile(t, dir, "users", "office::1:11::10.0.0.1,10.0.0.2\n")
+	waitFor("10.0.0.2", true)
+
+	// a broken file keeps the old users
+	writeFile(t, dir, "users", "office:broken\n")
+	select {
+	case err := <-errs:
+		if !errors.Is(err, ErrUnknownHash) {
+			t.Errorf("Expected ErrUnknownHash, got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected reload error")
+	}
+	if !a.IPAuth("1.2.3.4", "10.0.0.2").OK {
+		t.Error("Expected previous users to stay after a failed reload")
+	}
+
+	writeFile(t, dir, "users", "office::1:11::10.0.0.3\n")
+	waitFor("10.0.0.2", false)
+	waitFor("10.0.0.3", true)
+}
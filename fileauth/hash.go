@@ -0,0 +1,87 @@
+package fileauth
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+type hash interface {
+	verify(password string) bool
+}
+
+type bcryptHash []byte
+
+func (h bcryptHash) verify(password string) bool {
+	return bcrypt.CompareHashAndPassword(h, []byte(password)) == nil
+}
+
+type argon2Hash struct {
+	id      bool
+	memory  uint32
+	time    uint32
+	threads uint8
+	salt    []byte
+	key     []byte
+}
+
+func (h *argon2Hash) verify(password string) bool {
+	var key []byte
+	if h.id {
+		key = argon2.IDKey([]byte(password), h.salt, h.time, h.memory, h.threads, uint32(len(h.key)))
+	} else {
+		key = argon2.Key([]byte(password), h.salt, h.time, h.memory, h.threads, uint32(len(h.key)))
+	}
+
+	return subtle.ConstantTimeCompare(key, h.key) == 1
+}
+
+// bcrypt of "dummy" with the default cost
+var dummyHash = bcryptHash("$2a$10$S/faVO9ZHEwX9BVNkMeaFODQkezZ9JiPP37SeEGCTBG1RPH3JaxUe")
+
+// parseHash accepts bcrypt hashes and argon2id and argon2i hashes in the PHC
+// string format: $argon2id$v=19$m=65536,t=3,p=4$salt$key.
+func parseHash(s string) (hash, error) {
+	switch {
+	case strings.HasPrefix(s, "$2a$"), strings.HasPrefix(s, "$2b$"), strings.HasPrefix(s, "$2y$"):
+		if _, err := bcrypt.Cost([]byte(s)); err != nil {
+			return nil, ErrBadHash
+		}
+		return bcryptHash(s), nil
+	case strings.HasPrefix(s, "$argon2id$"), strings.HasPrefix(s, "$argon2i$"):
+		return parseArgon2(s)
+	}
+
+	return nil, ErrUnknownHash
+}
+
+func parseArgon2(s string) (hash, error) {
+	parts := strings.Split(s, "$")
+	if len(parts) != 6 {
+		return nil, ErrBadHash
+	}
+	h := &argon2Hash{id: parts[1] == "argon2id"}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return nil, ErrBadHash
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &h.memory, &h.time, &h.threads); err != nil {
+		return nil, ErrBadHash
+	}
+	if h.memory == 0 || h.time == 0 || h.threads == 0 {
+		return nil, ErrBadHash
+	}
+	var err error
+	if h.salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return nil, ErrBadHash
+	}
+	if h.key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil || len(h.key) == 0 {
+		return nil, ErrBadHash
+	}
+
+	return h, nil
+}
@@ -0,0 +1,98 @@
+package fileauth
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+type usersFile struct {
+	Users []*User `json:"users" yaml:"users"`
+}
+
+func parse(path string, data []byte) ([]*User, error) {
+	var f usersFile
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		if err := json.Unmarshal(data, &f); err != nil {
+			return nil, err
+		}
+	case ".yaml", ".yml":
+		if err := yaml.Unmarshal(data, &f); err != nil {
+			return nil, err
+		}
+	default:
+		return ParseHtpasswd(data)
+	}
+
+	return f.Users, nil
+}
+
+// ParseHtpasswd reads htpasswd lines with optional extra fields:
+//
+//	username:hash[:package_id[:user_id[:flags[:allowed_ips]]]]
+//
+// flags and allowed_ips are comma separated, flags are system and
+// backconnect. Empty lines and lines starting with # are skipped.
+func ParseHtpasswd(data []byte) ([]*User, error) {
+	var users []*User
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for nr := 1; scanner.Scan(); nr++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		user, err := parseLine(line)
+		if err != nil {
+			return nil, &ErrLine{Line: nr, err: err}
+		}
+		users = append(users, user)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return users, nil
+}
+
+func parseLine(line string) (*User, error) {
+	// allowed_ips is last so IPv6 addresses can keep their colons
+	fields := strings.SplitN(line, ":", 6)
+	if len(fields) < 2 {
+		return nil, ErrBadLine
+	}
+	u := &User{Username: fields[0], Password: fields[1]}
+	var err error
+	if len(fields) > 2 && fields[2] != "" {
+		if u.PackageID, err = strconv.Atoi(fields[2]); err != nil {
+			return nil, ErrBadLine
+		}
+	}
+	if len(fields) > 3 && fields[3] != "" {
+		if u.UserID, err = strconv.Atoi(fields[3]); err != nil {
+			return nil, ErrBadLine
+		}
+	}
+	if len(fields) > 4 && fields[4] != "" {
+		for _, flag := range strings.Split(fields[4], ",") {
+			switch flag {
+			case "system":
+				u.SystemUser = true
+			case "backconnect":
+				u.Backconnect = true
+			default:
+				return nil, ErrBadLine
+			}
+		}
+	}
+	if len(fields) > 5 && fields[5] != "" {
+		u.AllowedIPs = strings.Split(fields[5], ",")
+	}
+
+	return u, nil
+}
@@ -5,6 +5,11 @@ go 1.20
 require (
 	github.com/duratarskeyk/go-common-utils v1.10.1
 	go.uber.org/zap v1.25.0
+	golang.org/x/crypto v0.31.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
-require go.uber.org/multierr v1.11.0 // indirect
+require (
+	go.uber.org/multierr v1.11.0 // indirect
+	golang.org/x/sys v0.28.0 // indirect
+)
@@ -0,0 +1,10 @@
+package hmactoken
+
+import "errors"
+
+var ErrMalformedToken = errors.New("malformed credential token")
+var ErrBadMAC = errors.New("bad credential token mac")
+var ErrExpired = errors.New("credential token expired")
+var ErrTooLong = errors.New("credential token lifetime too long")
+var ErrNoKeys = errors.New("no credential token keys")
+var ErrWeakKey = errors.New("credential token key shorter than 32 bytes")
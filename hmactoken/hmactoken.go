@@ -0,0 +1,190 @@
+package hmactoken
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/duratarskeyk/go-common-utils/authorizer"
+	"github.com/duratarskeyk/proxymux/auth"
+)
+
+const prefix = "v1."
+
+// DefaultMaxTTL is the longest lifetime accepted when MaxTTL isn't set.
+const DefaultMaxTTL = 24 * time.Hour
+
+// Key is a secret tokens are signed with. UserIDs and PackageIDs, when not
+// empty, limit the key to tokens for those users and packages, so a
+// reseller given its own key can't mint credentials for anybody else or
+// bill anybody else's package.
+type Key struct {
+	Secret     []byte
+	UserIDs    []int
+	PackageIDs []int
+}
+
+func (k *Key) allows(userID, packageID int) bool {
+	return contains(k.UserIDs, userID) && contains(k.PackageIDs, packageID)
+}
+
+// contains reports whether id is in ids, an empty list allows any id.
+func contains(ids []int, id int) bool {
+	if len(ids) == 0 {
+		return true
+	}
+	for _, v := range ids {
+		if v == id {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Verifier is an auth.TokenVerifier for passwords of the form
+// v1.<userid>.<packageid>.<expiry>.<mac>, expiry being a unix time and mac
+// the unpadded base64url HMAC-SHA256 of everything before it. They are
+// checked against any of the active keys, so keys can be rotated by adding
+// the new one and dropping the old one once its tokens expired. Tokens carry
+// no issue time, those expiring more than MaxTTL, DefaultMaxTTL when zero,
+// after they are verified are rejected.
+type Verifier struct {
+	MaxTTL time.Duration
+
+	keys atomic.Pointer[[]Key]
+	now  func() time.Time
+}
+
+func New(keys ...Key) (*Verifier, error) {
+	v := &Verifier{}
+	if err := v.SetKeys(keys...); err != nil {
+		return nil, err
+	}
+
+	return v, nil
+}
+
+// SetKeys replaces the active keys.
+func (v *Verifier) SetKeys(keys ...Key) error {
+	if len(keys) == 0 {
+		return ErrNoKeys
+	}
+	for i := range keys {
+		if len(keys[i].Secret) < 32 {
+			return ErrWeakKey
+		}
+	}
+	keys = append([]Key(nil), keys...)
+	v.keys.Store(&keys)
+
+	return nil
+}
+
+// Mint returns a token for userID and packageID signed with secret that
+// expires at expires.
+func Mint(secret []byte, userID, packageID int, expires time.Time) string {
+	signed := prefix + strconv.Itoa(userID) + "." + strconv.Itoa(packageID) + "." + strconv.FormatInt(expires.Unix(), 10)
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sign(secret, signed))
+}
+
+func sign(secret []byte, signed string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(signed))
+
+	return mac.Sum(nil)
+}
+
+func (v *Verifier) IsToken(s string) bool {
+	return strings.HasPrefix(s, prefix) && strings.Count(s, ".") == 4
+}
+
+func (v *Verifier) VerifyToken(ctx context.Context, proxyIP, token string) (auth.TokenResult, error) {
+	userID, packageID, err := v.Verify(token)
+	if err != nil {
+		return auth.TokenResult{}, err
+	}
+
+	return auth.TokenResult{
+		AuthResult: authorizer.AuthResult{OK: true, UserID: userID, PackageID: packageID},
+	}, nil
+}
+
+// Verify checks the mac and expiry of token.
+func (v *Verifier) Verify(token string) (userID, packageID int, err error) {
+	if !v.IsToken(token) {
+		return 0, 0, ErrMalformedToken
+	}
+	pos := strings.LastIndexByte(token, '.')
+	signed := token[:pos]
+	mac, err := base64.RawURLEncoding.DecodeString(token[pos+1:])
+	if err != nil || len(mac) != sha256.Size {
+		return 0, 0, ErrMalformedToken
+	}
+	fields := strings.Split(signed[len(prefix):], ".")
+	userID, uerr := parseID(fields[0])
+	packageID, perr := parseID(fields[1])
+	expiry, eerr := strconv.ParseInt(fields[2], 10, 64)
+	if uerr != nil || perr != nil || eerr != nil || userID == 0 {
+		return 0, 0, ErrMalformedToken
+	}
+
+	keys := v.keys.Load()
+	if keys == nil {
+		return 0, 0, ErrNoKeys
+	}
+	ok := false
+	for i := range *keys {
+		k := &(*keys)[i]
+		if k.allows(userID, packageID) && hmac.Equal(sign(k.Secret, signed), mac) {
+			ok = true
+			break
+		}
+	}
+	if !ok {
+		return 0, 0, ErrBadMAC
+	}
+
+	now := v.clock()
+	expires := time.Unix(expiry, 0)
+	if !now.Before(expires) {
+		return 0, 0, ErrExpired
+	}
+	maxTTL := v.MaxTTL
+	if maxTTL <= 0 {
+		maxTTL = DefaultMaxTTL
+	}
+	if expires.Sub(now) > maxTTL {
+		return 0, 0, ErrTooLong
+	}
+
+	return userID, packageID, nil
+}
+
+// parseID parses a non-negative decimal ID without sign or leading zeros,
+// keeping one token per ID.
+func parseID(s string) (int, error) {
+	if len(s) > 1 && s[0] == '0' {
+		return 0, ErrMalformedToken
+	}
+	id, err := strconv.ParseUint(s, 10, 31)
+	if err != nil {
+		return 0, err
+	}
+
+	return int(id), nil
+}
+
+func (v *Verifier) clock() time.Time {
+	if v.now != nil {
+		return v.now()
+	}
+
+	return time.Now()
+}
@@ -0,0 +1,91 @@
+package hmactoken
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestVerifier(t *testing.T) {
+	oldKey := []byte("0123456789abcdef0123456789abcdef")
+	newKey := []byte("fedcba9876543210fedcba9876543210")
+	resellerKey := []byte("reseller key of at least 32 bytes")
+	v, err := New(Key{Secret: newKey}, Key{Secret: oldKey}, Key{Secret: resellerKey, UserIDs: []int{11, 12}, PackageIDs: []int{1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1700000000, 0)
+	v.now = func() time.Time { return now }
+	v.MaxTTL = 24 * time.Hour
+	later := now.Add(time.Hour)
+
+	tests := []struct {
+		token string
+		err   error
+	}{
+		{Mint(newKey, 11, 1, later), nil},
+		{Mint(oldKey, 11, 1, later), nil},
+		{Mint(resellerKey, 11, 1, later), nil},
+		{Mint(resellerKey, 13, 1, later), ErrBadMAC},
+		// another reseller's package
+		{Mint(resellerKey, 11, 2, later), ErrBadMAC},
+		{Mint([]byte("unknown key of at least 32 bytes!"), 11, 1, later), ErrBadMAC},
+		{Mint(newKey, 11, 1, now), ErrExpired},
+		{Mint(newKey, 11, 1, now.Add(25*time.Hour)), ErrTooLong},
+		{Mint(newKey, 0, 1, later), ErrMalformedToken},
+		{"v1.11.1.1700003600.AAAA", ErrMalformedToken},
+		{"v1.011.1.1700003600." + Mint(newKey, 11, 1, later)[19:], ErrMalformedToken},
+		{"v1.+11.1.1700003600." + Mint(newKey, 11, 1, later)[19:], ErrMalformedToken},
+		{"v1.11.1.1700003600", ErrMalformedToken},
+	}
+	for nr, test := range tests {
+		result, err := v.VerifyToken(context.Background(), "1.2.3.4", test.token)
+		if !errors.Is(err, test.err) {
+			t.Errorf("Test #%d: Expected %v, got %v", nr+1, test.err, err)
+			continue
+		}
+		if err == nil && (!result.OK || result.UserID != 11 || result.PackageID != 1) {
+			t.Errorf("Test #%d: Unexpected result %+v", nr+1, result)
+		}
+	}
+
+	// tokens of a dropped key stop working
+	if err = v.SetKeys(Key{Secret: newKey}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = v.Verify(tests[1].token); !errors.Is(err, ErrBadMAC) {
+		t.Errorf("Expected ErrBadMAC, got %v", err)
+	}
+	if err = v.SetKeys(Key{Secret: []byte("short")}); !errors.Is(err, ErrWeakKey) {
+		t.Errorf("Expected ErrWeakKey, got %v", err)
+	}
+	if _, _, err = v.Verify(tests[0].token); err != nil {
+		t.Errorf("Expected the previous keys to stay, got %s", err)
+	}
+}
+
+func TestDefaultMaxTTL(t *testing.T) {
+	key := []byte("0123456789abcdef0123456789abcdef")
+	v, err := New(Key{Secret: key})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1700000000, 0)
+	v.now = func() time.Time { return now }
+	if _, _, err = v.Verify(Mint(key, 11, 1, now.Add(DefaultMaxTTL))); err != nil {
+		t.Errorf("Expected a token within DefaultMaxTTL to pass, got %s", err)
+	}
+	if _, _, err = v.Verify(Mint(key, 11, 1, now.AddDate(10, 0, 0))); !errors.Is(err, ErrTooLong) {
+		t.Errorf("Expected %v, got %v", ErrTooLong, err)
+	}
+}
+
+func TestIsToken(t *testing.T) {
+	v := &Verifier{}
+	for nr, s := range []string{"v1.1.2.3.mac", "password", "eyJhbGciOiJIUzI1NiJ9.e30.sig", "v1.1.2.mac"} {
+		if v.IsToken(s) != (nr == 0) {
+			t.Errorf("Test #%d: Expected IsToken(%q) to be %v", nr+1, s, nr == 0)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package httpprotocol
+
+import (
+	"bufio"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+)
+
+type bufferedConn struct {
+	net.Conn
+	reader io.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+// ClientConnect asks the HTTP proxy on conn to open a tunnel to host and
+// port, authenticating with Basic auth when username is not empty. Hosts
+// that can't be sent in a request line are rejected with ErrBadHost. The
+// returned conn must be used instead of conn, it may hold bytes read past
+// the response.
+func ClientConnect(conn net.Conn, username, password, host string, port uint16) (net.Conn, error) {
+	if !validHost(host) {
+		return nil, ErrBadHost
+	}
+	addr := net.JoinHostPort(host, strconv.Itoa(int(port)))
+	request := "CONNECT " + addr + " HTTP/1.1\r\nHost: " + addr + "\r\n"
+	if username != "" {
+		credentials := base64.StdEncoding.EncodeToString([]byte(username + ":" + password))
+		request += "Proxy-Authorization: Basic " + credentials + "\r\n"
+	}
+	if _, err := io.WriteString(conn, request+"\r\n"); err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		return nil, &ErrConnectFailed{StatusCode: resp.StatusCode}
+	}
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, reader: io.MultiReader(io.LimitReader(br, int64(br.Buffered())), conn)}, nil
+	}
+
+	return conn, nil
+}
+
+// validHost reports whether host is free of the bytes that would break out
+// of the request line or the Host header.
+func validHost(host string) bool {
+	if host == "" {
+		return false
+	}
+	for i := 0; i < len(host); i++ {
+		if c := host[i]; c <= ' ' || c == 0x7f || c == '/' {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,31 @@
+package httpprotocol
+
+import (
+	"context"
+	"net"
+
+	"github.com/duratarskeyk/proxymux/dialer"
+)
+
+// Dial connects to the requested target. On failure the matching error
+// response is written to the client.
+func Dial(ctx context.Context, req *HTTPRequest) (net.Conn, error) {
+	conn, err := dialer.Dial(ctx, req.Fields)
+	if err != nil {
+		WriteHTTPError(req.Fields.Conn, DialErrorResponse(err), "")
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+func DialErrorResponse(err error) string {
+	switch dialer.Classify(err) {
+	case dialer.KindResolution:
+		return HTTP570ResolutionError
+	case dialer.KindDenied:
+		return HTTP451Forbidden
+	}
+
+	return HTTP572TargetConnectionError
+}
@@ -0,0 +1,366 @@
+package httpprotocol
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"hash"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/duratarskeyk/go-common-utils/authorizer"
+	"github.com/duratarskeyk/proxymux/auth"
+	"github.com/duratarskeyk/proxymux/corestructs"
+)
+
+const (
+	DigestSHA256 = "SHA-256"
+	DigestMD5    = "MD5"
+
+	defaultNonceTTL  = 5 * time.Minute
+	defaultMaxNonces = 1 << 16
+
+	// nonce counts up to this far below the highest one seen are still
+	// accepted once, clients may send requests on several connections
+	ncWindow = 64
+)
+
+// DigestSource looks up Digest credentials. HA1 returns the hex encoded
+// H(login:realm:password) of user, login being the username the client
+// hashed and user the same name with its login options parsed off. A result
+// that isn't OK means the user is unknown.
+type DigestSource interface {
+	HA1(ctx context.Context, proxyIP, user, login, realm string, newHash func() hash.Hash) (string, authorizer.AuthResult, error)
+}
+
+// DigestPasswordFunc is a DigestSource for backends that keep passwords
+// retrievable.
+type DigestPasswordFunc func(ctx context.Context, proxyIP, user string) (string, authorizer.AuthResult, error)
+
+func (f DigestPasswordFunc) HA1(ctx context.Context, proxyIP, user, login, realm string, newHash func() hash.Hash) (string, authorizer.AuthResult, error) {
+	password, result, err := f(ctx, proxyIP, user)
+	if err != nil || !result.OK {
+		return "", result, err
+	}
+
+	return DigestHA1(newHash, login, realm, password), result, nil
+}
+
+// DigestHA1 returns the hex encoded H(login:realm:password).
+func DigestHA1(newHash func() hash.Hash, login, realm, password string) string {
+	return hashHex(newHash, login+":"+realm+":"+password)
+}
+
+type digestNonce struct {
+	expires time.Time
+	maxNC   uint64
+	seen    uint64
+}
+
+// Digest verifies RFC 7616 Proxy-Authorization: Digest headers with qop=auth.
+// Nonces are issued with the 407 challenge and expire after NonceTTL, an
+// expired one gets a challenge with stale=true. Every nonce count is
+// accepted once per nonce. Algorithms lists the offered algorithms in the
+// order of preference, SHA-256 and MD5 by default, their -sess variants are
+// accepted as well. Every challenge stores a nonce, MaxNonces caps them at
+// 1<<16 by default, evicting arbitrary ones when full.
+type Digest struct {
+	Realm      string
+	Source     DigestSource
+	Algorithms []string
+	NonceTTL   time.Duration
+	MaxNonces  int
+
+	mu        sync.Mutex
+	nonces    map[string]*digestNonce
+	nextSweep time.Time
+	now       func() time.Time
+}
+
+// Challenge returns the Proxy-Authenticate values of a fresh nonce.
+func (d *Digest) Challenge(stale bool) []string {
+	nonce := d.newNonce()
+	var challenges []string
+	for _, algorithm := range d.algorithms() {
+		challenge := `Digest realm="` + quoteEscape(d.Realm) + `", qop="auth", algorithm=` + algorithm +
+			`, nonce="` + nonce + `"`
+		if stale {
+			challenge += ", stale=true"
+		}
+		challenges = append(challenges, challenge)
+	}
+
+	return challenges
+}
+
+// Verify checks the Digest credentials sent for a request with the given
+// method and request URI, setting Login and LoginOptions of fields.
+func (d *Digest) Verify(ctx context.Context, fields *corestructs.Fields, credentials, method, uri string) (authorizer.AuthResult, error) {
+	params, err := parseAuthParams(credentials)
+	if err != nil {
+		return authorizer.BadAuthResult, &ErrBadRequest{err: err}
+	}
+	login, nonce, nc, cnonce, response := params["username"], params["nonce"], params["nc"], params["cnonce"], params["response"]
+	if login == "" || nonce == "" || cnonce == "" || len(response) == 0 || params["uri"] == "" {
+		return authorizer.BadAuthResult, &ErrBadRequest{err: ErrBadDigest}
+	}
+	if params["userhash"] == "true" {
+		return authorizer.BadAuthResult, &ErrAuth{err: ErrUnsupportedDigest}
+	}
+	if params["qop"] != "auth" {
+		return authorizer.BadAuthResult, &ErrAuth{err: ErrUnsupportedDigest}
+	}
+	if params["uri"] != uri {
+		return authorizer.BadAuthResult, &ErrBadRequest{err: ErrDigestURIMismatch}
+	}
+	if params["realm"] != d.Realm {
+		return authorizer.BadAuthResult, &ErrAuth{err: ErrBadCredentials}
+	}
+	count, err := strconv.ParseUint(nc, 16, 32)
+	if err != nil || len(nc) != 8 || count == 0 {
+		return authorizer.BadAuthResult, &ErrBadRequest{err: ErrBadDigest}
+	}
+
+	algorithm := params["algorithm"]
+	if algorithm == "" {
+		algorithm = DigestMD5
+	}
+	base, session := strings.CutSuffix(algorithm, "-sess")
+	newHash, ok := d.hashFor(base)
+	if !ok {
+		return authorizer.BadAuthResult, &ErrAuth{err: ErrUnsupportedDigest}
+	}
+
+	if err = d.checkNonce(nonce); err != nil {
+		return authorizer.BadAuthResult, &ErrAuth{err: err}
+	}
+
+	if d.Source == nil {
+		return authorizer.BadAuthResult, &ErrAuth{err: auth.NewErrBackend(auth.ErrNoAuthorizer)}
+	}
+	fields.Login = login
+	if err = fields.ParseLogin(); err != nil {
+		return authorizer.BadAuthResult, &ErrAuth{err: err}
+	}
+	ha1, result, err := d.Source.HA1(ctx, fields.ProxyIP, fields.Login, login, d.Realm, newHash)
+	if err != nil {
+		return authorizer.BadAuthResult, &ErrAuth{err: auth.NewErrBackend(err)}
+	}
+	if !result.OK {
+		return authorizer.BadAuthResult, &ErrAuth{err: ErrBadCredentials}
+	}
+	if session {
+		ha1 = hashHex(newHash, ha1+":"+nonce+":"+cnonce)
+	}
+	ha2 := hashHex(newHash, method+":"+uri)
+	expected := hashHex(newHash, ha1+":"+nonce+":"+nc+":"+cnonce+":auth:"+ha2)
+	if subtle.ConstantTimeCompare([]byte(expected), []byte(strings.ToLower(response))) != 1 {
+		return authorizer.BadAuthResult, &ErrAuth{err: ErrBadCredentials}
+	}
+	// the count is only used up by a valid response so guessing can't
+	// burn the counts of the real client
+	if err = d.useNonce(nonce, count); err != nil {
+		return authorizer.BadAuthResult, &ErrAuth{err: err}
+	}
+
+	return result, nil
+}
+
+func (d *Digest) algorithms() []string {
+	if len(d.Algorithms) == 0 {
+		return []string{DigestSHA256, DigestMD5}
+	}
+
+	return d.Algorithms
+}
+
+func (d *Digest) hashFor(algorithm string) (func() hash.Hash, bool) {
+	for _, offered := range d.algorithms() {
+		if !strings.EqualFold(offered, algorithm) {
+			continue
+		}
+		switch strings.ToUpper(algorithm) {
+		case DigestSHA256:
+			return sha256.New, true
+		case DigestMD5:
+			return md5.New, true
+		}
+	}
+
+	return nil, false
+}
+
+func (d *Digest) newNonce() string {
+	b := make([]byte, 18)
+	io.ReadFull(rand.Reader, b)
+	nonce := base64.RawURLEncoding.EncodeToString(b)
+
+	now := d.clock()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.nonces == nil {
+		d.nonces = make(map[string]*digestNonce)
+	}
+	d.sweepLocked(now)
+	if maxNonces := d.maxNonces(); len(d.nonces) >= maxNonces {
+		for k := range d.nonces {
+			if len(d.nonces) < maxNonces {
+				break
+			}
+			delete(d.nonces, k)
+		}
+	}
+	d.nonces[nonce] = &digestNonce{expires: now.Add(d.nonceTTL())}
+
+	return nonce
+}
+
+func (d *Digest) checkNonce(nonce string) error {
+	now := d.clock()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	n, ok := d.nonces[nonce]
+	if !ok || !now.Before(n.expires) {
+		// unknown nonces were issued before a restart or evicted, the
+		// client can retry with a new one without asking the user
+		return ErrStaleNonce
+	}
+
+	return nil
+}
+
+func (d *Digest) useNonce(nonce string, count uint64) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	n, ok := d.nonces[nonce]
+	if !ok {
+		return ErrStaleNonce
+	}
+	switch {
+	case count > n.maxNC:
+		shift := count - n.maxNC
+		if shift >= ncWindow {
+			n.seen = 0
+		} else {
+			n.seen <<= shift
+		}
+		n.seen |= 1
+		n.maxNC = count
+	case n.maxNC-count >= ncWindow:
+		return ErrNonceReplay
+	default:
+		bit := uint64(1) << (n.maxNC - count)
+		if n.seen&bit != 0 {
+			return ErrNonceReplay
+		}
+		n.seen |= bit
+	}
+
+	return nil
+}
+
+// sweepLocked drops expired nonces at most once per NonceTTL.
+func (d *Digest) sweepLocked(now time.Time) {
+	if now.Before(d.nextSweep) {
+		return
+	}
+	for k, n := range d.nonces {
+		if !now.Before(n.expires) {
+			delete(d.nonces, k)
+		}
+	}
+	d.nextSweep = now.Add(d.nonceTTL())
+}
+
+func (d *Digest) nonceTTL() time.Duration {
+	if d.NonceTTL > 0 {
+		return d.NonceTTL
+	}
+
+	return defaultNonceTTL
+}
+
+func (d *Digest) maxNonces() int {
+	if d.MaxNonces > 0 {
+		return d.MaxNonces
+	}
+
+	return defaultMaxNonces
+}
+
+func (d *Digest) clock() time.Time {
+	if d.now != nil {
+		return d.now()
+	}
+
+	return time.Now()
+}
+
+func hashHex(newHash func() hash.Hash, s string) string {
+	h := newHash()
+	io.WriteString(h, s)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func quoteEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s)
+}
+
+// parseAuthParams parses the comma separated name=value pairs of RFC 9110
+// section 11.2, names are lowercased and quoted values unescaped.
+func parseAuthParams(s string) (map[string]string, error) {
+	params := make(map[string]string)
+	for {
+		s = strings.TrimLeft(s, " \t,")
+		if s == "" {
+			return params, nil
+		}
+		eq := strings.IndexByte(s, '=')
+		if eq <= 0 {
+			return nil, ErrBadDigest
+		}
+		name := strings.ToLower(strings.TrimSpace(s[:eq]))
+		s = strings.TrimLeft(s[eq+1:], " \t")
+
+		var value string
+		if strings.HasPrefix(s, `"`) {
+			var b strings.Builder
+			i := 1
+			for ; i < len(s) && s[i] != '"'; i++ {
+				if s[i] == '\\' && i+1 < len(s) {
+					i++
+				}
+				b.WriteByte(s[i])
+			}
+			if i == len(s) {
+				return nil, ErrBadDigest
+			}
+			value, s = b.String(), s[i+1:]
+		} else {
+			end := strings.IndexByte(s, ',')
+			if end == -1 {
+				end = len(s)
+			}
+			value, s = strings.TrimSpace(s[:end]), s[end:]
+			if value == "" || strings.ContainsAny(value, " \t\"") {
+				return nil, ErrBadDigest
+			}
+		}
+		if _, ok := params[name]; ok {
+			return nil, ErrBadDigest
+		}
+		params[name] = value
+
+		s = strings.TrimLeft(s, " \t")
+		if s != "" && s[0] != ',' {
+			return nil, ErrBadDigest
+		}
+	}
+}
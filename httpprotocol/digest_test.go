@@ -0,0 +1,229 @@
+package httpprotocol
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+	"net"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/duratarskeyk/go-common-utils/authorizer"
+	"github.com/duratarskeyk/proxymux/auth"
+	"github.com/duratarskeyk/proxymux/corestructs"
+	"github.com/duratarskeyk/proxymux/internal/authmock"
+)
+
+var testDigestPasswords = DigestPasswordFunc(func(ctx context.Context, proxyIP, user string) (string, authorizer.AuthResult, error) {
+	if user != "user" {
+		return "", authorizer.BadAuthResult, nil
+	}
+
+	return "pass", authorizer.AuthResult{OK: true, PackageID: 1, UserID: 11}, nil
+})
+
+type digestParams struct {
+	login     string
+	password  string
+	realm     string
+	algorithm string
+	method    string
+	uri       string
+	nonce     string
+	nc        int
+}
+
+func digestHeader(p digestParams) string {
+	var newHash func() hash.Hash = sha256.New
+	if strings.HasPrefix(p.algorithm, "MD5") {
+		newHash = md5.New
+	}
+	cnonce := "0a4f113b"
+	nc := fmt.Sprintf("%08x", p.nc)
+	ha1 := DigestHA1(newHash, p.login, p.realm, p.password)
+	if strings.HasSuffix(p.algorithm, "-sess") {
+		ha1 = hashHex(newHash, ha1+":"+p.nonce+":"+cnonce)
+	}
+	ha2 := hashHex(newHash, p.method+":"+p.uri)
+	response := hashHex(newHash, ha1+":"+p.nonce+":"+nc+":"+cnonce+":auth:"+ha2)
+
+	return fmt.Sprintf(`username="%s", realm="%s", uri="%s", algorithm=%s, nonce="%s", nc=%s, cnonce="%s", qop=auth, response="%s"`,
+		p.login, p.realm, p.uri, p.algorithm, p.nonce, nc, cnonce, response)
+}
+
+var nonceRe = regexp.MustCompile(`nonce="([^"]+)"`)
+
+func challengeNonce(t *testing.T, d *Digest) string {
+	challenges := d.Challenge(false)
+	if len(challenges) == 0 {
+		t.Fatal("Expected a challenge")
+	}
+	m := nonceRe.FindStringSubmatch(challenges[0])
+	if m == nil {
+		t.Fatalf("No nonce in %q", challenges[0])
+	}
+
+	return m[1]
+}
+
+func TestParseAuthParams(t *testing.T) {
+	tests := []struct {
+		header string
+		params map[string]string
+	}{
+		{`username="a\"b", Realm=Proxy,nc=00000001`, map[string]string{"username": `a"b`, "realm": "Proxy", "nc": "00000001"}},
+		{` uri="/a,b" , qop=auth`, map[string]string{"uri": "/a,b", "qop": "auth"}},
+		{`username="open`, nil},
+		{`username`, nil},
+		{`nc=1 2`, nil},
+		{`a=1, a=2`, nil},
+	}
+	for nr, test := range tests {
+		params, err := parseAuthParams(test.header)
+		if test.params == nil {
+			if err == nil {
+				t.Errorf("Test #%d: Expected error, got %v", nr+1, params)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test #%d: Unexpected error %s", nr+1, err)
+			continue
+		}
+		if fmt.Sprint(params) != fmt.Sprint(test.params) {
+			t.Errorf("Test #%d: Expected %v, got %v", nr+1, test.params, params)
+		}
+	}
+}
+
+func TestDigestVerify(t *testing.T) {
+	now := time.Now()
+	d := &Digest{Realm: "Proxy", Source: testDigestPasswords, now: func() time.Time { return now }}
+	nonce := challengeNonce(t, d)
+	expired := challengeNonce(t, d)
+	d.nonces[expired].expires = now
+
+	base := digestParams{login: "user", password: "pass", realm: "Proxy", algorithm: "SHA-256", method: "CONNECT", uri: "example.org:443", nonce: nonce}
+	tests := []struct {
+		modify func(p *digestParams)
+		err    error
+	}{
+		{func(p *digestParams) { p.nc = 1 }, nil},
+		{func(p *digestParams) { p.nc = 1 }, ErrNonceReplay},
+		{func(p *digestParams) { p.nc = 3 }, nil},
+		// out of order, but inside the window
+		{func(p *digestParams) { p.nc = 2 }, nil},
+		{func(p *digestParams) { p.nc, p.algorithm = 4, "MD5" }, nil},
+		{func(p *digestParams) { p.nc, p.algorithm = 5, "MD5-sess" }, nil},
+		{func(p *digestParams) { p.nc, p.password = 6, "bad" }, ErrBadCredentials},
+		// a failed attempt doesn't use up the count
+		{func(p *digestParams) { p.nc = 6 }, nil},
+		{func(p *digestParams) { p.nc, p.login = 7, "nobody" }, ErrBadCredentials},
+		{func(p *digestParams) { p.nc, p.realm = 7, "Other" }, ErrBadCredentials},
+		{func(p *digestParams) { p.nc, p.algorithm = 7, "SHA-512-256" }, ErrUnsupportedDigest},
+		{func(p *digestParams) { p.nc, p.uri = 7, "other.org:443" }, ErrDigestURIMismatch},
+		{func(p *digestParams) { p.nc, p.nonce = 7, expired }, ErrStaleNonce},
+		{func(p *digestParams) { p.nc, p.nonce = 7, "unknown" }, ErrStaleNonce},
+		{func(p *digestParams) { p.nc = 100 }, nil},
+		{func(p *digestParams) { p.nc = 7 }, ErrNonceReplay},
+	}
+	for nr, test := range tests {
+		p := base
+		test.modify(&p)
+		fields := &corestructs.Fields{ProxyIP: "1.2.3.4"}
+		result, err := d.Verify(context.Background(), fields, digestHeader(p), "CONNECT", "example.org:443")
+		if !errors.Is(err, test.err) {
+			t.Errorf("Test #%d: Expected %v, got %v", nr+1, test.err, err)
+		} else if err == nil && (result.UserID != 11 || fields.Login != "user") {
+			t.Errorf("Test #%d: Expected user 11, got %+v with login %s", nr+1, result, fields.Login)
+		}
+	}
+}
+
+func TestDigestRequest(t *testing.T) {
+	d := &Digest{Realm: "Proxy", Source: testDigestPasswords}
+	mock := &authmock.Mock{IPAuthRet: authorizer.BadAuthResult, CredentialsAuthRet: authorizer.BadAuthResult}
+	read := func(request string) (*HTTPRequest, error) {
+		c1, c2 := net.Pipe()
+		defer c1.Close()
+		defer c2.Close()
+		req := GetHTTPRequest()
+		req.FirstByte = 'C'
+		req.Digest = d
+		fields := req.Fields
+		fields.UserIP = "4.3.2.1"
+		fields.ProxyIP = "1.2.3.4"
+		fields.Conn = c1
+		fields.ProxyConfig = mock
+		fields.Timeouts = &corestructs.Timeouts{Handshake: 30 * time.Second}
+		errCh := make(chan error)
+		go func() {
+			errCh <- req.Read()
+		}()
+		c2.Write([]byte(request))
+		return req, <-errCh
+	}
+
+	req, err := read("ONNECT example.org:443 HTTP/1.1\r\nHost: example.org:443\r\n\r\n")
+	if !errors.Is(err, ErrIPAuthFailed) {
+		t.Fatalf("Expected ErrIPAuthFailed, got %v", err)
+	}
+	resp := req.ErrorResponse(err)
+	PutHTTPRequest(req)
+	challenges := regexp.MustCompile(`Proxy-Authenticate: (\w+)[^\r]*`).FindAllStringSubmatch(resp, -1)
+	if len(challenges) != 3 || challenges[0][1] != "Digest" || challenges[1][1] != "Digest" || challenges[2][1] != "Basic" {
+		t.Fatalf("Expected Digest and Basic challenges, got %q", resp)
+	}
+	if !strings.Contains(challenges[0][0], "algorithm=SHA-256") || !strings.Contains(challenges[1][0], "algorithm=MD5") {
+		t.Errorf("Expected SHA-256 to be offered before MD5, got %q", resp)
+	}
+	nonce := nonceRe.FindStringSubmatch(challenges[0][0])[1]
+
+	p := digestParams{login: "user", password: "pass", realm: "Proxy", algorithm: "SHA-256", method: "CONNECT", uri: "example.org:443", nonce: nonce, nc: 1}
+	req, err = read("ONNECT example.org:443 HTTP/1.1\r\nHost: example.org:443\r\nProxy-Authorization: Digest " + digestHeader(p) + "\r\n\r\n")
+	if err != nil {
+		t.Fatalf("Expected digest auth to succeed, got %s", err)
+	}
+	if req.Fields.Login != "user" || req.Fields.UserID != 11 || req.Fields.PackageID != 1 {
+		t.Errorf("Expected user 11 of package 1, got %s %d %d", req.Fields.Login, req.Fields.UserID, req.Fields.PackageID)
+	}
+	PutHTTPRequest(req)
+
+	req, err = read("ONNECT example.org:443 HTTP/1.1\r\nHost: example.org:443\r\nProxy-Authorization: Digest " + digestHeader(p) + "\r\n\r\n")
+	if !errors.Is(err, ErrNonceReplay) {
+		t.Errorf("Expected ErrNonceReplay, got %v", err)
+	} else if resp := req.ErrorResponse(err); !strings.HasPrefix(resp, "HTTP/1.1 407") || strings.Contains(resp, "stale=true") {
+		t.Errorf("Expected a 407 without stale, got %q", resp)
+	}
+	PutHTTPRequest(req)
+
+	p.nonce, p.nc = "unknown", 1
+	req, err = read("ONNECT example.org:443 HTTP/1.1\r\nHost: example.org:443\r\nProxy-Authorization: Digest " + digestHeader(p) + "\r\n\r\n")
+	if !errors.Is(err, ErrStaleNonce) {
+		t.Errorf("Expected ErrStaleNonce, got %v", err)
+	} else if resp := req.ErrorResponse(err); strings.Count(resp, "stale=true") != 2 {
+		t.Errorf("Expected stale Digest challenges, got %q", resp)
+	}
+	PutHTTPRequest(req)
+}
+
+func TestDigestLimits(t *testing.T) {
+	d := &Digest{Realm: "Proxy"}
+	for i := 0; i < defaultMaxNonces+10; i++ {
+		d.Challenge(false)
+	}
+	if len(d.nonces) != defaultMaxNonces {
+		t.Errorf("Expected %d nonces, got %d", defaultMaxNonces, len(d.nonces))
+	}
+
+	p := digestParams{login: "user", password: "pass", realm: "Proxy", algorithm: "SHA-256", method: "CONNECT", uri: "example.org:443", nonce: challengeNonce(t, d), nc: 1}
+	_, err := d.Verify(context.Background(), &corestructs.Fields{}, digestHeader(p), "CONNECT", "example.org:443")
+	if !errors.Is(err, auth.ErrBackendUnavailable) {
+		t.Errorf("Expected %v without a Source, got %v", auth.ErrBackendUnavailable, err)
+	}
+}
@@ -14,6 +14,16 @@ var ErrNotBasicAuth = errors.New("not basic auth")
 var ErrBadCredentials = errors.New("bad credentials")
 var ErrBackconnectUserIPNotPresent = errors.New("no user ip provided in a backconnect request")
 var ErrIPAuthFailed = errors.New("ip auth failed, no credentials provided")
+var ErrBadDigest = errors.New("malformed digest credentials")
+var ErrUnsupportedDigest = errors.New("unsupported digest algorithm or qop")
+var ErrDigestURIMismatch = errors.New("digest uri doesn't match the request")
+var ErrStaleNonce = errors.New("stale digest nonce")
+var ErrNonceReplay = errors.New("replayed digest nonce count")
+var ErrBadNTLMMessage = errors.New("malformed ntlm message")
+var ErrUnsupportedNTLM = errors.New("only ntlmv2 is supported")
+var ErrNTLMHandshake = errors.New("ntlm message out of order")
+var ErrBadToken = errors.New("malformed bearer token")
+var ErrBadHost = errors.New("host can't be sent in a request")
 
 type ErrBadRequest struct {
 	err error
@@ -38,3 +48,11 @@ func (e *ErrAuth) Error() string {
 func (e *ErrAuth) Unwrap() error {
 	return e.err
 }
+
+type ErrConnectFailed struct {
+	StatusCode int
+}
+
+func (e *ErrConnectFailed) Error() string {
+	return fmt.Sprintf("HTTP proxy replied with status %d", e.StatusCode)
+}
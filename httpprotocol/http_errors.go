@@ -1,9 +1,13 @@
 package httpprotocol
 
 import (
+	"errors"
 	"fmt"
 	"net"
+	"strings"
 	"time"
+
+	"github.com/duratarskeyk/proxymux/auth"
 )
 
 var HTTP400BadRequest = "HTTP/1.1 400 Bad Request\r\n" +
@@ -13,11 +17,13 @@ var HTTP400BadRequest = "HTTP/1.1 400 Bad Request\r\n" +
 	"X-Request-Error: BAD_REQUEST\r\n" +
 	"Connection: close\r\n%s"
 
+const basicChallenge = `Proxy-Authenticate: Basic realm="Proxy"` + "\r\n"
+
 var HTTP407Unauthorized = "HTTP/1.1 407 Proxy Authentication Required\r\n" +
 	"Server: FaaS v1.3-20220203-7fa38bd5af\r\n" +
 	"Date: %s\r\n" +
 	"%s" +
-	`Proxy-Authenticate: Basic realm="Proxy"` + "\r\n" +
+	basicChallenge +
 	"Connection: close\r\n%s"
 
 var HTTP451Forbidden = "HTTP/1.1 451 Unavailable For Legal Reasons\r\n" +
@@ -55,6 +61,13 @@ var HTTP573CommunicationError = "HTTP/1.1 573 Target Host Communication Error\r\
 	"X-Request-Error: TARGET_HOST_COMMUNICATION_FAILED\r\n" +
 	"Connection: close\r\n%s"
 
+var HTTP503ServiceUnavailable = "HTTP/1.1 503 Service Unavailable\r\n" +
+	"Server: FaaS v1.3-20220203-7fa38bd5af\r\n" +
+	"Date: %s\r\n" +
+	"%s" +
+	"X-Request-Error: AUTH_BACKEND_UNAVAILABLE\r\n" +
+	"Connection: close\r\n%s"
+
 var HTTP529ProxyRatelimitReached = "HTTP/1.1 529 Proxy Limit Reached\r\n" +
 	"Server: FaaS v1.3-20220203-7fa38bd5af\r\n" +
 	"Date: %s\r\n" +
@@ -73,3 +86,47 @@ func WriteHTTPError(conn net.Conn, errStr, body string) {
 	contentHeaders := fmt.Sprintf("%sContent-Length: %d\r\n", contentTypeHeader, len(body))
 	fmt.Fprintf(conn, errStr, now, contentHeaders, "\r\n"+body)
 }
+
+// ReadErrorResponse returns the response for an error returned by Read.
+func ReadErrorResponse(err error) string {
+	var badRequest *ErrBadRequest
+	if errors.Is(err, auth.ErrBackendUnavailable) {
+		return HTTP503ServiceUnavailable
+	} else if errors.Is(err, ErrIPv6Addr) {
+		return HTTP571IPv6NotSupported
+	} else if errors.As(err, &badRequest) {
+		return HTTP400BadRequest
+	}
+
+	return HTTP407Unauthorized
+}
+
+// ErrorResponse is ReadErrorResponse with a 407 that also offers the
+// schemes enabled by req.Digest, req.NTLM and Fields.TokenVerifier, Digest
+// with a fresh nonce.
+func (req *HTTPRequest) ErrorResponse(err error) string {
+	resp := ReadErrorResponse(err)
+	if (req.Digest == nil && req.NTLM == nil && req.Fields.TokenVerifier == nil) || resp != HTTP407Unauthorized {
+		return resp
+	}
+
+	var challenges strings.Builder
+	if req.NTLM != nil {
+		if req.NTLM.Negotiate {
+			challenges.WriteString("Proxy-Authenticate: Negotiate\r\n")
+		}
+		challenges.WriteString("Proxy-Authenticate: NTLM\r\n")
+	}
+	if req.Digest != nil {
+		for _, challenge := range req.Digest.Challenge(errors.Is(err, ErrStaleNonce)) {
+			// the response is a format string
+			challenges.WriteString("Proxy-Authenticate: " + strings.ReplaceAll(challenge, "%", "%%") + "\r\n")
+		}
+	}
+	if req.Fields.TokenVerifier != nil {
+		challenges.WriteString(`Proxy-Authenticate: Bearer realm="Proxy"` + "\r\n")
+	}
+	challenges.WriteString(basicChallenge)
+
+	return strings.Replace(resp, basicChallenge, challenges.String(), 1)
+}
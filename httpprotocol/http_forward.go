@@ -0,0 +1,307 @@
+package httpprotocol
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/textproto"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/duratarskeyk/proxymux/dialer"
+)
+
+// RFC 9110 section 7.6.1
+var hopByHopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+type countingWriter struct {
+	conn    net.Conn
+	timeout time.Duration
+	counter *int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	if w.timeout > 0 {
+		w.conn.SetWriteDeadline(time.Now().Add(w.timeout))
+	}
+	n, err := w.conn.Write(p)
+	atomic.AddInt64(w.counter, int64(n))
+	return n, err
+}
+
+type originConn struct {
+	net.Conn
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+}
+
+func (c *originConn) Read(p []byte) (int, error) {
+	if c.readTimeout > 0 {
+		c.Conn.SetReadDeadline(time.Now().Add(c.readTimeout))
+	}
+	return c.Conn.Read(p)
+}
+
+func (c *originConn) Write(p []byte) (int, error) {
+	if c.writeTimeout > 0 {
+		c.Conn.SetWriteDeadline(time.Now().Add(c.writeTimeout))
+	}
+	return c.Conn.Write(p)
+}
+
+type forwarder struct {
+	req    *HTTPRequest
+	client *countingWriter
+
+	origin       *originConn
+	originAddr   string
+	originReader *bufio.Reader
+}
+
+// Forward proxies plain HTTP requests read by Read until the client closes
+// the connection, asks to close it or sends a CONNECT request, in which case
+// it returns nil with Tunnel set. Every following request goes through the
+// same authorization as the first one, and check, when not nil, is called
+// for every request before it's sent to the origin. Once ctx is done Forward
+// stops waiting for the next request and returns nil.
+func Forward(ctx context.Context, req *HTTPRequest, check func(req *HTTPRequest) error) error {
+	fields := req.Fields
+	fw := &forwarder{
+		req: req,
+		client: &countingWriter{
+			conn:    fields.Conn,
+			timeout: fields.Timeouts.Write,
+			counter: &fields.Download,
+		},
+	}
+	defer fw.closeOrigin()
+
+	for {
+		if check != nil {
+			if err := check(req); err != nil {
+				WriteHTTPError(fields.Conn, HTTP451Forbidden, "")
+				return err
+			}
+		}
+
+		keepAlive, err := fw.roundTrip(ctx)
+		// pipelined requests still buffered weren't forwarded
+		fields.Upload = req.consumed()
+		if err != nil || !keepAlive {
+			return err
+		}
+
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err = fw.readNext(ctx); err != nil {
+			var badRequest *ErrBadRequest
+			if errors.As(err, &badRequest) && errors.Is(err, ErrRequestReadFailed) {
+				// the client has closed the connection or went idle
+				return nil
+			}
+			WriteHTTPError(fields.Conn, req.ErrorResponse(err), "")
+			return err
+		}
+		if req.Tunnel {
+			return nil
+		}
+	}
+}
+
+// readNext reads the next request, the client conn read deadline is
+// shortened when ctx is done while waiting for it.
+func (fw *forwarder) readNext(ctx context.Context) error {
+	req := fw.req
+	req.handshakeConn.done = ctx.Done()
+	stop, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			req.Fields.Conn.SetReadDeadline(time.Now())
+		case <-stop:
+		}
+	}()
+	err := req.ReadNext()
+	close(stop)
+	<-stopped
+	req.handshakeConn.done = nil
+
+	return err
+}
+
+func (fw *forwarder) roundTrip(ctx context.Context) (bool, error) {
+	outReq := fw.req.Request
+	keepAlive := !outReq.Close
+
+	removeHopByHopHeaders(outReq.Header)
+	if strings.EqualFold(outReq.Header.Get("Expect"), "100-continue") {
+		outReq.Header.Del("Expect")
+		if _, err := io.WriteString(fw.client, "HTTP/1.1 100 Continue\r\n\r\n"); err != nil {
+			return false, err
+		}
+	}
+
+	resp, err := fw.send(ctx, outReq)
+	if err != nil {
+		return false, err
+	}
+	for resp.StatusCode/100 == 1 && resp.StatusCode != http.StatusSwitchingProtocols {
+		if err = fw.writeInterim(resp, outReq); err != nil {
+			fw.closeOrigin()
+			return false, err
+		}
+		if resp, err = http.ReadResponse(fw.originReader, outReq); err != nil {
+			fw.closeOrigin()
+			WriteHTTPError(fw.req.Fields.Conn, HTTP573CommunicationError, "")
+			return false, err
+		}
+	}
+	defer resp.Body.Close()
+
+	originKeepAlive := !resp.Close
+	removeHopByHopHeaders(resp.Header)
+	if !outReq.ProtoAtLeast(1, 1) {
+		// HTTP/1.0 clients don't understand chunked bodies
+		resp.TransferEncoding = nil
+		keepAlive = false
+	}
+	resp.Close = !keepAlive
+	if err = resp.Write(fw.client); err != nil {
+		fw.closeOrigin()
+		return false, err
+	}
+	if resp.ContentLength == -1 && len(resp.TransferEncoding) == 0 {
+		// the body was delimited by closing the connection
+		keepAlive = false
+	}
+	if !originKeepAlive {
+		fw.closeOrigin()
+	}
+
+	return keepAlive, nil
+}
+
+// writeInterim passes a 1xx response on to the client. 100 Continue is
+// dropped as the proxy answers Expect itself, and HTTP/1.0 clients get none,
+// RFC 9110 section 15.2.
+func (fw *forwarder) writeInterim(resp *http.Response, outReq *http.Request) error {
+	if resp.StatusCode == http.StatusContinue || !outReq.ProtoAtLeast(1, 1) {
+		return nil
+	}
+	removeHopByHopHeaders(resp.Header)
+	var buf bytes.Buffer
+	buf.WriteString("HTTP/1.1 " + resp.Status + "\r\n")
+	resp.Header.Write(&buf)
+	buf.WriteString("\r\n")
+	_, err := fw.client.Write(buf.Bytes())
+
+	return err
+}
+
+// send writes outReq to the origin and reads the response head. A bodyless
+// idempotent request is retried once on a new connection when a kept-alive
+// one turns out to be closed by the origin.
+func (fw *forwarder) send(ctx context.Context, outReq *http.Request) (*http.Response, error) {
+	fields := fw.req.Fields
+	for {
+		reused, err := fw.connectOrigin(ctx)
+		if err != nil {
+			WriteHTTPError(fields.Conn, DialErrorResponse(err), "")
+			return nil, err
+		}
+
+		if err = outReq.Write(fw.origin); err == nil {
+			var resp *http.Response
+			if resp, err = http.ReadResponse(fw.originReader, outReq); err == nil {
+				return resp, nil
+			}
+		}
+		fw.closeOrigin()
+		if !reused || !replayable(outReq) {
+			WriteHTTPError(fields.Conn, HTTP573CommunicationError, "")
+			return nil, err
+		}
+	}
+}
+
+// replayable reports whether outReq can be sent again, RFC 9110 section
+// 9.2.2.
+func replayable(outReq *http.Request) bool {
+	if outReq.Body != nil && outReq.Body != http.NoBody {
+		return false
+	}
+	switch outReq.Method {
+	case "GET", "HEAD", "OPTIONS", "TRACE":
+		return true
+	}
+
+	return false
+}
+
+// connectOrigin dials the target unless the kept-alive origin conn already
+// leads to it, in which case reused is true.
+func (fw *forwarder) connectOrigin(ctx context.Context) (reused bool, err error) {
+	fields := fw.req.Fields
+	addr := net.JoinHostPort(fields.Host, fields.Port)
+	if fw.origin != nil && fw.originAddr == addr {
+		return true, nil
+	}
+	fw.closeOrigin()
+
+	conn, err := dialer.Dial(ctx, fields)
+	if err != nil {
+		return false, err
+	}
+
+	fw.origin = &originConn{
+		Conn:         conn,
+		readTimeout:  fields.Timeouts.Read,
+		writeTimeout: fields.Timeouts.Write,
+	}
+	fw.originAddr = addr
+	if fw.originReader == nil {
+		fw.originReader = bufio.NewReader(fw.origin)
+	} else {
+		fw.originReader.Reset(fw.origin)
+	}
+
+	return false, nil
+}
+
+func (fw *forwarder) closeOrigin() {
+	if fw.origin != nil {
+		fw.origin.Close()
+		fw.origin = nil
+		fw.originAddr = ""
+	}
+}
+
+func removeHopByHopHeaders(header http.Header) {
+	for _, v := range header.Values("Connection") {
+		for _, name := range strings.Split(v, ",") {
+			if name = textproto.TrimString(name); name != "" {
+				header.Del(name)
+			}
+		}
+	}
+	for _, name := range hopByHopHeaders {
+		header.Del(name)
+	}
+}
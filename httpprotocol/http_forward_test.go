@@ -0,0 +1,338 @@
+package httpprotocol
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/duratarskeyk/go-common-utils/authorizer"
+	"github.com/duratarskeyk/proxymux/corestructs"
+)
+
+type passwordAuth struct{}
+
+func (passwordAuth) IPAuth(proxyIP, userIP string) authorizer.AuthResult {
+	return authorizer.BadAuthResult
+}
+
+func (passwordAuth) CredentialsAuth(proxyIP, username, password string) authorizer.AuthResult {
+	if username == "a" && password == "b" {
+		return authorizer.AuthResult{OK: true, PackageID: 1, UserID: 11}
+	}
+	return authorizer.BadAuthResult
+}
+
+func startForward(t *testing.T, check func(req *HTTPRequest) error) (net.Conn, *HTTPRequest, chan error) {
+	return startForwardContext(t, context.Background(), check)
+}
+
+func startForwardContext(t *testing.T, ctx context.Context, check func(req *HTTPRequest) error) (net.Conn, *HTTPRequest, chan error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := GetHTTPRequest()
+	fields := req.Fields
+	fields.UserIP = "127.0.0.1"
+	fields.ProxyIP = "127.0.0.1"
+	fields.Conn = server
+	fields.ProxyConfig = passwordAuth{}
+	fields.Timeouts = &corestructs.Timeouts{Handshake: time.Second, Connect: time.Second, Read: time.Second, Write: time.Second}
+	errCh := make(chan error, 1)
+	go func() {
+		defer server.Close()
+		first := []byte{0}
+		server.Read(first)
+		req.FirstByte = first[0]
+		if err := req.Read(); err != nil {
+			errCh <- err
+			return
+		}
+		errCh <- Forward(ctx, req, check)
+	}()
+
+	return client, req, errCh
+}
+
+func TestForwardKeepAlive(t *testing.T) {
+	var seen []http.Header
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = append(seen, r.Header.Clone())
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("Connection", "X-Hop")
+		w.Header().Set("X-Hop", "1")
+		if r.URL.Path == "/chunked" {
+			w.Write([]byte("chunk1"))
+			w.(http.Flusher).Flush()
+			w.Write([]byte("chunk2"))
+			return
+		}
+		fmt.Fprintf(w, "%s %s %s", r.Method, r.URL.Path, body)
+	}))
+	defer origin.Close()
+	host := strings.TrimPrefix(origin.URL, "http://")
+
+	conn, req, errCh := startForward(t, nil)
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+	auth := "Proxy-Authorization: Basic YTpi\r\n"
+
+	requests := []string{
+		"GET http://" + host + "/first HTTP/1.1\r\nHost: " + host + "\r\n" + auth + "Connection: X-Secret\r\nX-Secret: 1\r\nKeep-Alive: 300\r\n\r\n",
+		"POST http://" + host + "/second HTTP/1.1\r\nHost: " + host + "\r\n" + auth + "Transfer-Encoding: chunked\r\n\r\n4\r\nbody\r\n0\r\n\r\n",
+		"GET http://" + host + "/chunked HTTP/1.1\r\nHost: " + host + "\r\n" + auth + "\r\n",
+	}
+	bodies := []string{"GET /first ", "POST /second body", "chunk1chunk2"}
+	for nr, r := range requests {
+		conn.Write([]byte(r))
+		resp, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatalf("Test #%d: %s", nr+1, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		if string(body) != bodies[nr] {
+			t.Errorf("Test #%d: Expected body %q, got %q", nr+1, bodies[nr], body)
+		}
+		if resp.Header.Get("X-Hop") != "" {
+			t.Errorf("Test #%d: Hop-by-hop response header was forwarded", nr+1)
+		}
+		if resp.Close {
+			t.Errorf("Test #%d: Expected connection to be kept alive", nr+1)
+		}
+	}
+	for nr, h := range seen {
+		for _, name := range []string{"X-Secret", "Keep-Alive", "Proxy-Authorization"} {
+			if h.Get(name) != "" {
+				t.Errorf("Test #%d: Hop-by-hop header %s reached the origin", nr+1, name)
+			}
+		}
+	}
+
+	// authorization is checked for every request
+	conn.Write([]byte("GET http://" + host + "/ HTTP/1.1\r\nHost: " + host + "\r\nProxy-Authorization: Basic YTpj\r\n\r\n"))
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusProxyAuthRequired {
+		t.Errorf("Expected status %d, got %d", http.StatusProxyAuthRequired, resp.StatusCode)
+	}
+	if err := <-errCh; err == nil {
+		t.Error("Expected auth error, got nil")
+	}
+	if req.Fields.Upload == 0 || req.Fields.Download == 0 {
+		t.Errorf("Expected traffic to be counted, got upload %d, download %d", req.Fields.Upload, req.Fields.Download)
+	}
+}
+
+func TestForwardCheck(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer origin.Close()
+	host := strings.TrimPrefix(origin.URL, "http://")
+
+	denied := fmt.Errorf("denied")
+	conn, _, errCh := startForward(t, func(req *HTTPRequest) error {
+		if req.Request.URL.Path == "/blocked" {
+			return denied
+		}
+		return nil
+	})
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+
+	conn.Write([]byte("GET http://" + host + "/ok HTTP/1.1\r\nHost: " + host + "\r\nProxy-Authorization: Basic YTpi\r\n\r\n"))
+	if resp, err := http.ReadResponse(br, nil); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected first request to succeed, got %v, %v", resp, err)
+	}
+	conn.Write([]byte("GET http://" + host + "/blocked HTTP/1.1\r\nHost: " + host + "\r\nProxy-Authorization: Basic YTpi\r\n\r\n"))
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusUnavailableForLegalReasons {
+		t.Errorf("Expected status %d, got %d", http.StatusUnavailableForLegalReasons, resp.StatusCode)
+	}
+	if err := <-errCh; err != denied {
+		t.Errorf("Expected %s, got %v", denied, err)
+	}
+}
+
+func TestForwardClientClose(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("bye"))
+	}))
+	defer origin.Close()
+	host := strings.TrimPrefix(origin.URL, "http://")
+
+	conn, _, errCh := startForward(t, nil)
+	defer conn.Close()
+	conn.Write([]byte("GET http://" + host + "/ HTTP/1.1\r\nHost: " + host + "\r\nProxy-Authorization: Basic YTpi\r\nConnection: close\r\n\r\n"))
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !resp.Close {
+		t.Error("Expected Connection: close in the response")
+	}
+	if err := <-errCh; err != nil {
+		t.Errorf("Expected nil error, got %s", err)
+	}
+}
+
+func TestForwardRetry(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	host := ln.Addr().String()
+	closed := make(chan struct{})
+	go func() {
+		// the first conn is closed right after a keep-alive response
+		for i := 0; ; i++ {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			r, err := http.ReadRequest(bufio.NewReader(c))
+			if err == nil {
+				fmt.Fprintf(c, "HTTP/1.1 200 OK\r\nContent-Length: %d\r\n\r\n%s", len(r.URL.Path), r.URL.Path)
+			}
+			c.Close()
+			if i == 0 {
+				close(closed)
+			}
+		}
+	}()
+
+	conn, _, errCh := startForward(t, nil)
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+	requests := []string{
+		"GET http://" + host + "/first HTTP/1.1\r\nHost: " + host + "\r\nProxy-Authorization: Basic YTpi\r\n\r\n",
+		"GET http://" + host + "/second HTTP/1.1\r\nHost: " + host + "\r\nProxy-Authorization: Basic YTpi\r\n\r\n",
+		"POST http://" + host + "/third HTTP/1.1\r\nHost: " + host + "\r\nProxy-Authorization: Basic YTpi\r\nContent-Length: 4\r\n\r\nbody",
+	}
+	statuses := []int{http.StatusOK, http.StatusOK, 573}
+	for nr, r := range requests {
+		if nr > 0 {
+			<-closed
+			time.Sleep(20 * time.Millisecond)
+		}
+		conn.Write([]byte(r))
+		resp, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatalf("Test #%d: %s", nr+1, err)
+		}
+		io.ReadAll(resp.Body)
+		if resp.StatusCode != statuses[nr] {
+			t.Errorf("Test #%d: Expected status %d, got %d", nr+1, statuses[nr], resp.StatusCode)
+		}
+	}
+	if err := <-errCh; err == nil {
+		t.Error("Expected the request that can't be retried to fail")
+	}
+}
+
+func TestForwardPipelinedUpload(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer origin.Close()
+	host := strings.TrimPrefix(origin.URL, "http://")
+
+	conn, req, errCh := startForward(t, nil)
+	defer conn.Close()
+	first := "GET http://" + host + "/ HTTP/1.1\r\nHost: " + host + "\r\nProxy-Authorization: Basic YTpi\r\nConnection: close\r\n\r\n"
+	conn.Write([]byte(first + "GET http://" + host + "/never HTTP/1.1\r\nHost: " + host + "\r\n\r\n"))
+	if _, err := http.ReadResponse(bufio.NewReader(conn), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errCh; err != nil {
+		t.Errorf("Expected nil error, got %s", err)
+	}
+	if req.Fields.Upload != int64(len(first)) {
+		t.Errorf("Expected Upload to be %d, got %d", len(first), req.Fields.Upload)
+	}
+}
+
+func TestForwardInterim(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	host := ln.Addr().String()
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		if _, err = http.ReadRequest(bufio.NewReader(c)); err == nil {
+			io.WriteString(c, "HTTP/1.1 100 Continue\r\n\r\n"+
+				"HTTP/1.1 103 Early Hints\r\nLink: </style.css>; rel=preload\r\n\r\n"+
+				"HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok")
+		}
+	}()
+
+	conn, _, _ := startForward(t, nil)
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+	conn.Write([]byte("GET http://" + host + "/ HTTP/1.1\r\nHost: " + host + "\r\nProxy-Authorization: Basic YTpi\r\n\r\n"))
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusEarlyHints || resp.Header.Get("Link") != "</style.css>; rel=preload" {
+		t.Errorf("Expected 103 with the Link header, got %d %v", resp.StatusCode, resp.Header)
+	}
+	if resp, err = http.ReadResponse(br, nil); err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(body) != "ok" {
+		t.Errorf("Expected 200 ok, got %d %q", resp.StatusCode, body)
+	}
+}
+
+func TestForwardContextDone(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer origin.Close()
+	host := strings.TrimPrefix(origin.URL, "http://")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	conn, _, errCh := startForwardContext(t, ctx, nil)
+	defer conn.Close()
+	conn.Write([]byte("GET http://" + host + "/ HTTP/1.1\r\nHost: " + host + "\r\nProxy-Authorization: Basic YTpi\r\n\r\n"))
+	if _, err := http.ReadResponse(bufio.NewReader(conn), nil); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+	// well before the handshake timeout ends the idle wait
+	select {
+	case err := <-errCh:
+		if err != nil {
+			t.Errorf("Expected nil error, got %s", err)
+		}
+	case <-time.After(500 * time.Millisecond):
+		t.Error("Forward kept waiting for the next request after ctx was done")
+	}
+}
@@ -14,6 +14,8 @@ type httpReader struct {
 	firstByte     byte
 	firstByteRead bool
 	total         int64
+	// done, when not nil, fails reads once it's closed
+	done <-chan struct{}
 }
 
 var nilTime time.Time
@@ -27,6 +29,11 @@ func (c *httpReader) Read(p []byte) (int, error) {
 	}
 	c.conn.SetReadDeadline(time.Now().Add(c.timeout))
 	defer c.conn.SetReadDeadline(nilTime)
+	select {
+	case <-c.done:
+		return 0, io.ErrUnexpectedEOF
+	default:
+	}
 	var (
 		n   int
 		err error
@@ -2,17 +2,28 @@ package httpprotocol
 
 import (
 	"bufio"
+	"context"
 	"encoding/base64"
+	"fmt"
+	"io"
 	"net"
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/duratarskeyk/go-common-utils/authorizer"
+	"github.com/duratarskeyk/proxymux/auth"
+	"github.com/duratarskeyk/proxymux/backconnect"
 	"github.com/duratarskeyk/proxymux/corestructs"
 	"go.uber.org/zap"
 )
 
+// rejected requests with larger bodies aren't retried
+const maxDrainedBody = 64 << 10
+
+const keepAliveHeaders = "Proxy-Connection: keep-alive\r\nConnection: keep-alive\r\n"
+
 type HTTPRequest struct {
 	Fields *corestructs.Fields
 
@@ -23,11 +34,35 @@ type HTTPRequest struct {
 
 	Tunnel bool
 
+	// Digest and NTLM, when set, accept Digest credentials and NTLM
+	// handshakes besides Basic credentials.
+	Digest *Digest
+	NTLM   *NTLM
+
+	// AuthRetries is the number of 407 responses Read sends on the same
+	// connection before it returns the auth error, which the caller answers
+	// closing the connection. Bodies of rejected requests are discarded and
+	// only the request that gets through counts toward Fields.Upload.
+	AuthRetries int
+
+	ntlm ntlmState
+
+	userIP string
+	ctx    context.Context
+
 	Request *http.Request
 }
 
 func (req *HTTPRequest) Read() error {
+	return req.ReadContext(context.Background())
+}
+
+// ReadContext reads the request passing ctx to the auth backend, ReadNext
+// keeps using it. Errors of an unavailable backend match
+// auth.ErrBackendUnavailable.
+func (req *HTTPRequest) ReadContext(ctx context.Context) error {
 	fields := req.Fields
+	req.ctx = ctx
 	req.handshakeConn.conn = fields.Conn
 	req.handshakeConn.timeout = fields.Timeouts.Handshake
 	req.handshakeConn.firstByteRead = false
@@ -38,11 +73,90 @@ func (req *HTTPRequest) Read() error {
 	} else {
 		req.buffer.Reset(&req.handshakeConn)
 	}
+	req.userIP = fields.UserIP
+	req.ntlm = ntlmState{}
 	fields.LogFields = append(fields.LogFields,
 		zap.String("user_ip", fields.UserIP),
 		zap.String("proxy_ip", fields.ProxyIP),
 		zap.String("type", "HTTP"),
 	)
+	fields.Download = 0
+
+	return req.read()
+}
+
+// ReadNext reads the next request from the same connection, running the
+// same parsing and authorization as Read.
+func (req *HTTPRequest) ReadNext() error {
+	return req.read()
+}
+
+func (req *HTTPRequest) read() error {
+	fields := req.Fields
+	retries := req.AuthRetries
+	// an NTLM handshake takes a challenge, every retry may start a new one
+	challenges := 1 + retries
+	for {
+		// a backconnect request of a rejected attempt may have replaced them
+		fields.UserIP = req.userIP
+		fields.LogFields = fields.LogFields[:3]
+		fields.LogFields[0].String = req.userIP
+
+		start := req.consumed()
+		err := req.readRequest()
+		switch {
+		case err == errChallengeSent && challenges > 0:
+			challenges--
+			if !req.drainBody() {
+				return &ErrBadRequest{err: ErrRequestReadFailed}
+			}
+		case err == errChallengeSent:
+			return &ErrAuth{err: ErrNTLMHandshake}
+		case err != nil && retries > 0 && req.Request != nil && !req.Request.Close && ReadErrorResponse(err) == HTTP407Unauthorized:
+			retries--
+			if !req.drainBody() || req.writeChallenge(err) != nil {
+				return err
+			}
+		default:
+			return err
+		}
+
+		// the client answers on the same connection, only the request
+		// that gets through counts
+		req.handshakeConn.total -= req.consumed() - start
+	}
+}
+
+// consumed returns the bytes of the connection parsed so far.
+func (req *HTTPRequest) consumed() int64 {
+	return req.handshakeConn.total - int64(req.buffer.Buffered())
+}
+
+// drainBody discards the body of a rejected request, false when it's
+// too large or can't be read.
+func (req *HTTPRequest) drainBody() bool {
+	body := req.Request.Body
+	if body == nil {
+		return true
+	}
+	n, err := io.Copy(io.Discard, io.LimitReader(body, maxDrainedBody+1))
+	body.Close()
+
+	return err == nil && n <= maxDrainedBody
+}
+
+// writeChallenge answers a request rejected by err with a 407 keeping the
+// connection open.
+func (req *HTTPRequest) writeChallenge(err error) error {
+	resp := strings.Replace(req.ErrorResponse(err), "Connection: close\r\n", keepAliveHeaders, 1)
+	now := time.Now().UTC().Format("Mon, 02 Jan 2006 15:04:05 GMT")
+	_, err = fmt.Fprintf(req.Fields.Conn, resp, now, "Content-Length: 0\r\n", "\r\n")
+
+	return err
+}
+
+func (req *HTTPRequest) readRequest() error {
+	fields := req.Fields
 
 	var err error
 	req.Request, err = http.ReadRequest(req.buffer)
@@ -53,14 +167,14 @@ func (req *HTTPRequest) Read() error {
 	req.Tunnel = req.Request.Method == "CONNECT"
 
 	fields.Upload = req.handshakeConn.total
-	fields.Download = 0
 
 	hostname := req.Request.URL.Host
 	if hostname == "" {
 		return &ErrBadRequest{err: ErrNotAuthorativeRequest}
 	}
 
-	if strings.IndexByte(hostname, ':') != -1 {
+	// a colon after the closing bracket of an IPv6 literal starts the port
+	if i := strings.LastIndexByte(hostname, ':'); i != -1 && i > strings.LastIndexByte(hostname, ']') {
 		fields.Host, fields.Port, err = net.SplitHostPort(hostname)
 		if err != nil {
 			return &ErrBadRequest{err: err}
@@ -74,6 +188,9 @@ func (req *HTTPRequest) Read() error {
 		}
 		fields.PortNum = uint16(portNum)
 	} else {
+		if len(hostname) > 2 && hostname[0] == '[' && hostname[len(hostname)-1] == ']' {
+			hostname = hostname[1 : len(hostname)-1]
+		}
 		if req.Tunnel {
 			fields.Host, fields.Port, fields.PortNum = hostname, "80", 80
 		} else {
@@ -88,19 +205,24 @@ func (req *HTTPRequest) Read() error {
 		}
 	}
 
-	fields.HostIP = net.ParseIP(hostname)
+	fields.HostIP = net.ParseIP(fields.Host)
 	if fields.HostIP != nil && fields.HostIP.To4() == nil {
 		fields.HostType = corestructs.HostTypeIPv6
 	} else if fields.HostIP != nil {
+		fields.HostIP = fields.HostIP.To4()
 		fields.HostType = corestructs.HostTypeIPv4
 	} else {
 		fields.HostType = corestructs.HostTypeHostname
 	}
+	if fields.IPv6Denied() {
+		return &ErrBadRequest{err: ErrIPv6Addr}
+	}
 
 	fields.Login = ""
+	fields.LoginOptions = fields.LoginOptions[:0]
 	fields.Password = ""
-	auth := fields.ProxyConfig.(authorizer.Authorizer)
-	result := auth.IPAuth(fields.ProxyIP, fields.UserIP)
+	backend := auth.From(fields.ProxyConfig)
+	result, ipAuthErr := backend.IPAuth(req.ctx, fields.ProxyIP, fields.UserIP)
 	if result.OK {
 		fields.PackageID = result.PackageID
 		fields.UserID = result.UserID
@@ -109,59 +231,34 @@ func (req *HTTPRequest) Read() error {
 	} else {
 		authHeader := req.Request.Header.Get("Proxy-Authorization")
 		if authHeader != "" {
-			if !strings.HasPrefix(strings.ToLower(authHeader), "basic ") {
-				return &ErrBadRequest{err: ErrNotBasicAuth}
+			scheme, credentials, _ := strings.Cut(authHeader, " ")
+			switch {
+			case strings.EqualFold(scheme, "basic"):
+				result, err = req.basicAuth(backend, credentials)
+			case strings.EqualFold(scheme, "bearer") && fields.TokenVerifier != nil:
+				result, err = req.bearerAuth(credentials)
+			case strings.EqualFold(scheme, "digest") && req.Digest != nil:
+				result, err = req.Digest.Verify(req.ctx, fields, credentials, req.Request.Method, req.Request.RequestURI)
+			case req.NTLM != nil && (strings.EqualFold(scheme, "ntlm") || req.NTLM.Negotiate && strings.EqualFold(scheme, "negotiate")):
+				result, err = req.ntlmAuth(scheme, credentials)
+			default:
+				err = &ErrBadRequest{err: ErrNotBasicAuth}
 			}
-			baseStr := authHeader[6:]
-			decoded, err := base64.StdEncoding.DecodeString(baseStr)
 			if err != nil {
-				return &ErrBadRequest{err: err}
+				return err
 			}
-			credentials := string(decoded)
-			index := strings.IndexByte(credentials, ':')
-			if index == -1 {
-				fields.Login = credentials
-				fields.Password = ""
-				result = auth.CredentialsAuth(fields.ProxyIP, fields.Login, "")
-			} else {
-				fields.Login = credentials[:index]
-				fields.Password = credentials[index+1:]
-				result = auth.CredentialsAuth(fields.ProxyIP, fields.Login, fields.Password)
+			if err = req.applyResult(result); err != nil {
+				return err
 			}
-
-			if !result.OK {
-				return &ErrAuth{err: ErrBadCredentials}
+		} else if req.ntlm.authenticated {
+			if result, err = req.ntlmConnAuth(); err != nil {
+				return err
 			}
-
-			fields.PackageID = result.PackageID
-			fields.UserID = result.UserID
-			fields.SystemUser = result.SystemUser
-			fields.Backconnect = result.Backconnect
-
-			if result.Backconnect {
-				packageIDStr := req.Request.Header.Get("X-Packageid")
-				fields.PackageID, err = strconv.Atoi(packageIDStr)
-				if err != nil {
-					return &ErrBadRequest{err: err}
-				}
-				userIDStr := req.Request.Header.Get("X-Userid")
-				fields.UserID, err = strconv.Atoi(userIDStr)
-				if err != nil {
-					return &ErrBadRequest{err: err}
-				}
-
-				userIP := req.Request.Header.Get("X-Clientip")
-				if userIP == "" {
-					return &ErrBadRequest{err: ErrBackconnectUserIPNotPresent}
-				}
-				fields.UserIP = userIP
-				fields.LogFields[0].String = userIP
-				if !req.Tunnel {
-					req.Request.Header.Del("X-Packageid")
-					req.Request.Header.Del("X-Userid")
-					req.Request.Header.Del("X-Clientip")
-				}
+			if err = req.applyResult(result); err != nil {
+				return err
 			}
+		} else if ipAuthErr != nil {
+			return &ErrAuth{err: auth.NewErrBackend(ipAuthErr)}
 		} else {
 			return &ErrAuth{err: ErrIPAuthFailed}
 		}
@@ -185,9 +282,104 @@ func (req *HTTPRequest) Read() error {
 		}
 	}
 
-	proxyIPOctets := []byte(net.ParseIP(fields.ProxyIP).To4())
-	fields.ProxyIPNum = (uint32(proxyIPOctets[0]) << 24) | (uint32(proxyIPOctets[1]) << 16) |
-		(uint32(proxyIPOctets[2]) << 8) | uint32(proxyIPOctets[3])
+	fields.SetProxyAddr()
 
 	return nil
 }
+
+func (req *HTTPRequest) basicAuth(backend auth.Authorizer, credentials string) (authorizer.AuthResult, error) {
+	fields := req.Fields
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(credentials))
+	if err != nil {
+		return authorizer.BadAuthResult, &ErrBadRequest{err: err}
+	}
+	fields.Login, fields.Password, _ = strings.Cut(string(decoded), ":")
+	if err = fields.ParseLogin(); err != nil {
+		return authorizer.BadAuthResult, &ErrAuth{err: err}
+	}
+	result, isToken, err := fields.TokenAuth(req.ctx)
+	if isToken {
+		if err != nil {
+			return authorizer.BadAuthResult, &ErrAuth{err: err}
+		}
+	} else if result, err = backend.CredentialsAuth(req.ctx, fields.ProxyIP, fields.Login, fields.Password); err != nil {
+		return authorizer.BadAuthResult, &ErrAuth{err: auth.NewErrBackend(err)}
+	}
+	if !result.OK {
+		return authorizer.BadAuthResult, &ErrAuth{err: ErrBadCredentials}
+	}
+
+	return result, nil
+}
+
+func (req *HTTPRequest) bearerAuth(token string) (authorizer.AuthResult, error) {
+	fields := req.Fields
+	fields.Password = strings.TrimSpace(token)
+	result, isToken, err := fields.TokenAuth(req.ctx)
+	if !isToken {
+		return authorizer.BadAuthResult, &ErrBadRequest{err: ErrBadToken}
+	}
+	if err != nil {
+		return authorizer.BadAuthResult, &ErrAuth{err: err}
+	}
+	fields.Password = ""
+
+	return result, nil
+}
+
+func (req *HTTPRequest) applyResult(result authorizer.AuthResult) error {
+	fields := req.Fields
+	fields.PackageID = result.PackageID
+	fields.UserID = result.UserID
+	fields.SystemUser = result.SystemUser
+	fields.Backconnect = result.Backconnect
+	if !result.Backconnect {
+		return nil
+	}
+
+	var (
+		userIP string
+		err    error
+	)
+	envelope := req.Request.Header.Get(backconnect.Header)
+	if v := fields.BackconnectVerifier; v != nil && v.Legacy && envelope == "" {
+		userIP, err = req.legacyBackconnect()
+	} else {
+		fields.PackageID, fields.UserID, userIP, err = v.ReadHeader(envelope)
+	}
+	if err != nil {
+		return &ErrBadRequest{err: err}
+	}
+	fields.UserIP = userIP
+	fields.LogFields[0].String = userIP
+	if !req.Tunnel {
+		req.Request.Header.Del(backconnect.Header)
+		req.Request.Header.Del("X-Packageid")
+		req.Request.Header.Del("X-Userid")
+		req.Request.Header.Del("X-Clientip")
+	}
+
+	return nil
+}
+
+func (req *HTTPRequest) legacyBackconnect() (string, error) {
+	fields := req.Fields
+	var err error
+	packageIDStr := req.Request.Header.Get("X-Packageid")
+	fields.PackageID, err = strconv.Atoi(packageIDStr)
+	if err != nil {
+		return "", err
+	}
+	userIDStr := req.Request.Header.Get("X-Userid")
+	fields.UserID, err = strconv.Atoi(userIDStr)
+	if err != nil {
+		return "", err
+	}
+
+	userIP := req.Request.Header.Get("X-Clientip")
+	if userIP == "" {
+		return "", ErrBackconnectUserIPNotPresent
+	}
+
+	return userIP, nil
+}
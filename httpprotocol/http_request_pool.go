@@ -26,6 +26,11 @@ func PutHTTPRequest(req *HTTPRequest) {
 	req.Fields.Clean()
 	req.handshakeConn.conn = nil
 	req.Request = nil
+	req.ctx = nil
+	req.Digest = nil
+	req.NTLM = nil
+	req.AuthRetries = 0
+	req.ntlm = ntlmState{}
 
 	HTTPRequestPool.Put(req)
 }
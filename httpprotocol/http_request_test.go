@@ -1,16 +1,24 @@
 package httpprotocol
 
 import (
+	"bufio"
+	"context"
 	"encoding/base64"
 	"errors"
+	"fmt"
+	"io"
 	"net"
+	"net/http"
 	"strings"
 	"testing"
 	"time"
 
 	"github.com/duratarskeyk/go-common-utils/authorizer"
+	"github.com/duratarskeyk/proxymux/auth"
+	"github.com/duratarskeyk/proxymux/backconnect"
 	"github.com/duratarskeyk/proxymux/corestructs"
 	"github.com/duratarskeyk/proxymux/internal/authmock"
+	"github.com/duratarskeyk/proxymux/loginparams"
 )
 
 type goodTestCase struct {
@@ -181,6 +189,7 @@ func TestGoodRequests(t *testing.T) {
 		fields.UserID = 0
 		fields.Conn = c1
 		fields.ProxyConfig = testCase.authMock
+		fields.BackconnectVerifier = &backconnect.Verifier{Legacy: true}
 		fields.Timeouts = &corestructs.Timeouts{Handshake: 30 * time.Second}
 		go func() {
 			req.Read()
@@ -327,3 +336,364 @@ func TestBadRequests(t *testing.T) {
 		}
 	}
 }
+
+func TestDualStackRequests(t *testing.T) {
+	okAuth := &authmock.Mock{
+		IPAuthRet:          authorizer.AuthResult{OK: true, PackageID: 1, UserID: 11},
+		CredentialsAuthRet: authorizer.BadAuthResult,
+	}
+	testCases := []struct {
+		proxyIP     string
+		policy      corestructs.IPv6Policy
+		httpRequest []byte
+		firstByte   byte
+
+		host       string
+		port       string
+		hostType   int
+		proxyIPNum uint32
+		err        error
+	}{
+		{"1.2.3.4", corestructs.IPv6Allow, []byte("ONNECT 5.6.7.8:443 HTTP/1.1\r\nHost: 5.6.7.8:443\r\n\r\n"), 'C', "5.6.7.8", "443", corestructs.HostTypeIPv4, 0x01020304, nil},
+		{"2001:db8::1", corestructs.IPv6Allow, []byte("ONNECT [2001:db8::2]:443 HTTP/1.1\r\nHost: [2001:db8::2]:443\r\n\r\n"), 'C', "2001:db8::2", "443", corestructs.HostTypeIPv6, 0, nil},
+		{"2001:db8::1", corestructs.IPv6Allow, []byte("ET http://[2001:db8::2]/ HTTP/1.1\r\nHost: [2001:db8::2]\r\n\r\n"), 'G', "2001:db8::2", "80", corestructs.HostTypeIPv6, 0, nil},
+		{"::ffff:1.2.3.4", corestructs.IPv6Allow, []byte("ET http://example.org/ HTTP/1.1\r\nHost: example.org\r\n\r\n"), 'G', "example.org", "80", corestructs.HostTypeHostname, 0x01020304, nil},
+		{"1.2.3.4", corestructs.IPv6Deny, []byte("ONNECT [2001:db8::2]:443 HTTP/1.1\r\nHost: [2001:db8::2]:443\r\n\r\n"), 'C', "", "", 0, 0, ErrIPv6Addr},
+		{"1.2.3.4", corestructs.IPv6Deny, []byte("ONNECT 5.6.7.8:443 HTTP/1.1\r\nHost: 5.6.7.8:443\r\n\r\n"), 'C', "5.6.7.8", "443", corestructs.HostTypeIPv4, 0x01020304, nil},
+	}
+	errCh := make(chan error)
+	for nr, testCase := range testCases {
+		c1, c2 := net.Pipe()
+		req := GetHTTPRequest()
+		req.FirstByte = testCase.firstByte
+		fields := req.Fields
+		fields.UserIP = "2001:db8::3"
+		fields.ProxyIP = testCase.proxyIP
+		fields.IPv6Policy = testCase.policy
+		fields.Conn = c1
+		fields.ProxyConfig = okAuth
+		fields.Timeouts = &corestructs.Timeouts{Handshake: 30 * time.Second}
+		go func() {
+			errCh <- req.Read()
+		}()
+		c2.Write(testCase.httpRequest)
+		err := <-errCh
+		c1.Close()
+		c2.Close()
+		if !errors.Is(err, testCase.err) {
+			t.Errorf("Test #%d: Expected %v, got %v", nr+1, testCase.err, err)
+		} else if err == nil {
+			if fields.Host != testCase.host || fields.Port != testCase.port || fields.HostType != testCase.hostType {
+				t.Errorf("Test #%d: Expected %s %s type %d, got %s %s type %d", nr+1, testCase.host, testCase.port, testCase.hostType, fields.Host, fields.Port, fields.HostType)
+			}
+			if fields.ProxyIPNum != testCase.proxyIPNum || !fields.ProxyAddr.IsValid() {
+				t.Errorf("Test #%d: Expected ProxyIPNum %x, got %x, ProxyAddr %s", nr+1, testCase.proxyIPNum, fields.ProxyIPNum, fields.ProxyAddr)
+			}
+		} else if resp := ReadErrorResponse(err); resp != HTTP571IPv6NotSupported {
+			t.Errorf("Test #%d: Expected 571 response, got %q", nr+1, resp[:strings.IndexByte(resp, '\r')])
+		}
+		PutHTTPRequest(req)
+	}
+}
+
+func TestLoginOptions(t *testing.T) {
+	credentials := []string{"user-session-abc-ttl-10m:pass", "user-session-a-city-x:pass"}
+	results := []struct {
+		err error
+		ttl string
+	}{
+		{nil, "10m"},
+		{loginparams.ErrUnknownOption, ""},
+	}
+	errCh := make(chan error)
+	for nr, cred := range credentials {
+		c1, c2 := net.Pipe()
+		mock := &authmock.Mock{
+			IPAuthRet:          authorizer.BadAuthResult,
+			CredentialsAuthRet: authorizer.AuthResult{OK: true, PackageID: 1, UserID: 11},
+		}
+		req := GetHTTPRequest()
+		req.FirstByte = 'C'
+		fields := req.Fields
+		fields.UserIP = "4.3.2.1"
+		fields.ProxyIP = "1.2.3.4"
+		fields.Conn = c1
+		fields.ProxyConfig = mock
+		fields.LoginParser = &loginparams.Parser{Keys: []string{"session", "ttl"}}
+		fields.Timeouts = &corestructs.Timeouts{Handshake: 30 * time.Second}
+		go func() {
+			errCh <- req.Read()
+		}()
+		c2.Write([]byte("ONNECT example.org:443 HTTP/1.1\r\nHost: example.org:443\r\nProxy-Authorization: Basic " +
+			base64.StdEncoding.EncodeToString([]byte(cred)) + "\r\n\r\n"))
+		err := <-errCh
+		c1.Close()
+		c2.Close()
+		var authErr *ErrAuth
+		if !errors.Is(err, results[nr].err) || (err != nil && !errors.As(err, &authErr)) {
+			t.Errorf("Test #%d: Expected %v, got %v", nr+1, results[nr].err, err)
+		} else if err == nil {
+			ttl, _ := fields.LoginOptions.Get("ttl")
+			if mock.Username != "user" || mock.Password != "pass" || ttl != results[nr].ttl {
+				t.Errorf("Test #%d: Expected user/pass with ttl %s, got %s/%s with %v", nr+1, results[nr].ttl, mock.Username, mock.Password, fields.LoginOptions)
+			}
+		}
+		PutHTTPRequest(req)
+	}
+}
+
+func TestBackendUnavailable(t *testing.T) {
+	down := errors.New("down")
+	backends := []*authmock.Backend{
+		{IPAuthErr: down},
+		{CredentialsAuthErr: down},
+	}
+	requests := []string{
+		"ONNECT example.org:443 HTTP/1.1\r\nHost: example.org:443\r\n\r\n",
+		"ONNECT example.org:443 HTTP/1.1\r\nHost: example.org:443\r\nProxy-Authorization: Basic YTpi\r\n\r\n",
+	}
+	errCh := make(chan error)
+	for nr, backend := range backends {
+		c1, c2 := net.Pipe()
+		req := GetHTTPRequest()
+		req.FirstByte = 'C'
+		fields := req.Fields
+		fields.UserIP = "4.3.2.1"
+		fields.ProxyIP = "1.2.3.4"
+		fields.Conn = c1
+		fields.ProxyConfig = backend
+		fields.Timeouts = &corestructs.Timeouts{Handshake: 30 * time.Second}
+		go func() {
+			errCh <- req.ReadContext(context.Background())
+		}()
+		c2.Write([]byte(requests[nr]))
+		err := <-errCh
+		c1.Close()
+		c2.Close()
+		if !errors.Is(err, auth.ErrBackendUnavailable) {
+			t.Errorf("Test #%d: Expected ErrBackendUnavailable, got %v", nr+1, err)
+		} else if resp := ReadErrorResponse(err); resp != HTTP503ServiceUnavailable {
+			t.Errorf("Test #%d: Expected 503 response, got %q", nr+1, resp[:strings.IndexByte(resp, '\r')])
+		}
+		PutHTTPRequest(req)
+	}
+}
+
+func TestAuthRetries(t *testing.T) {
+	mock := &authmock.Mock{IPAuthRet: authorizer.BadAuthResult, CredentialsAuthRet: authorizer.BadAuthResult}
+	start := func(retries int) (*HTTPRequest, net.Conn, *bufio.Reader, chan error) {
+		c1, c2 := net.Pipe()
+		req := GetHTTPRequest()
+		req.FirstByte = 'P'
+		req.Digest = &Digest{Realm: "Proxy", Source: testDigestPasswords}
+		req.AuthRetries = retries
+		fields := req.Fields
+		fields.UserIP = "4.3.2.1"
+		fields.ProxyIP = "1.2.3.4"
+		fields.Conn = c1
+		fields.ProxyConfig = mock
+		fields.Timeouts = &corestructs.Timeouts{Handshake: 5 * time.Second}
+		errCh := make(chan error, 1)
+		go func() {
+			errCh <- req.Read()
+			c1.Close()
+		}()
+		return req, c2, bufio.NewReader(c2), errCh
+	}
+	readChallenge := func(r *bufio.Reader) (string, error) {
+		resp, err := http.ReadResponse(r, nil)
+		if err != nil {
+			return "", err
+		}
+		if resp.StatusCode != 407 || resp.Close || resp.ContentLength != 0 {
+			return "", fmt.Errorf("expected a keep-alive 407, got %d, close %v", resp.StatusCode, resp.Close)
+		}
+		return nonceRe.FindStringSubmatch(resp.Header.Get("Proxy-Authenticate"))[1], nil
+	}
+
+	req, conn, r, errCh := start(2)
+	conn.Write([]byte("OST http://example.org/ HTTP/1.1\r\nHost: example.org\r\nContent-Length: 5\r\n\r\nfirst"))
+	if _, err := readChallenge(r); err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte("POST http://example.org/ HTTP/1.1\r\nHost: example.org\r\nContent-Length: 6\r\nProxy-Authorization: Basic YTpi\r\n\r\nsecond"))
+	nonce, err := readChallenge(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := digestParams{login: "user", password: "pass", realm: "Proxy", algorithm: "SHA-256", method: "POST", uri: "http://example.org/", nonce: nonce, nc: 1}
+	final := "POST http://example.org/ HTTP/1.1\r\nHost: example.org\r\nContent-Length: 5\r\nProxy-Authorization: Digest " + digestHeader(p) + "\r\n\r\n"
+	conn.Write([]byte(final))
+	if err := <-errCh; err != nil {
+		t.Fatalf("Expected the third request to get through, got %s", err)
+	}
+	if req.Fields.UserID != 11 {
+		t.Errorf("Expected user 11, got %d", req.Fields.UserID)
+	}
+	if req.Fields.Upload != int64(len(final)) {
+		t.Errorf("Expected Upload of the final request headers %d, got %d", len(final), req.Fields.Upload)
+	}
+	conn.Close()
+	PutHTTPRequest(req)
+
+	requests := []string{
+		// retries run out
+		"OST http://example.org/ HTTP/1.1\r\nHost: example.org\r\n\r\n",
+		// the client closes the connection
+		"OST http://example.org/ HTTP/1.1\r\nHost: example.org\r\nConnection: close\r\n\r\n",
+		// the body is too large to discard
+		"OST http://example.org/ HTTP/1.1\r\nHost: example.org\r\nContent-Length: 1000000\r\n\r\n",
+	}
+	challenges := []int{1, 0, 0}
+	for nr, request := range requests {
+		req, conn, r, errCh := start(1)
+		conn.Write([]byte(request))
+		for i := 0; i < challenges[nr]; i++ {
+			if _, err := readChallenge(r); err != nil {
+				t.Fatalf("Test #%d: %s", nr+1, err)
+			}
+			conn.Write([]byte("P" + request))
+		}
+		if nr == 2 {
+			go io.Copy(conn, io.LimitReader(zeroReader{}, 1000000))
+		}
+		if err := <-errCh; !errors.Is(err, ErrIPAuthFailed) {
+			t.Errorf("Test #%d: Expected ErrIPAuthFailed, got %v", nr+1, err)
+		}
+		conn.Close()
+		PutHTTPRequest(req)
+	}
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+var errBadTestToken = errors.New("bad test token")
+
+type testTokens map[string]auth.TokenResult
+
+func (tokens testTokens) IsToken(s string) bool {
+	return strings.HasPrefix(s, "tok.")
+}
+
+func (tokens testTokens) VerifyToken(ctx context.Context, proxyIP, token string) (auth.TokenResult, error) {
+	result, ok := tokens[token]
+	if !ok {
+		return result, errBadTestToken
+	}
+
+	return result, nil
+}
+
+func TestBearerAuth(t *testing.T) {
+	tokens := testTokens{"tok.good": {
+		AuthResult: authorizer.AuthResult{OK: true, PackageID: 2, UserID: 22},
+		Login:      "tokenuser",
+		Options:    loginparams.Options{{Key: "session", Value: "s1"}},
+	}}
+	testCases := []struct {
+		authorization string
+		err           error
+	}{
+		{"Bearer tok.good", nil},
+		{"bearer  tok.good ", nil},
+		{"Bearer tok.bad", errBadTestToken},
+		{"Bearer password", ErrBadToken},
+		{"Basic " + base64.StdEncoding.EncodeToString([]byte("user:tok.good")), nil},
+		{"Basic " + base64.StdEncoding.EncodeToString([]byte("user:tok.bad")), errBadTestToken},
+	}
+	errCh := make(chan error)
+	for nr, tc := range testCases {
+		c1, c2 := net.Pipe()
+		req := GetHTTPRequest()
+		req.FirstByte = 'C'
+		fields := req.Fields
+		fields.UserIP = "4.3.2.1"
+		fields.ProxyIP = "1.2.3.4"
+		fields.Conn = c1
+		fields.ProxyConfig = &authmock.Mock{IPAuthRet: authorizer.BadAuthResult, CredentialsAuthRet: authorizer.BadAuthResult}
+		fields.TokenVerifier = tokens
+		fields.Timeouts = &corestructs.Timeouts{Handshake: 5 * time.Second}
+		go func() {
+			errCh <- req.Read()
+		}()
+		c2.Write([]byte("ONNECT example.org:443 HTTP/1.1\r\nHost: example.org:443\r\nProxy-Authorization: " + tc.authorization + "\r\n\r\n"))
+		err := <-errCh
+		c1.Close()
+		c2.Close()
+		if !errors.Is(err, tc.err) {
+			t.Errorf("Test #%d: Expected %v, got %v", nr+1, tc.err, err)
+		} else if err == nil {
+			session, _ := fields.LoginOptions.Get("session")
+			if fields.Login != "tokenuser" || fields.UserID != 22 || fields.PackageID != 2 || session != "s1" || (strings.HasPrefix(tc.authorization, "Bearer") && fields.Password != "") {
+				t.Errorf("Test #%d: Unexpected identity %s %d %d %v", nr+1, fields.Login, fields.UserID, fields.PackageID, fields.LoginOptions)
+			}
+		} else if resp := req.ErrorResponse(err); errors.Is(err, errBadTestToken) && !strings.Contains(resp, `Proxy-Authenticate: Bearer realm="Proxy"`) {
+			t.Errorf("Test #%d: Expected a Bearer challenge, got %q", nr+1, resp)
+		}
+		PutHTTPRequest(req)
+	}
+}
+
+func TestSignedBackconnect(t *testing.T) {
+	secret := []byte("0123456789abcdef0123456789abcdef")
+	verifier, err := backconnect.NewVerifier(backconnect.Key{ID: 1, HMAC: secret})
+	if err != nil {
+		t.Fatal(err)
+	}
+	envelope, err := (&backconnect.Signer{KeyID: 1, HMAC: secret}).Header(5, 55, net.ParseIP("5.5.5.5"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCases := []struct {
+		verifier *backconnect.Verifier
+		err      error
+	}{
+		{verifier, nil},
+		{verifier, backconnect.ErrReplayed},
+		{nil, backconnect.ErrNotConfigured},
+		{&backconnect.Verifier{Legacy: true}, backconnect.ErrUnknownKey},
+		{&backconnect.Verifier{Keys: verifier.Keys, Legacy: true}, nil},
+	}
+	errCh := make(chan error)
+	for nr, tc := range testCases {
+		c1, c2 := net.Pipe()
+		req := GetHTTPRequest()
+		req.FirstByte = 'G'
+		fields := req.Fields
+		fields.UserIP = "4.3.2.1"
+		fields.ProxyIP = "1.2.3.4"
+		fields.Conn = c1
+		fields.ProxyConfig = &authmock.Mock{
+			IPAuthRet:          authorizer.BadAuthResult,
+			CredentialsAuthRet: authorizer.AuthResult{OK: true, PackageID: 1, UserID: 11, Backconnect: true},
+		}
+		fields.BackconnectVerifier = tc.verifier
+		fields.Timeouts = &corestructs.Timeouts{Handshake: 5 * time.Second}
+		go func() {
+			errCh <- req.Read()
+		}()
+		c2.Write([]byte("ET http://example.org HTTP/1.1\r\nHost: example.org\r\nProxy-Authorization: Basic YTpi\r\nX-Backconnect: " + envelope + "\r\n\r\n"))
+		err := <-errCh
+		c1.Close()
+		c2.Close()
+		var rejected *backconnect.ErrRejected
+		if !errors.Is(err, tc.err) || (errors.Is(err, backconnect.ErrReplayed) && !errors.As(err, &rejected)) {
+			t.Errorf("Test #%d: Expected %v, got %v", nr+1, tc.err, err)
+		} else if err == nil {
+			if fields.PackageID != 5 || fields.UserID != 55 || fields.UserIP != "5.5.5.5" {
+				t.Errorf("Test #%d: Expected 5 55 5.5.5.5, got %d %d %s", nr+1, fields.PackageID, fields.UserID, fields.UserIP)
+			}
+			if req.Request.Header.Get(backconnect.Header) != "" {
+				t.Errorf("Test #%d: Expected the envelope header to be removed", nr+1)
+			}
+		}
+		PutHTTPRequest(req)
+	}
+}
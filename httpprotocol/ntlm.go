@@ -0,0 +1,174 @@
+package httpprotocol
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/duratarskeyk/go-common-utils/authorizer"
+	"github.com/duratarskeyk/proxymux/auth"
+	"github.com/duratarskeyk/proxymux/internal/ntlm"
+)
+
+// errChallengeSent is returned by readRequest after it answered a
+// handshake message with a 407 and the client has to answer on the same
+// connection.
+var errChallengeSent = errors.New("challenge sent")
+
+const defaultNTLMDomain = "PROXY"
+
+// NTHashSource looks up the NT hash, the MD4 of the UTF-16 password, of user
+// in domain. A result that isn't OK means the user is unknown.
+type NTHashSource interface {
+	NTHash(ctx context.Context, proxyIP, user, domain string) ([]byte, authorizer.AuthResult, error)
+}
+
+// NTHash returns the NT hash of password.
+func NTHash(password string) []byte {
+	return ntlm.NTHash(password)
+}
+
+// NTLM accepts NTLMv2 handshakes sent with the NTLM scheme and, when
+// Negotiate is set, with the Negotiate one wrapped in SPNEGO. The handshake
+// authenticates the connection, following requests without credentials are
+// made by the same user. Domain and Computer are the NetBIOS names sent in
+// the challenge, PROXY by default.
+type NTLM struct {
+	Source    NTHashSource
+	Negotiate bool
+	Domain    string
+	Computer  string
+}
+
+type ntlmState struct {
+	challenge [8]byte
+	pending   bool
+
+	authenticated bool
+	login         string
+	result        authorizer.AuthResult
+}
+
+var http407Challenge = "HTTP/1.1 407 Proxy Authentication Required\r\n" +
+	"Server: FaaS v1.3-20220203-7fa38bd5af\r\n" +
+	"Date: %s\r\n" +
+	"Proxy-Authenticate: %s\r\n" +
+	"Content-Length: 0\r\n" +
+	"Proxy-Connection: keep-alive\r\n" +
+	"Connection: keep-alive\r\n\r\n"
+
+func (req *HTTPRequest) ntlmAuth(scheme, credentials string) (authorizer.AuthResult, error) {
+	fields := req.Fields
+	token, err := base64.StdEncoding.DecodeString(strings.TrimSpace(credentials))
+	if err != nil {
+		return authorizer.BadAuthResult, &ErrBadRequest{err: err}
+	}
+	negotiate := strings.EqualFold(scheme, "negotiate")
+	msg := token
+	if negotiate {
+		if msg, err = ntlm.Unwrap(token); errors.Is(err, ntlm.ErrNoNTLMMech) {
+			return authorizer.BadAuthResult, &ErrAuth{err: ErrUnsupportedNTLM}
+		} else if err != nil {
+			return authorizer.BadAuthResult, &ErrBadRequest{err: ErrBadNTLMMessage}
+		}
+	}
+
+	switch ntlm.MessageType(msg) {
+	case ntlm.NegotiateMessage:
+		n, err := ntlm.ParseNegotiate(msg)
+		if err != nil {
+			return authorizer.BadAuthResult, &ErrBadRequest{err: ErrBadNTLMMessage}
+		}
+		if _, err = io.ReadFull(rand.Reader, req.ntlm.challenge[:]); err != nil {
+			return authorizer.BadAuthResult, err
+		}
+		challenge := n.Challenge(req.ntlm.challenge, req.NTLM.domain(), req.NTLM.computer())
+		scheme = "NTLM"
+		if negotiate {
+			challenge = ntlm.Wrap(challenge)
+			scheme = "Negotiate"
+		}
+		req.ntlm.pending = true
+		now := time.Now().UTC().Format("Mon, 02 Jan 2006 15:04:05 GMT")
+		if _, err = fmt.Fprintf(fields.Conn, http407Challenge, now, scheme+" "+base64.StdEncoding.EncodeToString(challenge)); err != nil {
+			return authorizer.BadAuthResult, err
+		}
+		return authorizer.BadAuthResult, errChallengeSent
+	case ntlm.AuthenticateMessage:
+		if !req.ntlm.pending {
+			return authorizer.BadAuthResult, &ErrAuth{err: ErrNTLMHandshake}
+		}
+		// a challenge is answered once
+		req.ntlm.pending = false
+		a, err := ntlm.ParseAuthenticate(msg)
+		if err != nil {
+			return authorizer.BadAuthResult, &ErrBadRequest{err: ErrBadNTLMMessage}
+		}
+		if a.User == "" {
+			return authorizer.BadAuthResult, &ErrAuth{err: ErrBadCredentials}
+		}
+		if req.NTLM.Source == nil {
+			return authorizer.BadAuthResult, &ErrAuth{err: auth.NewErrBackend(auth.ErrNoAuthorizer)}
+		}
+		fields.Login = a.User
+		if err = fields.ParseLogin(); err != nil {
+			return authorizer.BadAuthResult, &ErrAuth{err: err}
+		}
+		ntHash, result, err := req.NTLM.Source.NTHash(req.ctx, fields.ProxyIP, fields.Login, a.Domain)
+		if err != nil {
+			return authorizer.BadAuthResult, &ErrAuth{err: auth.NewErrBackend(err)}
+		}
+		if !result.OK {
+			return authorizer.BadAuthResult, &ErrAuth{err: ErrBadCredentials}
+		}
+		ok, err := a.VerifyV2(req.ntlm.challenge, ntHash)
+		if errors.Is(err, ntlm.ErrNTLMv1) {
+			return authorizer.BadAuthResult, &ErrAuth{err: ErrUnsupportedNTLM}
+		} else if err != nil {
+			return authorizer.BadAuthResult, &ErrBadRequest{err: ErrBadNTLMMessage}
+		}
+		if !ok {
+			return authorizer.BadAuthResult, &ErrAuth{err: ErrBadCredentials}
+		}
+		req.ntlm.authenticated = true
+		req.ntlm.login = a.User
+		req.ntlm.result = result
+
+		return result, nil
+	}
+
+	return authorizer.BadAuthResult, &ErrBadRequest{err: ErrBadNTLMMessage}
+}
+
+// ntlmConnAuth authorizes a request without credentials on a connection
+// authenticated by an NTLM handshake.
+func (req *HTTPRequest) ntlmConnAuth() (authorizer.AuthResult, error) {
+	fields := req.Fields
+	fields.Login = req.ntlm.login
+	if err := fields.ParseLogin(); err != nil {
+		return authorizer.BadAuthResult, &ErrAuth{err: err}
+	}
+
+	return req.ntlm.result, nil
+}
+
+func (n *NTLM) domain() string {
+	if n.Domain == "" {
+		return defaultNTLMDomain
+	}
+
+	return n.Domain
+}
+
+func (n *NTLM) computer() string {
+	if n.Computer == "" {
+		return defaultNTLMDomain
+	}
+
+	return n.Computer
+}
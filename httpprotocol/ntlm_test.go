@@ -0,0 +1,201 @@
+package httpprotocol
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf16"
+
+	"github.com/duratarskeyk/go-common-utils/authorizer"
+	"github.com/duratarskeyk/proxymux/auth"
+	"github.com/duratarskeyk/proxymux/corestructs"
+	"github.com/duratarskeyk/proxymux/internal/authmock"
+)
+
+type testNTHashes map[string]string
+
+func (h testNTHashes) NTHash(ctx context.Context, proxyIP, user, domain string) ([]byte, authorizer.AuthResult, error) {
+	password, ok := h[user]
+	if !ok {
+		return nil, authorizer.BadAuthResult, nil
+	}
+
+	return NTHash(password), authorizer.AuthResult{OK: true, PackageID: 1, UserID: 11}, nil
+}
+
+func utf16le(s string) []byte {
+	var b []byte
+	for _, c := range utf16.Encode([]rune(s)) {
+		b = binary.LittleEndian.AppendUint16(b, c)
+	}
+	return b
+}
+
+var ntlmNegotiateMessage = []byte("NTLMSSP\x00\x01\x00\x00\x00\x05\x82\x08\xa2")
+
+// ntlmAuthenticateMessage answers a type 2 message with an NTLMv2 response.
+func ntlmAuthenticateMessage(t *testing.T, challengeMsg []byte, user, domain, password string) []byte {
+	if len(challengeMsg) < 48 || binary.LittleEndian.Uint32(challengeMsg[8:]) != 2 {
+		t.Fatalf("Bad challenge message %x", challengeMsg)
+	}
+	infoLen := int(binary.LittleEndian.Uint16(challengeMsg[40:]))
+	infoOffset := int(binary.LittleEndian.Uint32(challengeMsg[44:]))
+	info := challengeMsg[infoOffset : infoOffset+infoLen]
+
+	blob := append([]byte{1, 1, 0, 0, 0, 0, 0, 0}, make([]byte, 8)...)
+	blob = append(blob, "cnonce!!"...)
+	blob = append(append(append(blob, 0, 0, 0, 0), info...), 0, 0, 0, 0)
+	key := hmac.New(md5.New, NTHash(password))
+	key.Write(utf16le(strings.ToUpper(user) + domain))
+	proof := hmac.New(md5.New, key.Sum(nil))
+	proof.Write(challengeMsg[24:32])
+	proof.Write(blob)
+	nt := append(proof.Sum(nil), blob...)
+
+	payload := [][]byte{nil, nt, utf16le(domain), utf16le(user), nil, nil}
+	msg := make([]byte, 64)
+	copy(msg, "NTLMSSP\x00")
+	msg[8] = 3
+	for i, p := range payload {
+		binary.LittleEndian.PutUint16(msg[12+8*i:], uint16(len(p)))
+		binary.LittleEndian.PutUint16(msg[14+8*i:], uint16(len(p)))
+		binary.LittleEndian.PutUint32(msg[16+8*i:], uint32(len(msg)))
+		msg = append(msg, p...)
+	}
+	binary.LittleEndian.PutUint32(msg[60:], 0xa2088205)
+
+	return msg
+}
+
+func TestNTLMHandshake(t *testing.T) {
+	tests := []struct {
+		scheme   string
+		password string
+		noSource bool
+		err      error
+	}{
+		{"NTLM", "pass", false, nil},
+		{"Negotiate", "pass", false, nil},
+		{"NTLM", "wrong", false, ErrBadCredentials},
+		{"NTLM", "pass", true, auth.ErrBackendUnavailable},
+	}
+	for nr, test := range tests {
+		c1, c2 := net.Pipe()
+		req := GetHTTPRequest()
+		req.FirstByte = 'G'
+		req.NTLM = &NTLM{Source: testNTHashes{"user": "pass"}, Negotiate: true}
+		if test.noSource {
+			req.NTLM.Source = nil
+		}
+		fields := req.Fields
+		fields.UserIP = "4.3.2.1"
+		fields.ProxyIP = "1.2.3.4"
+		fields.Conn = c1
+		fields.ProxyConfig = &authmock.Mock{IPAuthRet: authorizer.BadAuthResult, CredentialsAuthRet: authorizer.BadAuthResult}
+		fields.Timeouts = &corestructs.Timeouts{Handshake: 5 * time.Second}
+		errCh := make(chan error, 1)
+		go func() {
+			errCh <- req.Read()
+		}()
+
+		token := ntlmNegotiateMessage
+		if test.scheme == "Negotiate" {
+			mech, _ := asn1.Marshal(asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 2})
+			inner, _ := asn1.MarshalWithParams(struct {
+				MechTypes []asn1.ObjectIdentifier `asn1:"explicit,tag:0"`
+				MechToken []byte                  `asn1:"explicit,tag:2"`
+			}{[]asn1.ObjectIdentifier{{1, 3, 6, 1, 4, 1, 311, 2, 2, 10}}, token}, "explicit,tag:0")
+			token, _ = asn1.Marshal(asn1.RawValue{Class: asn1.ClassApplication, Tag: 0, IsCompound: true, Bytes: append(mech, inner...)})
+		}
+		// the body of the first request is drained before the second one
+		c2.Write([]byte("ET http://example.org/ HTTP/1.1\r\nHost: example.org\r\nContent-Length: 4\r\nProxy-Authorization: " +
+			test.scheme + " " + base64.StdEncoding.EncodeToString(token) + "\r\n\r\nbody"))
+
+		clientReader := bufio.NewReader(c2)
+		resp, err := http.ReadResponse(clientReader, nil)
+		if err != nil {
+			t.Fatalf("Test #%d: %s", nr+1, err)
+		}
+		challenge := resp.Header.Get("Proxy-Authenticate")
+		if resp.StatusCode != 407 || resp.Close || !strings.HasPrefix(challenge, test.scheme+" ") {
+			t.Fatalf("Test #%d: Expected a keep-alive %s challenge, got %d %q", nr+1, test.scheme, resp.StatusCode, challenge)
+		}
+		challengeMsg, _ := base64.StdEncoding.DecodeString(challenge[len(test.scheme)+1:])
+		if test.scheme == "Negotiate" {
+			var negResp struct {
+				NegState      asn1.Enumerated       `asn1:"explicit,optional,tag:0"`
+				SupportedMech asn1.ObjectIdentifier `asn1:"explicit,optional,tag:1"`
+				ResponseToken []byte                `asn1:"explicit,optional,tag:2"`
+			}
+			if _, err := asn1.UnmarshalWithParams(challengeMsg, &negResp, "explicit,tag:1"); err != nil {
+				t.Fatalf("Test #%d: %s", nr+1, err)
+			}
+			challengeMsg = negResp.ResponseToken
+		}
+
+		authenticate := ntlmAuthenticateMessage(t, challengeMsg, "user", "DOMAIN", test.password)
+		c2.Write([]byte("GET http://example.org/ HTTP/1.1\r\nHost: example.org\r\nProxy-Authorization: NTLM " +
+			base64.StdEncoding.EncodeToString(authenticate) + "\r\n\r\n"))
+		err = <-errCh
+		if !errors.Is(err, test.err) {
+			t.Errorf("Test #%d: Expected %v, got %v", nr+1, test.err, err)
+		} else if err == nil {
+			if fields.Login != "user" || fields.UserID != 11 || fields.PackageID != 1 {
+				t.Errorf("Test #%d: Expected user 11 of package 1, got %s %d %d", nr+1, fields.Login, fields.UserID, fields.PackageID)
+			}
+
+			// the connection stays authenticated
+			go func() {
+				errCh <- req.ReadNext()
+			}()
+			c2.Write([]byte("GET http://example.org/next HTTP/1.1\r\nHost: example.org\r\n\r\n"))
+			if err = <-errCh; err != nil || fields.Login != "user" || fields.UserID != 11 {
+				t.Errorf("Test #%d: Expected next request to be authorized as user 11, got %v, %s %d", nr+1, err, fields.Login, fields.UserID)
+			}
+		}
+		c1.Close()
+		c2.Close()
+		PutHTTPRequest(req)
+	}
+}
+
+func TestNTLMOutOfOrder(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	req := GetHTTPRequest()
+	req.FirstByte = 'C'
+	req.NTLM = &NTLM{Source: testNTHashes{"user": "pass"}}
+	fields := req.Fields
+	fields.UserIP = "4.3.2.1"
+	fields.ProxyIP = "1.2.3.4"
+	fields.Conn = c1
+	fields.ProxyConfig = &authmock.Mock{IPAuthRet: authorizer.BadAuthResult, CredentialsAuthRet: authorizer.BadAuthResult}
+	fields.Timeouts = &corestructs.Timeouts{Handshake: 5 * time.Second}
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- req.Read()
+	}()
+
+	challengeMsg := make([]byte, 48)
+	copy(challengeMsg, "NTLMSSP\x00\x02")
+	authenticate := ntlmAuthenticateMessage(t, challengeMsg, "user", "", "pass")
+	c2.Write([]byte("ONNECT example.org:443 HTTP/1.1\r\nHost: example.org:443\r\nProxy-Authorization: NTLM " +
+		base64.StdEncoding.EncodeToString(authenticate) + "\r\n\r\n"))
+	if err := <-errCh; !errors.Is(err, ErrNTLMHandshake) {
+		t.Errorf("Expected ErrNTLMHandshake, got %v", err)
+	} else if resp := req.ErrorResponse(err); !strings.Contains(resp, "Proxy-Authenticate: NTLM\r\n") || !strings.Contains(resp, basicChallenge) {
+		t.Errorf("Expected NTLM and Basic challenges, got %q", resp)
+	}
+	PutHTTPRequest(req)
+}
@@ -1,10 +1,18 @@
 package authmock
 
-import "github.com/duratarskeyk/go-common-utils/authorizer"
+import (
+	"context"
+
+	"github.com/duratarskeyk/go-common-utils/authorizer"
+)
 
 type Mock struct {
 	IPAuthRet          authorizer.AuthResult
 	CredentialsAuthRet authorizer.AuthResult
+
+	// Username and Password passed to the last CredentialsAuth call
+	Username string
+	Password string
 }
 
 func (m *Mock) IPAuth(proxyIP, userIP string) authorizer.AuthResult {
@@ -12,5 +20,22 @@ func (m *Mock) IPAuth(proxyIP, userIP string) authorizer.AuthResult {
 }
 
 func (m *Mock) CredentialsAuth(proxyIP, username, password string) authorizer.AuthResult {
+	m.Username, m.Password = username, password
 	return m.CredentialsAuthRet
 }
+
+// Backend is a Mock for the context-aware auth.Authorizer interface.
+type Backend struct {
+	IPAuthRet          authorizer.AuthResult
+	IPAuthErr          error
+	CredentialsAuthRet authorizer.AuthResult
+	CredentialsAuthErr error
+}
+
+func (b *Backend) IPAuth(ctx context.Context, proxyIP, userIP string) (authorizer.AuthResult, error) {
+	return b.IPAuthRet, b.IPAuthErr
+}
+
+func (b *Backend) CredentialsAuth(ctx context.Context, proxyIP, username, password string) (authorizer.AuthResult, error) {
+	return b.CredentialsAuthRet, b.CredentialsAuthErr
+}
@@ -0,0 +1,47 @@
+package backconnect
+
+import (
+	"errors"
+	"io"
+	"net"
+)
+
+var ErrBadUserIP = errors.New("bad backconnect user ip")
+
+// Read reads the backconnect data appended to SOCKS requests: package and
+// user IDs as big endian uint32s followed by the 4 byte user IP. An IPv6
+// user IP is sent as 0.0.0.0 followed by its 16 bytes.
+func Read(r io.Reader) (packageID, userID int, userIP string, err error) {
+	data := make([]byte, 12)
+	if _, err = io.ReadFull(r, data); err != nil {
+		return 0, 0, "", err
+	}
+	packageID = int(uint(data[0])<<24 | uint(data[1])<<16 | uint(data[2])<<8 | uint(data[3]))
+	userID = int(uint(data[4])<<24 | uint(data[5])<<16 | uint(data[6])<<8 | uint(data[7]))
+
+	ip := net.IP(data[8:12])
+	if ip.IsUnspecified() {
+		ip = make(net.IP, net.IPv6len)
+		if _, err = io.ReadFull(r, ip); err != nil {
+			return 0, 0, "", err
+		}
+		if ip.IsUnspecified() || ip.To4() != nil {
+			return 0, 0, "", ErrBadUserIP
+		}
+	}
+
+	return packageID, userID, ip.String(), nil
+}
+
+// Append appends the backconnect data in the format Read expects.
+func Append(b []byte, packageID, userID int, userIP net.IP) []byte {
+	b = append(b,
+		byte(packageID>>24), byte(packageID>>16), byte(packageID>>8), byte(packageID),
+		byte(userID>>24), byte(userID>>16), byte(userID>>8), byte(userID),
+	)
+	if ip4 := userIP.To4(); ip4 != nil {
+		return append(b, ip4...)
+	}
+
+	return append(append(b, 0, 0, 0, 0), userIP.To16()...)
+}
@@ -0,0 +1,36 @@
+package backconnect
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestRead(t *testing.T) {
+	tests := []struct {
+		data      []byte
+		packageID int
+		userID    int
+		userIP    string
+		err       error
+	}{
+		{[]byte{0, 0, 0, 2, 0, 0, 1, 22, 5, 5, 5, 5}, 2, 278, "5.5.5.5", nil},
+		{Append(nil, 3, 33, net.ParseIP("2001:db8::1")), 3, 33, "2001:db8::1", nil},
+		{[]byte{0, 0, 0, 2, 0, 0, 1, 22, 5, 5}, 0, 0, "", io.ErrUnexpectedEOF},
+		{[]byte{0, 0, 0, 2, 0, 0, 1, 22, 0, 0, 0, 0, 0x20, 1}, 0, 0, "", io.ErrUnexpectedEOF},
+		{Append(nil, 1, 1, net.IPv6zero), 0, 0, "", ErrBadUserIP},
+		{append([]byte{0, 0, 0, 1, 0, 0, 0, 1, 0, 0, 0, 0}, net.IPv4(1, 2, 3, 4).To16()...), 0, 0, "", ErrBadUserIP},
+	}
+	for nr, test := range tests {
+		packageID, userID, userIP, err := Read(bytes.NewReader(test.data))
+		if !errors.Is(err, test.err) {
+			t.Errorf("Test #%d: Expected error %v, got %v", nr+1, test.err, err)
+			continue
+		}
+		if packageID != test.packageID || userID != test.userID || userIP != test.userIP {
+			t.Errorf("Test #%d: Expected %d, %d, %s, got %d, %d, %s", nr+1, test.packageID, test.userID, test.userIP, packageID, userID, userIP)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package bindlistener
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/duratarskeyk/proxymux/corestructs"
+)
+
+// Listen opens a listener on the egress IP, the local address of DialerTCP
+// when it has one and ProxyIP otherwise, with the socket options of
+// DialerTCP. The returned address has an unspecified IP replaced with the
+// client conn's local IP.
+func Listen(network string, fields *corestructs.Fields) (*net.TCPListener, *net.TCPAddr, error) {
+	var (
+		bindIP net.IP
+		lc     net.ListenConfig
+	)
+	if fields.DialerTCP != nil {
+		lc.Control = fields.DialerTCP.Control
+		if localAddr, ok := fields.DialerTCP.LocalAddr.(*net.TCPAddr); ok {
+			bindIP = localAddr.IP
+		}
+	}
+	if bindIP == nil {
+		bindIP = net.ParseIP(fields.ProxyIP)
+	}
+	l, err := lc.Listen(context.Background(), network, (&net.TCPAddr{IP: bindIP}).String())
+	if err != nil {
+		return nil, nil, err
+	}
+	ln := l.(*net.TCPListener)
+
+	bound := *ln.Addr().(*net.TCPAddr)
+	if bound.IP.IsUnspecified() {
+		if localAddr, ok := fields.Conn.LocalAddr().(*net.TCPAddr); ok {
+			bound.IP = localAddr.IP
+		}
+	}
+
+	return ln, &bound, nil
+}
+
+// Accept waits for one connection from expected, or from anyone if expected
+// is nil or unspecified. Connections from other peers and from peers check
+// denies are closed.
+func Accept(ctx context.Context, ln *net.TCPListener, expected net.IP, timeout time.Duration, check corestructs.AddrChecker) (*net.TCPConn, error) {
+	if timeout > 0 {
+		ln.SetDeadline(time.Now().Add(timeout))
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			ln.SetDeadline(time.Now())
+		case <-done:
+		}
+	}()
+
+	restrict := expected != nil && !expected.IsUnspecified()
+	for {
+		conn, err := ln.AcceptTCP()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			return nil, err
+		}
+		peer := conn.RemoteAddr().(*net.TCPAddr)
+		if restrict && !peer.IP.Equal(expected) {
+			conn.Close()
+			continue
+		}
+		if check != nil && check.CheckAddr(peer.IP, uint16(peer.Port)) != nil {
+			conn.Close()
+			continue
+		}
+
+		return conn, nil
+	}
+}
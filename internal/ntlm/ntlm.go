@@ -0,0 +1,214 @@
+package ntlm
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"encoding/binary"
+	"errors"
+	"strings"
+	"unicode/utf16"
+
+	"golang.org/x/crypto/md4"
+)
+
+var ErrBadMessage = errors.New("malformed ntlm message")
+var ErrNTLMv1 = errors.New("ntlmv1 responses aren't supported")
+
+const (
+	NegotiateMessage    = 1
+	ChallengeMessage    = 2
+	AuthenticateMessage = 3
+)
+
+const (
+	flagUnicode            = 0x00000001
+	flagOEM                = 0x00000002
+	flagRequestTarget      = 0x00000004
+	flagNTLM               = 0x00000200
+	flagAlwaysSign         = 0x00008000
+	flagTargetTypeDomain   = 0x00010000
+	flagExtendedSessionSec = 0x00080000
+	flagTargetInfo         = 0x00800000
+	flag128                = 0x20000000
+	flag56                 = 0x80000000
+)
+
+const (
+	avEOL            = 0
+	avNbComputerName = 1
+	avNbDomainName   = 2
+)
+
+const (
+	negotiateMessageLen    = 16
+	challengeMessageLen    = 48
+	authenticateMessageLen = 64
+
+	// the 16 byte proof followed by a blob of at least 28 bytes
+	ntlmv2ResponseMinLen = 44
+	ntlmv1ResponseLen    = 24
+)
+
+var signature = []byte("NTLMSSP\x00")
+
+// MessageType returns the type of an NTLMSSP message, 0 when msg isn't one.
+func MessageType(msg []byte) uint32 {
+	if len(msg) < 12 || !bytes.Equal(msg[:8], signature) {
+		return 0
+	}
+
+	return binary.LittleEndian.Uint32(msg[8:12])
+}
+
+// Negotiate holds the flags of a type 1 message.
+type Negotiate struct {
+	Flags uint32
+}
+
+func ParseNegotiate(msg []byte) (*Negotiate, error) {
+	if len(msg) < negotiateMessageLen || MessageType(msg) != NegotiateMessage {
+		return nil, ErrBadMessage
+	}
+
+	return &Negotiate{Flags: binary.LittleEndian.Uint32(msg[12:])}, nil
+}
+
+// Challenge builds the type 2 answer to n, naming the server computer in
+// the target info as NTLMv2 clients require.
+func (n *Negotiate) Challenge(challenge [8]byte, domain, computer string) []byte {
+	flags := uint32(flagRequestTarget | flagNTLM | flagAlwaysSign | flagTargetTypeDomain | flagTargetInfo)
+	unicode := n.Flags&flagUnicode != 0
+	if unicode {
+		flags |= flagUnicode
+	} else {
+		flags |= flagOEM
+	}
+	flags |= n.Flags & (flagExtendedSessionSec | flag128 | flag56)
+
+	target := encodeString(domain, unicode)
+	var info []byte
+	info = appendAV(info, avNbDomainName, encodeString(domain, true))
+	info = appendAV(info, avNbComputerName, encodeString(computer, true))
+	info = appendAV(info, avEOL, nil)
+
+	msg := make([]byte, challengeMessageLen, challengeMessageLen+len(target)+len(info))
+	copy(msg, signature)
+	binary.LittleEndian.PutUint32(msg[8:], ChallengeMessage)
+	putField(msg[12:], len(target), challengeMessageLen)
+	binary.LittleEndian.PutUint32(msg[20:], flags)
+	copy(msg[24:32], challenge[:])
+	putField(msg[40:], len(info), challengeMessageLen+len(target))
+	msg = append(msg, target...)
+
+	return append(msg, info...)
+}
+
+// Authenticate holds the fields of a type 3 message needed to verify it.
+type Authenticate struct {
+	User       string
+	Domain     string
+	NTResponse []byte
+}
+
+func ParseAuthenticate(msg []byte) (*Authenticate, error) {
+	if len(msg) < authenticateMessageLen || MessageType(msg) != AuthenticateMessage {
+		return nil, ErrBadMessage
+	}
+	unicode := binary.LittleEndian.Uint32(msg[60:])&flagUnicode != 0
+
+	nt, err := field(msg, 20)
+	if err != nil {
+		return nil, err
+	}
+	domain, err := field(msg, 28)
+	if err != nil {
+		return nil, err
+	}
+	user, err := field(msg, 36)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Authenticate{
+		User:       decodeString(user, unicode),
+		Domain:     decodeString(domain, unicode),
+		NTResponse: nt,
+	}, nil
+}
+
+// VerifyV2 checks the NTLMv2 response of a against the server challenge
+// and the NT hash of the user's password.
+func (a *Authenticate) VerifyV2(challenge [8]byte, ntHash []byte) (bool, error) {
+	if len(a.NTResponse) == ntlmv1ResponseLen {
+		return false, ErrNTLMv1
+	}
+	if len(a.NTResponse) < ntlmv2ResponseMinLen {
+		return false, ErrBadMessage
+	}
+
+	key := hmacMD5(ntHash, encodeString(strings.ToUpper(a.User)+a.Domain, true))
+	proof := hmacMD5(key, challenge[:], a.NTResponse[16:])
+
+	return hmac.Equal(proof, a.NTResponse[:16]), nil
+}
+
+// NTHash returns the MD4 hash of the UTF-16 password.
+func NTHash(password string) []byte {
+	h := md4.New()
+	h.Write(encodeString(password, true))
+	return h.Sum(nil)
+}
+
+func hmacMD5(key []byte, data ...[]byte) []byte {
+	h := hmac.New(md5.New, key)
+	for _, d := range data {
+		h.Write(d)
+	}
+	return h.Sum(nil)
+}
+
+func field(msg []byte, offset int) ([]byte, error) {
+	length := int(binary.LittleEndian.Uint16(msg[offset:]))
+	start := int(binary.LittleEndian.Uint32(msg[offset+4:]))
+	if start > len(msg) || length > len(msg)-start {
+		return nil, ErrBadMessage
+	}
+
+	return msg[start : start+length], nil
+}
+
+func putField(b []byte, length, offset int) {
+	binary.LittleEndian.PutUint16(b, uint16(length))
+	binary.LittleEndian.PutUint16(b[2:], uint16(length))
+	binary.LittleEndian.PutUint32(b[4:], uint32(offset))
+}
+
+func appendAV(b []byte, id uint16, value []byte) []byte {
+	b = binary.LittleEndian.AppendUint16(b, id)
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(value)))
+	return append(b, value...)
+}
+
+func encodeString(s string, unicode bool) []byte {
+	if !unicode {
+		return []byte(s)
+	}
+	u := utf16.Encode([]rune(s))
+	b := make([]byte, 0, 2*len(u))
+	for _, c := range u {
+		b = binary.LittleEndian.AppendUint16(b, c)
+	}
+	return b
+}
+
+func decodeString(b []byte, unicode bool) string {
+	if !unicode {
+		return string(b)
+	}
+	u := make([]uint16, len(b)/2)
+	for i := range u {
+		u[i] = binary.LittleEndian.Uint16(b[2*i:])
+	}
+	return string(utf16.Decode(u))
+}
@@ -0,0 +1,150 @@
+package ntlm
+
+import (
+	"bytes"
+	"encoding/asn1"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"testing"
+)
+
+// authenticateMessage builds a type 3 message with unicode strings.
+func authenticateMessage(user, domain string, nt []byte) []byte {
+	payload := [][]byte{nil, nt, encodeString(domain, true), encodeString(user, true), nil, nil}
+	msg := make([]byte, authenticateMessageLen)
+	copy(msg, signature)
+	binary.LittleEndian.PutUint32(msg[8:], AuthenticateMessage)
+	for i, p := range payload {
+		putField(msg[12+8*i:], len(p), len(msg))
+		msg = append(msg, p...)
+	}
+	binary.LittleEndian.PutUint32(msg[60:], flagUnicode)
+
+	return msg
+}
+
+func TestVerifyV2(t *testing.T) {
+	// MS-NLMP 4.2.4
+	challenge := [8]byte{0x01, 0x23, 0x45, 0x67, 0x89, 0xab, 0xcd, 0xef}
+	var info []byte
+	info = appendAV(info, avNbDomainName, encodeString("Domain", true))
+	info = appendAV(info, avNbComputerName, encodeString("Server", true))
+	info = appendAV(info, avEOL, nil)
+	blob := []byte{1, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+	blob = append(blob, bytes.Repeat([]byte{0xaa}, 8)...)
+	blob = append(blob, 0, 0, 0, 0)
+	blob = append(append(blob, info...), 0, 0, 0, 0)
+	proof, _ := hex.DecodeString("68cd0ab851e51c96aabc927bebef6a1c")
+	nt := append(proof, blob...)
+
+	tests := []struct {
+		user     string
+		password string
+		nt       []byte
+		ok       bool
+		err      error
+	}{
+		{"User", "Password", nt, true, nil},
+		{"user", "Password", nt, true, nil},
+		{"User", "password", nt, false, nil},
+		{"User", "Password", nt[:24], false, ErrNTLMv1},
+		{"User", "Password", nt[:30], false, ErrBadMessage},
+	}
+	for nr, test := range tests {
+		a, err := ParseAuthenticate(authenticateMessage(test.user, "Domain", test.nt))
+		if err != nil {
+			t.Fatalf("Test #%d: %s", nr+1, err)
+		}
+		if a.User != test.user || a.Domain != "Domain" {
+			t.Errorf("Test #%d: Expected %s in Domain, got %s in %s", nr+1, test.user, a.User, a.Domain)
+		}
+		ok, err := a.VerifyV2(challenge, NTHash(test.password))
+		if ok != test.ok || !errors.Is(err, test.err) {
+			t.Errorf("Test #%d: Expected %v, %v, got %v, %v", nr+1, test.ok, test.err, ok, err)
+		}
+	}
+}
+
+func TestParseAuthenticate(t *testing.T) {
+	good := authenticateMessage("user", "domain", make([]byte, 50))
+	outOfBounds := append([]byte{}, good...)
+	binary.LittleEndian.PutUint32(outOfBounds[24:], uint32(len(good)))
+	for nr, msg := range [][]byte{good[:63], outOfBounds, append([]byte("NTLMSSP\x00\x01"), good[9:]...)} {
+		if _, err := ParseAuthenticate(msg); !errors.Is(err, ErrBadMessage) {
+			t.Errorf("Test #%d: Expected ErrBadMessage, got %v", nr+1, err)
+		}
+	}
+}
+
+func TestChallenge(t *testing.T) {
+	negotiate := append(append([]byte{}, signature...), 1, 0, 0, 0, 0x05, 0x82, 0x08, 0xa2)
+	n, err := ParseNegotiate(negotiate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	challenge := [8]byte{1, 2, 3, 4, 5, 6, 7, 8}
+	msg := n.Challenge(challenge, "PROXY", "HOST")
+	if MessageType(msg) != ChallengeMessage {
+		t.Fatalf("Expected a challenge message, got %x", msg)
+	}
+	flags := binary.LittleEndian.Uint32(msg[20:])
+	if flags&flagUnicode == 0 || flags&flagTargetInfo == 0 || flags&flagExtendedSessionSec == 0 {
+		t.Errorf("Bad flags %08x", flags)
+	}
+	if !bytes.Equal(msg[24:32], challenge[:]) {
+		t.Errorf("Expected challenge %x, got %x", challenge, msg[24:32])
+	}
+	target, err := field(msg, 12)
+	if err != nil || decodeString(target, true) != "PROXY" {
+		t.Errorf("Expected target PROXY, got %q, %v", target, err)
+	}
+	info, err := field(msg, 40)
+	if err != nil || !bytes.HasSuffix(info, []byte{0, 0, 0, 0}) || !bytes.Contains(info, encodeString("HOST", true)) {
+		t.Errorf("Bad target info %x, %v", info, err)
+	}
+}
+
+func negTokenInitToken(t *testing.T, init negTokenInit) []byte {
+	mech, err := asn1.Marshal(spnegoOID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inner, err := asn1.MarshalWithParams(init, "explicit,tag:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := asn1.Marshal(asn1.RawValue{Class: asn1.ClassApplication, Tag: 0, IsCompound: true, Bytes: append(mech, inner...)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return token
+}
+
+func TestSPNEGO(t *testing.T) {
+	negotiate := append(append([]byte{}, signature...), 1, 0, 0, 0, 1, 0, 0, 0)
+	kerberosOID := asn1.ObjectIdentifier{1, 2, 840, 113554, 1, 2, 2}
+
+	tests := []struct {
+		token []byte
+		msg   []byte
+		err   error
+	}{
+		{negotiate, negotiate, nil},
+		{negTokenInitToken(t, negTokenInit{MechTypes: []asn1.ObjectIdentifier{ntlmOID}, MechToken: negotiate}), negotiate, nil},
+		{Wrap(negotiate), negotiate, nil},
+		{negTokenInitToken(t, negTokenInit{MechTypes: []asn1.ObjectIdentifier{kerberosOID}}), nil, ErrNoNTLMMech},
+		// the optimistic token is for Kerberos
+		{negTokenInitToken(t, negTokenInit{MechTypes: []asn1.ObjectIdentifier{kerberosOID, ntlmOID}, MechToken: []byte{1}}), nil, ErrNoNTLMMech},
+		{negTokenInitToken(t, negTokenInit{MechTypes: []asn1.ObjectIdentifier{kerberosOID, ntlmOID}}), nil, ErrBadMessage},
+		{[]byte{0x60, 0x01}, nil, ErrBadMessage},
+		{nil, nil, ErrBadMessage},
+	}
+	for nr, test := range tests {
+		msg, err := Unwrap(test.token)
+		if !errors.Is(err, test.err) || !bytes.Equal(msg, test.msg) {
+			t.Errorf("Test #%d: Expected %x, %v, got %x, %v", nr+1, test.msg, test.err, msg, err)
+		}
+	}
+}
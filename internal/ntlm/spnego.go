@@ -0,0 +1,89 @@
+package ntlm
+
+import (
+	"encoding/asn1"
+	"errors"
+)
+
+var ErrNoNTLMMech = errors.New("spnego token doesn't offer ntlm")
+
+var (
+	spnegoOID = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 2}
+	ntlmOID   = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 311, 2, 2, 10}
+)
+
+// accept-incomplete of RFC 4178
+const negStateIncomplete = 1
+
+type negTokenInit struct {
+	MechTypes   []asn1.ObjectIdentifier `asn1:"explicit,tag:0"`
+	ReqFlags    asn1.BitString          `asn1:"explicit,optional,tag:1"`
+	MechToken   []byte                  `asn1:"explicit,optional,tag:2"`
+	MechListMIC []byte                  `asn1:"explicit,optional,tag:3"`
+}
+
+type negTokenResp struct {
+	NegState      asn1.Enumerated       `asn1:"explicit,optional,tag:0"`
+	SupportedMech asn1.ObjectIdentifier `asn1:"explicit,optional,tag:1"`
+	ResponseToken []byte                `asn1:"explicit,optional,tag:2"`
+	MechListMIC   []byte                `asn1:"explicit,optional,tag:3"`
+}
+
+// Unwrap returns the NTLMSSP message of a Negotiate token, which is either
+// the bare message or an SPNEGO NegTokenInit or NegTokenResp carrying it.
+func Unwrap(token []byte) ([]byte, error) {
+	if MessageType(token) != 0 {
+		return token, nil
+	}
+	if len(token) == 0 {
+		return nil, ErrBadMessage
+	}
+
+	switch token[0] {
+	case 0x60:
+		var outer asn1.RawValue
+		if rest, err := asn1.Unmarshal(token, &outer); err != nil || len(rest) != 0 || outer.Class != asn1.ClassApplication {
+			return nil, ErrBadMessage
+		}
+		var mech asn1.ObjectIdentifier
+		rest, err := asn1.Unmarshal(outer.Bytes, &mech)
+		if err != nil || !mech.Equal(spnegoOID) {
+			return nil, ErrBadMessage
+		}
+		var init negTokenInit
+		if _, err = asn1.UnmarshalWithParams(rest, &init, "explicit,tag:0"); err != nil {
+			return nil, ErrBadMessage
+		}
+		offered := false
+		for _, mech := range init.MechTypes {
+			offered = offered || mech.Equal(ntlmOID)
+		}
+		// an optimistic token is for the first mech only
+		if !offered || (len(init.MechToken) != 0 && !init.MechTypes[0].Equal(ntlmOID)) {
+			return nil, ErrNoNTLMMech
+		}
+		if len(init.MechToken) == 0 {
+			return nil, ErrBadMessage
+		}
+		return init.MechToken, nil
+	case 0xa1:
+		var resp negTokenResp
+		if _, err := asn1.UnmarshalWithParams(token, &resp, "explicit,tag:1"); err != nil || len(resp.ResponseToken) == 0 {
+			return nil, ErrBadMessage
+		}
+		return resp.ResponseToken, nil
+	}
+
+	return nil, ErrBadMessage
+}
+
+// Wrap returns the SPNEGO NegTokenResp carrying a challenge message.
+func Wrap(challenge []byte) []byte {
+	b, _ := asn1.MarshalWithParams(negTokenResp{
+		NegState:      negStateIncomplete,
+		SupportedMech: ntlmOID,
+		ResponseToken: challenge,
+	}, "explicit,tag:1")
+
+	return b
+}
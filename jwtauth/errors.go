@@ -0,0 +1,32 @@
+package jwtauth
+
+import (
+	"errors"
+	"fmt"
+)
+
+var ErrMalformedToken = errors.New("malformed jwt")
+var ErrUnsupportedAlg = errors.New("unsupported jwt alg")
+var ErrUnknownKey = errors.New("no key for jwt")
+var ErrBadSignature = errors.New("bad jwt signature")
+var ErrExpired = errors.New("jwt expired")
+var ErrNotYetValid = errors.New("jwt not valid yet")
+var ErrBadIssuer = errors.New("bad jwt issuer")
+var ErrBadAudience = errors.New("bad jwt audience")
+var ErrNoUserID = errors.New("jwt carries no user id")
+var ErrBadKey = errors.New("malformed jwk")
+var ErrWeakKey = errors.New("rsa key shorter than 2048 bits")
+
+type ErrKey struct {
+	Index int
+	Kid   string
+	err   error
+}
+
+func (e *ErrKey) Error() string {
+	return fmt.Sprintf("key #%d %q: %s", e.Index, e.Kid, e.err)
+}
+
+func (e *ErrKey) Unwrap() error {
+	return e.err
+}
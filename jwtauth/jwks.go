@@ -0,0 +1,100 @@
+package jwtauth
+
+import (
+	"crypto/ed25519"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+)
+
+const (
+	AlgHS256 = "HS256"
+	AlgRS256 = "RS256"
+	AlgEdDSA = "EdDSA"
+)
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	K   string `json:"k"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+}
+
+type key struct {
+	kid string
+	alg string
+
+	secret []byte
+	rsa    *rsa.PublicKey
+	ed     ed25519.PublicKey
+}
+
+// parseJWKS reads a JSON Web Key Set. Only signing keys are used: oct
+// keys for HS256, RSA ones for RS256 and Ed25519 OKP ones for EdDSA.
+func parseJWKS(data []byte) ([]*key, error) {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, err
+	}
+
+	keys := make([]*key, 0, len(set.Keys))
+	for i, j := range set.Keys {
+		if j.Use != "" && j.Use != "sig" {
+			continue
+		}
+		k, err := j.key()
+		if err != nil {
+			return nil, &ErrKey{Index: i, Kid: j.Kid, err: err}
+		}
+		keys = append(keys, k)
+	}
+
+	return keys, nil
+}
+
+func (j *jwk) key() (*key, error) {
+	k := &key{kid: j.Kid}
+	switch j.Kty {
+	case "oct":
+		secret, err := base64.RawURLEncoding.DecodeString(j.K)
+		if err != nil || len(secret) < 32 {
+			return nil, ErrBadKey
+		}
+		k.alg, k.secret = AlgHS256, secret
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(j.N)
+		if err != nil || len(n) == 0 {
+			return nil, ErrBadKey
+		}
+		e, err := base64.RawURLEncoding.DecodeString(j.E)
+		if err != nil || len(e) == 0 || len(e) > 4 {
+			return nil, ErrBadKey
+		}
+		pub := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		if pub.N.BitLen() < 2048 {
+			return nil, ErrWeakKey
+		}
+		k.alg, k.rsa = AlgRS256, pub
+	case "OKP":
+		x, err := base64.RawURLEncoding.DecodeString(j.X)
+		if err != nil || j.Crv != "Ed25519" || len(x) != ed25519.PublicKeySize {
+			return nil, ErrBadKey
+		}
+		k.alg, k.ed = AlgEdDSA, ed25519.PublicKey(x)
+	default:
+		return nil, ErrBadKey
+	}
+	if j.Alg != "" && j.Alg != k.alg {
+		return nil, ErrBadKey
+	}
+
+	return k, nil
+}
@@ -0,0 +1,262 @@
+package jwtauth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"os"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/duratarskeyk/go-common-utils/authorizer"
+	"github.com/duratarskeyk/proxymux/auth"
+	"github.com/duratarskeyk/proxymux/loginparams"
+)
+
+type header struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// Claims are the JWT claims Verifier reads. UserID, PackageID and
+// Backconnect make up the auth result, Subject becomes the login and
+// Options its login options.
+type Claims struct {
+	Subject   string   `json:"sub"`
+	Issuer    string   `json:"iss"`
+	Audience  audience `json:"aud"`
+	ExpiresAt float64  `json:"exp"`
+	NotBefore float64  `json:"nbf"`
+
+	UserID      int               `json:"user_id"`
+	PackageID   int               `json:"package_id"`
+	Backconnect bool              `json:"backconnect"`
+	Options     map[string]string `json:"options"`
+}
+
+// audience is a string or a list of them.
+type audience []string
+
+func (a *audience) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		*a = audience{s}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return err
+	}
+	*a = list
+
+	return nil
+}
+
+// Verifier is an auth.TokenVerifier for JWTs signed with HS256, RS256 or
+// EdDSA by the keys of the JWKS file at Path. The token header kid picks the
+// key, tokens without one are tried with every key of their alg. Tokens
+// must expire, Issuer and Audience are checked when set and Leeway is the
+// allowed clock skew.
+type Verifier struct {
+	Path     string
+	Issuer   string
+	Audience string
+	Leeway   time.Duration
+
+	keys atomic.Pointer[[]*key]
+	now  func() time.Time
+}
+
+func Load(path string) (*Verifier, error) {
+	v := &Verifier{Path: path}
+	if err := v.Reload(); err != nil {
+		return nil, err
+	}
+
+	return v, nil
+}
+
+// Reload reads Path again, keeping the current keys when it fails.
+func (v *Verifier) Reload() error {
+	data, err := os.ReadFile(v.Path)
+	if err != nil {
+		return err
+	}
+	keys, err := parseJWKS(data)
+	if err != nil {
+		return err
+	}
+	v.keys.Store(&keys)
+
+	return nil
+}
+
+// IsToken reports whether s looks like a compact JWS, three dot separated
+// segments with a JSON header.
+func (v *Verifier) IsToken(s string) bool {
+	return strings.Count(s, ".") == 2 && strings.HasPrefix(s, "eyJ")
+}
+
+func (v *Verifier) VerifyToken(ctx context.Context, proxyIP, token string) (auth.TokenResult, error) {
+	claims, err := v.Verify(token)
+	if err != nil {
+		return auth.TokenResult{}, err
+	}
+
+	result := auth.TokenResult{
+		AuthResult: authorizer.AuthResult{
+			OK:          true,
+			PackageID:   claims.PackageID,
+			UserID:      claims.UserID,
+			Backconnect: claims.Backconnect,
+		},
+		Login: claims.Subject,
+	}
+	names := make([]string, 0, len(claims.Options))
+	for name := range claims.Options {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		result.Options = append(result.Options, loginparams.Option{Key: name, Value: claims.Options[name]})
+	}
+
+	return result, nil
+}
+
+// Verify checks the signature and claims of token.
+func (v *Verifier) Verify(token string) (*Claims, error) {
+	encodedHeader, rest, _ := strings.Cut(token, ".")
+	encodedClaims, encodedSig, ok := strings.Cut(rest, ".")
+	if !ok || strings.Contains(encodedSig, ".") {
+		return nil, ErrMalformedToken
+	}
+	var h header
+	if err := decodeSegment(encodedHeader, &h); err != nil {
+		return nil, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(encodedSig)
+	if err != nil {
+		return nil, ErrMalformedToken
+	}
+	if h.Alg != AlgHS256 && h.Alg != AlgRS256 && h.Alg != AlgEdDSA {
+		return nil, ErrUnsupportedAlg
+	}
+
+	signed := token[:len(encodedHeader)+1+len(encodedClaims)]
+	if err = v.verifySignature(&h, []byte(signed), sig); err != nil {
+		return nil, err
+	}
+
+	var claims Claims
+	if err = decodeSegment(encodedClaims, &claims); err != nil {
+		return nil, err
+	}
+	if err = v.checkClaims(&claims); err != nil {
+		return nil, err
+	}
+
+	return &claims, nil
+}
+
+func (v *Verifier) verifySignature(h *header, signed, sig []byte) error {
+	keys := v.keys.Load()
+	if keys == nil {
+		return ErrUnknownKey
+	}
+
+	found := false
+	for _, k := range *keys {
+		if k.alg != h.Alg || (h.Kid != "" && k.kid != h.Kid) {
+			continue
+		}
+		found = true
+		if k.verify(signed, sig) {
+			return nil
+		}
+	}
+	if !found {
+		return ErrUnknownKey
+	}
+
+	return ErrBadSignature
+}
+
+func (k *key) verify(signed, sig []byte) bool {
+	switch k.alg {
+	case AlgHS256:
+		mac := hmac.New(sha256.New, k.secret)
+		mac.Write(signed)
+		return hmac.Equal(mac.Sum(nil), sig)
+	case AlgRS256:
+		digest := sha256.Sum256(signed)
+		return rsa.VerifyPKCS1v15(k.rsa, crypto.SHA256, digest[:], sig) == nil
+	case AlgEdDSA:
+		return ed25519.Verify(k.ed, signed, sig)
+	}
+
+	return false
+}
+
+func (v *Verifier) checkClaims(c *Claims) error {
+	now := v.clock()
+	if c.ExpiresAt == 0 || !now.Before(unixTime(c.ExpiresAt).Add(v.Leeway)) {
+		return ErrExpired
+	}
+	if c.NotBefore != 0 && now.Add(v.Leeway).Before(unixTime(c.NotBefore)) {
+		return ErrNotYetValid
+	}
+	if v.Issuer != "" && c.Issuer != v.Issuer {
+		return ErrBadIssuer
+	}
+	if v.Audience != "" {
+		ok := false
+		for _, aud := range c.Audience {
+			ok = ok || aud == v.Audience
+		}
+		if !ok {
+			return ErrBadAudience
+		}
+	}
+	if c.UserID <= 0 {
+		return ErrNoUserID
+	}
+
+	return nil
+}
+
+func (v *Verifier) clock() time.Time {
+	if v.now != nil {
+		return v.now()
+	}
+
+	return time.Now()
+}
+
+func decodeSegment(segment string, dst interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return ErrMalformedToken
+	}
+	if err = json.Unmarshal(data, dst); err != nil {
+		return ErrMalformedToken
+	}
+
+	return nil
+}
+
+func unixTime(seconds float64) time.Time {
+	// far enough in the future without overflowing UnixNano
+	if seconds > 1<<33 {
+		seconds = 1 << 33
+	}
+
+	return time.Unix(0, int64(seconds*float64(time.Second)))
+}
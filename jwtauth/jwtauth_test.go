@@ -0,0 +1,158 @@
+package jwtauth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testKeys struct {
+	secret []byte
+	rsa    *rsa.PrivateKey
+	ed     ed25519.PrivateKey
+}
+
+func newTestKeys(t *testing.T) *testKeys {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &testKeys{secret: []byte("0123456789abcdef0123456789abcdef"), rsa: rsaKey, ed: edKey}
+}
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func (k *testKeys) jwks() string {
+	set := map[string][]map[string]string{"keys": {
+		{"kty": "oct", "kid": "hs", "k": b64(k.secret)},
+		{"kty": "RSA", "kid": "rs", "alg": "RS256", "n": b64(k.rsa.N.Bytes()), "e": b64(big.NewInt(int64(k.rsa.E)).Bytes())},
+		{"kty": "OKP", "kid": "ed", "crv": "Ed25519", "x": b64(k.ed.Public().(ed25519.PublicKey))},
+		{"kty": "RSA", "use": "enc", "n": "AQAB", "e": "AQAB"},
+	}}
+	data, _ := json.Marshal(set)
+	return string(data)
+}
+
+func (k *testKeys) sign(t *testing.T, alg, kid string, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := b64(header) + "." + b64(payload)
+
+	var sig []byte
+	switch alg {
+	case AlgHS256:
+		mac := hmac.New(sha256.New, k.secret)
+		mac.Write([]byte(signed))
+		sig = mac.Sum(nil)
+	case AlgRS256:
+		digest := sha256.Sum256([]byte(signed))
+		var err error
+		if sig, err = rsa.SignPKCS1v15(rand.Reader, k.rsa, crypto.SHA256, digest[:]); err != nil {
+			t.Fatal(err)
+		}
+	case AlgEdDSA:
+		sig = ed25519.Sign(k.ed, []byte(signed))
+	}
+
+	return signed + "." + b64(sig)
+}
+
+func TestVerifier(t *testing.T) {
+	keys := newTestKeys(t)
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(path, []byte(keys.jwks()), 0600); err != nil {
+		t.Fatal(err)
+	}
+	v, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v.Issuer, v.Audience = "issuer", "proxy"
+
+	now := time.Now()
+	claims := func(modify func(c map[string]interface{})) map[string]interface{} {
+		c := map[string]interface{}{
+			"sub": "user", "iss": "issuer", "aud": []string{"api", "proxy"},
+			"exp": now.Add(time.Minute).Unix(), "user_id": 11, "package_id": 1,
+			"options": map[string]string{"session": "abc", "country": "us"},
+		}
+		if modify != nil {
+			modify(c)
+		}
+		return c
+	}
+	otherKeys := &testKeys{secret: []byte("another secret of at least 32 bytes"), ed: keys.ed, rsa: keys.rsa}
+
+	tests := []struct {
+		token string
+		err   error
+	}{
+		{keys.sign(t, AlgHS256, "hs", claims(nil)), nil},
+		{keys.sign(t, AlgRS256, "rs", claims(nil)), nil},
+		{keys.sign(t, AlgEdDSA, "", claims(nil)), nil},
+		{keys.sign(t, AlgHS256, "", claims(func(c map[string]interface{}) { c["aud"] = "proxy" })), nil},
+		{keys.sign(t, AlgHS256, "rs", claims(nil)), ErrUnknownKey},
+		{keys.sign(t, "none", "", claims(nil)), ErrUnsupportedAlg},
+		{otherKeys.sign(t, AlgHS256, "hs", claims(nil)), ErrBadSignature},
+		{keys.sign(t, AlgHS256, "hs", claims(func(c map[string]interface{}) { c["exp"] = now.Add(-time.Minute).Unix() })), ErrExpired},
+		{keys.sign(t, AlgHS256, "hs", claims(func(c map[string]interface{}) { delete(c, "exp") })), ErrExpired},
+		{keys.sign(t, AlgHS256, "hs", claims(func(c map[string]interface{}) { c["exp"] = 1e300 })), nil},
+		{keys.sign(t, AlgHS256, "hs", claims(func(c map[string]interface{}) { c["nbf"] = now.Add(time.Minute).Unix() })), ErrNotYetValid},
+		{keys.sign(t, AlgHS256, "hs", claims(func(c map[string]interface{}) { c["iss"] = "other" })), ErrBadIssuer},
+		{keys.sign(t, AlgHS256, "hs", claims(func(c map[string]interface{}) { c["aud"] = "api" })), ErrBadAudience},
+		{keys.sign(t, AlgHS256, "hs", claims(func(c map[string]interface{}) { delete(c, "user_id") })), ErrNoUserID},
+		{"eyJ.e30.", ErrMalformedToken},
+		{"a.b", ErrMalformedToken},
+	}
+	for nr, test := range tests {
+		result, err := v.VerifyToken(context.Background(), "1.2.3.4", test.token)
+		if !errors.Is(err, test.err) {
+			t.Errorf("Test #%d: Expected %v, got %v", nr+1, test.err, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		session, _ := result.Options.Get("session")
+		if !result.OK || result.UserID != 11 || result.PackageID != 1 || result.Login != "user" || session != "abc" || result.Options[0].Key != "country" {
+			t.Errorf("Test #%d: Unexpected result %+v", nr+1, result)
+		}
+	}
+
+	// a broken file keeps the keys
+	os.WriteFile(path, []byte(`{"keys": [{"kty": "oct", "k": "c2hvcnQ"}]}`), 0600)
+	if err = v.Reload(); !errors.Is(err, ErrBadKey) {
+		t.Errorf("Expected ErrBadKey, got %v", err)
+	}
+	if _, err = v.Verify(tests[0].token); err != nil {
+		t.Errorf("Expected the previous keys to stay, got %s", err)
+	}
+}
+
+func TestIsToken(t *testing.T) {
+	v := &Verifier{}
+	for nr, s := range []string{"eyJhbGciOiJIUzI1NiJ9.e30.sig", "password", "v1.1.2.3.mac", "eyJ.a"} {
+		if v.IsToken(s) != (nr == 0) {
+			t.Errorf("Test #%d: Expected IsToken(%q) to be %v", nr+1, s, nr == 0)
+		}
+	}
+}
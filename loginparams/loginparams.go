@@ -0,0 +1,97 @@
+package loginparams
+
+import (
+	"errors"
+	"strings"
+)
+
+var ErrMissingValue = errors.New("login option without a value")
+var ErrUnknownOption = errors.New("unknown login option")
+var ErrDuplicateOption = errors.New("duplicate login option")
+var ErrEmptyUsername = errors.New("empty username")
+
+type Option struct {
+	Key   string
+	Value string
+}
+
+type Options []Option
+
+func (o Options) Get(key string) (string, bool) {
+	for _, opt := range o {
+		if opt.Key == key {
+			return opt.Value, true
+		}
+	}
+
+	return "", false
+}
+
+// Parser splits logins like user-session-abc123-country-de into the base
+// username and key/value options. The username ends at the first Keys
+// entry found between separators, so usernames may contain the separator
+// as long as no part of them is an option name. Values can't contain the
+// separator.
+type Parser struct {
+	Keys []string
+	// Separator defaults to "-"
+	Separator string
+}
+
+// Parse appends the options found in login to opts and returns the base
+// username. Logins without options are returned as is.
+func (p *Parser) Parse(login string, opts Options) (string, Options, error) {
+	sep := p.Separator
+	if sep == "" {
+		sep = "-"
+	}
+
+	user := login
+	rest := ""
+	for i := 0; ; {
+		j := strings.Index(login[i:], sep)
+		if j == -1 {
+			return login, opts, nil
+		}
+		i += j + len(sep)
+		if p.isKey(login[i:], sep) {
+			user, rest = login[:i-len(sep)], login[i:]
+			break
+		}
+	}
+	if user == "" {
+		return "", opts, ErrEmptyUsername
+	}
+
+	for rest != "" {
+		var key, value string
+		key, rest, _ = strings.Cut(rest, sep)
+		if !p.known(key) {
+			return "", opts, ErrUnknownOption
+		}
+		if value, rest, _ = strings.Cut(rest, sep); value == "" {
+			return "", opts, ErrMissingValue
+		}
+		if _, dup := opts.Get(key); dup {
+			return "", opts, ErrDuplicateOption
+		}
+		opts = append(opts, Option{Key: key, Value: value})
+	}
+
+	return user, opts, nil
+}
+
+func (p *Parser) isKey(s, sep string) bool {
+	key, _, _ := strings.Cut(s, sep)
+	return p.known(key)
+}
+
+func (p *Parser) known(key string) bool {
+	for _, k := range p.Keys {
+		if k == key {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,49 @@
+package loginparams
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	p := &Parser{Keys: []string{"session", "country", "ttl"}}
+	tests := []struct {
+		login string
+		user  string
+		opts  Options
+		err   error
+	}{
+		{"user", "user", nil, nil},
+		{"user-session-abc123-country-de-ttl-10m", "user", Options{{"session", "abc123"}, {"country", "de"}, {"ttl", "10m"}}, nil},
+		{"my-user-country-us", "my-user", Options{{"country", "us"}}, nil},
+		{"my-user", "my-user", nil, nil},
+		{"user-session", "", nil, ErrMissingValue},
+		{"user-session--country-de", "", nil, ErrMissingValue},
+		{"user-session-a-city-x", "", nil, ErrUnknownOption},
+		{"user-session-a-session-b", "", nil, ErrDuplicateOption},
+		{"-session-a", "", nil, ErrEmptyUsername},
+	}
+	for nr, test := range tests {
+		user, opts, err := p.Parse(test.login, nil)
+		if !errors.Is(err, test.err) {
+			t.Errorf("Test #%d: Expected error %v, got %v", nr+1, test.err, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if user != test.user || !reflect.DeepEqual(opts, test.opts) {
+			t.Errorf("Test #%d: Expected %s %v, got %s %v", nr+1, test.user, test.opts, user, opts)
+		}
+	}
+
+	p = &Parser{Keys: []string{"zone"}, Separator: "_"}
+	user, opts, err := p.Parse("my-user_zone_eu", nil)
+	if err != nil || user != "my-user" {
+		t.Fatalf("Expected my-user, got %s, %v", user, err)
+	}
+	if zone, ok := opts.Get("zone"); !ok || zone != "eu" {
+		t.Errorf("Expected zone eu, got %q", zone)
+	}
+}
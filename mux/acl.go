@@ -0,0 +1,48 @@
+package mux
+
+import (
+	"github.com/duratarskeyk/go-common-utils/idlenet"
+	"github.com/duratarskeyk/proxymux/acl"
+	"github.com/duratarskeyk/proxymux/httpprotocol"
+	"github.com/duratarskeyk/proxymux/socks4protocol"
+	"github.com/duratarskeyk/proxymux/socks5protocol"
+)
+
+// Allow checks the destination of any parsed request against l. Denied
+// requests get HTTP 451, SOCKS5 reply 0x02 or a SOCKS4 rejection. l becomes
+// the request's Fields.Destinations so addresses resolved while dialing, UDP
+// datagram targets and BIND peers are checked as well. The destination of
+// UDP ASSOCIATE and BIND requests is not checked, it's a client address or
+// the expected peer.
+func Allow(req interface{}, l *acl.List) error {
+	switch r := req.(type) {
+	case *socks4protocol.Socks4Request:
+		r.Fields.Destinations = l
+		if r.Command == socks4protocol.BindCommand {
+			return nil
+		}
+		if err := l.Check(r.Fields); err != nil {
+			idlenet.WriteWithTimeout(r.Fields.Conn, r.Fields.Timeouts.Write, socks4protocol.ResponseRejected)
+			return err
+		}
+	case *socks5protocol.Socks5Request:
+		r.Fields.Destinations = l
+		if r.Command == socks5protocol.AssociateCommand || r.Command == socks5protocol.BindCommand {
+			return nil
+		}
+		if err := l.Check(r.Fields); err != nil {
+			socks5protocol.SendFailReply(r, socks5protocol.RuleFailure)
+			return err
+		}
+	case *httpprotocol.HTTPRequest:
+		r.Fields.Destinations = l
+		if err := l.Check(r.Fields); err != nil {
+			httpprotocol.WriteHTTPError(r.Fields.Conn, httpprotocol.HTTP451Forbidden, "")
+			return err
+		}
+	default:
+		return ErrUnknownRequest
+	}
+
+	return nil
+}
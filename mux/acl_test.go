@@ -0,0 +1,133 @@
+package mux
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/duratarskeyk/proxymux/acl"
+	"github.com/duratarskeyk/proxymux/corestructs"
+	"github.com/duratarskeyk/proxymux/httpprotocol"
+	"github.com/duratarskeyk/proxymux/socks4protocol"
+	"github.com/duratarskeyk/proxymux/socks5protocol"
+	"github.com/duratarskeyk/proxymux/upstream"
+)
+
+func TestAllow(t *testing.T) {
+	list := &acl.List{}
+	timeouts := &corestructs.Timeouts{Write: time.Second}
+
+	socks5Req := socks5protocol.GetSocks5Request()
+	socks4Req := socks4protocol.GetSocks4Request()
+	httpReq := httpprotocol.GetHTTPRequest()
+	requests := []interface{}{socks5Req, socks4Req, httpReq}
+	fields := []*corestructs.Fields{socks5Req.Fields, socks4Req.Fields, httpReq.Fields}
+	replies := []string{
+		string([]byte{5, socks5protocol.RuleFailure, 0, 1, 0, 0, 0, 0, 0, 0}),
+		string(socks4protocol.ResponseRejected),
+		"HTTP/1.1 451 Unavailable For Legal Reasons\r\n",
+	}
+	for nr, req := range requests {
+		c1, c2 := net.Pipe()
+		f := fields[nr]
+		f.Conn = c1
+		f.Host = "169.254.169.254"
+		f.HostIP = net.IPv4(169, 254, 169, 254)
+		f.Port = "80"
+		f.PortNum = 80
+		f.Timeouts = timeouts
+		errCh := make(chan error)
+		go func(req interface{}) {
+			err := Allow(req, list)
+			c1.Close()
+			errCh <- err
+		}(req)
+		reply, _ := io.ReadAll(c2)
+		if !strings.HasPrefix(string(reply), replies[nr]) {
+			t.Errorf("Test #%d: Expected reply %q, got %q", nr+1, replies[nr], reply)
+		}
+		if err := <-errCh; !errors.Is(err, acl.ErrDenied) {
+			t.Errorf("Test #%d: Expected %s, got %v", nr+1, acl.ErrDenied, err)
+		}
+		c2.Close()
+	}
+
+	socks5Req.Fields.HostIP = net.IPv4(203, 0, 113, 1)
+	if err := Allow(socks5Req, list); err != nil {
+		t.Errorf("Expected public destination to be allowed, got %s", err)
+	}
+	if socks5Req.Fields.Destinations != list {
+		t.Error("Expected Destinations to be the list")
+	}
+
+	// UDP ASSOCIATE and BIND destinations are checked per datagram and peer
+	socks5Req.Fields.Host, socks5Req.Fields.HostIP, socks5Req.Fields.Port, socks5Req.Fields.PortNum = "0.0.0.0", net.IPv4zero, "0", 0
+	for _, command := range []byte{socks5protocol.AssociateCommand, socks5protocol.BindCommand} {
+		socks5Req.Command = command
+		if err := Allow(socks5Req, list); err != nil {
+			t.Errorf("Expected command %d to be allowed, got %s", command, err)
+		}
+	}
+	socks4Req.Command = socks4protocol.BindCommand
+	if err := Allow(socks4Req, list); err != nil {
+		t.Errorf("Expected SOCKS4 BIND to be allowed, got %s", err)
+	}
+}
+
+func TestAllowChain(t *testing.T) {
+	// a parent proxy on loopback answering every CONNECT
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	connects := make(chan string, 2)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			line, _ := bufio.NewReader(conn).ReadString('\n')
+			connects <- line
+			conn.Write([]byte("HTTP/1.1 200 OK\r\n\r\n"))
+			conn.Close()
+		}
+	}()
+	chain := upstream.Chain{{Type: upstream.TypeHTTP, Addr: ln.Addr().String()}}
+
+	hosts := []string{"203.0.113.1", "localhost"}
+	results := []error{nil, acl.ErrDenied}
+	for nr, host := range hosts {
+		req := httpprotocol.GetHTTPRequest()
+		f := req.Fields
+		f.Host, f.HostIP, f.HostType = host, net.ParseIP(host), corestructs.HostTypeHostname
+		if f.HostIP != nil {
+			f.HostType = corestructs.HostTypeIPv4
+		}
+		f.Port, f.PortNum = "80", 80
+		f.Timeouts = &corestructs.Timeouts{Connect: time.Second, Write: time.Second}
+		if err := Allow(req, &acl.List{}); err != nil {
+			t.Fatalf("Test #%d: Expected Allow to pass, got %s", nr+1, err)
+		}
+		conn, err := chain.Dial(context.Background(), f)
+		if !errors.Is(err, results[nr]) {
+			t.Errorf("Test #%d: Expected %v, got %v", nr+1, results[nr], err)
+		}
+		if err == nil {
+			conn.Close()
+			if line := <-connects; !strings.HasPrefix(line, "CONNECT "+host+":80 ") {
+				t.Errorf("Test #%d: Unexpected request %q", nr+1, line)
+			}
+		}
+		httpprotocol.PutHTTPRequest(req)
+	}
+	if len(connects) != 0 {
+		t.Errorf("Expected the denied target not to reach the parent, got %q", <-connects)
+	}
+}
@@ -0,0 +1,28 @@
+package mux
+
+import (
+	"context"
+	"errors"
+	"net"
+
+	"github.com/duratarskeyk/proxymux/httpprotocol"
+	"github.com/duratarskeyk/proxymux/socks4protocol"
+	"github.com/duratarskeyk/proxymux/socks5protocol"
+)
+
+var ErrUnknownRequest = errors.New("unknown request type")
+
+// Dial connects to the target of any parsed request, writing the protocol
+// specific failure reply when the dial fails.
+func Dial(ctx context.Context, req interface{}) (net.Conn, error) {
+	switch r := req.(type) {
+	case *socks4protocol.Socks4Request:
+		return socks4protocol.Dial(ctx, r)
+	case *socks5protocol.Socks5Request:
+		return socks5protocol.Dial(ctx, r)
+	case *httpprotocol.HTTPRequest:
+		return httpprotocol.Dial(ctx, r)
+	}
+
+	return nil, ErrUnknownRequest
+}
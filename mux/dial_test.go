@@ -0,0 +1,69 @@
+package mux
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/duratarskeyk/proxymux/corestructs"
+	"github.com/duratarskeyk/proxymux/httpprotocol"
+	"github.com/duratarskeyk/proxymux/socks4protocol"
+	"github.com/duratarskeyk/proxymux/socks5protocol"
+)
+
+func closedPort(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln.Close()
+
+	return fmt.Sprint(ln.Addr().(*net.TCPAddr).Port)
+}
+
+func TestDialReplies(t *testing.T) {
+	port := closedPort(t)
+	timeouts := &corestructs.Timeouts{Connect: time.Second, Write: time.Second}
+
+	socks5Req := socks5protocol.GetSocks5Request()
+	socks4Req := socks4protocol.GetSocks4Request()
+	httpReq := httpprotocol.GetHTTPRequest()
+	requests := []interface{}{socks5Req, socks4Req, httpReq}
+	fields := []*corestructs.Fields{socks5Req.Fields, socks4Req.Fields, httpReq.Fields}
+	replies := []string{
+		string([]byte{5, socks5protocol.ConnectionRefused, 0, 1, 0, 0, 0, 0, 0, 0}),
+		string(socks4protocol.ResponseRejected),
+		"HTTP/1.1 572 Target Host Connection Failed\r\n",
+	}
+	for nr, req := range requests {
+		c1, c2 := net.Pipe()
+		f := fields[nr]
+		f.Conn = c1
+		f.Host = "127.0.0.1"
+		f.HostIP = net.IPv4(127, 0, 0, 1)
+		f.Port = port
+		f.Timeouts = timeouts
+		errCh := make(chan error)
+		go func(req interface{}) {
+			_, err := Dial(context.Background(), req)
+			c1.Close()
+			errCh <- err
+		}(req)
+		reply, _ := io.ReadAll(c2)
+		if !strings.HasPrefix(string(reply), replies[nr]) {
+			t.Errorf("Test #%d: Expected reply %q, got %q", nr+1, replies[nr], reply)
+		}
+		if err := <-errCh; err == nil {
+			t.Errorf("Test #%d: Expected dial error, got nil", nr+1)
+		}
+		c2.Close()
+	}
+
+	if _, err := Dial(context.Background(), struct{}{}); err != ErrUnknownRequest {
+		t.Errorf("Expected %s, got %v", ErrUnknownRequest, err)
+	}
+}
@@ -5,8 +5,12 @@ import (
 	"net"
 
 	"github.com/duratarskeyk/go-common-utils/idlenet"
+	"github.com/duratarskeyk/proxymux/auth"
+	"github.com/duratarskeyk/proxymux/backconnect"
 	"github.com/duratarskeyk/proxymux/corestructs"
 	"github.com/duratarskeyk/proxymux/httpprotocol"
+	"github.com/duratarskeyk/proxymux/loginparams"
+	"github.com/duratarskeyk/proxymux/resolver"
 	"github.com/duratarskeyk/proxymux/socks4protocol"
 	"github.com/duratarskeyk/proxymux/socks5protocol"
 )
@@ -17,7 +21,27 @@ type Handler struct {
 	HTTPHandler   func(ctx context.Context, req *httpprotocol.HTTPRequest)
 	ExitHandler   func(conn net.Conn)
 
-	Timeouts *corestructs.Timeouts
+	Timeouts    *corestructs.Timeouts
+	IPv6Policy  corestructs.IPv6Policy
+	LoginParser *loginparams.Parser
+	Digest      *httpprotocol.Digest
+	NTLM        *httpprotocol.NTLM
+	AuthRetries int
+
+	// TokenVerifier checks tokens sent as passwords, after the dot of the
+	// SOCKS4 userid, and as HTTP Bearer credentials. auth.TokenVerifiers
+	// combines several kinds.
+	TokenVerifier auth.TokenVerifier
+
+	// Resolver resolves hostname targets, connections to every address
+	// ResolverFamily allows are raced. Without one the dialer resolves
+	// them and tries the addresses in order.
+	Resolver       resolver.Resolver
+	ResolverFamily resolver.Family
+
+	// Backconnect verifies the envelopes of backconnect accounts, the
+	// legacy unsigned format needs Backconnect.Legacy.
+	Backconnect *backconnect.Verifier
 }
 
 func (h Handler) Handle(
@@ -43,6 +67,12 @@ func (h Handler) Handle(
 		fields.DialerTCP = dialerTCP
 		fields.DialerUDP = dialerUDP
 		fields.Timeouts = h.Timeouts
+		fields.IPv6Policy = h.IPv6Policy
+		fields.Resolver = h.Resolver
+		fields.ResolverFamily = int(h.ResolverFamily)
+		fields.LoginParser = h.LoginParser
+		fields.TokenVerifier = h.TokenVerifier
+		fields.BackconnectVerifier = h.Backconnect
 		fields.UserIP = userIP
 		fields.ProxyIP = proxyIP
 		proxyConfig = nil
@@ -56,6 +86,12 @@ func (h Handler) Handle(
 		fields.ProxyConfig = proxyConfig
 		fields.DialerTCP = dialerTCP
 		fields.Timeouts = h.Timeouts
+		fields.IPv6Policy = h.IPv6Policy
+		fields.Resolver = h.Resolver
+		fields.ResolverFamily = int(h.ResolverFamily)
+		fields.LoginParser = h.LoginParser
+		fields.TokenVerifier = h.TokenVerifier
+		fields.BackconnectVerifier = h.Backconnect
 		fields.UserIP = userIP
 		fields.ProxyIP = proxyIP
 		proxyConfig = nil
@@ -65,12 +101,21 @@ func (h Handler) Handle(
 	} else if 'A' <= firstByte && firstByte <= 'Z' {
 		req := httpprotocol.GetHTTPRequest()
 		req.FirstByte = firstByte
+		req.Digest = h.Digest
+		req.NTLM = h.NTLM
+		req.AuthRetries = h.AuthRetries
 
 		fields := req.Fields
 		fields.Conn = conn
 		fields.ProxyConfig = proxyConfig
 		fields.DialerTCP = dialerTCP
 		fields.Timeouts = h.Timeouts
+		fields.IPv6Policy = h.IPv6Policy
+		fields.Resolver = h.Resolver
+		fields.ResolverFamily = int(h.ResolverFamily)
+		fields.LoginParser = h.LoginParser
+		fields.TokenVerifier = h.TokenVerifier
+		fields.BackconnectVerifier = h.Backconnect
 		fields.UserIP = userIP
 		fields.ProxyIP = proxyIP
 		proxyConfig = nil
@@ -0,0 +1,248 @@
+package mux
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/duratarskeyk/proxymux/egress"
+)
+
+var ErrServerClosed = errors.New("mux: server closed")
+
+type Server struct {
+	Addr    string
+	Handler Handler
+
+	DialerTCP   *net.Dialer
+	DialerUDP   *net.Dialer
+	ProxyConfig interface{}
+
+	// Egress, when set, replaces DialerTCP and DialerUDP with dialers bound
+	// to the egress IP of the address each connection was accepted on.
+	Egress *egress.Binder
+
+	// BaseContext is the parent of the context passed to protocol handlers.
+	// It is canceled on Close or when the Shutdown deadline expires.
+	BaseContext context.Context
+
+	inShutdown atomic.Bool
+
+	mu        sync.Mutex
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]struct{}
+	ctx       context.Context
+	cancel    context.CancelFunc
+	wg        sync.WaitGroup
+}
+
+func (s *Server) ListenAndServe() error {
+	if s.inShutdown.Load() {
+		return ErrServerClosed
+	}
+	addr := s.Addr
+	if addr == "" {
+		addr = ":1080"
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	return s.Serve(ln)
+}
+
+func (s *Server) Serve(ln net.Listener) error {
+	if !s.trackListener(ln, true) {
+		ln.Close()
+		return ErrServerClosed
+	}
+	defer s.trackListener(ln, false)
+
+	var backoff time.Duration
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if s.inShutdown.Load() {
+				return ErrServerClosed
+			}
+			if temporary(err) {
+				if backoff == 0 {
+					backoff = 5 * time.Millisecond
+				} else {
+					backoff *= 2
+				}
+				if backoff > time.Second {
+					backoff = time.Second
+				}
+				time.Sleep(backoff)
+				continue
+			}
+			return err
+		}
+		backoff = 0
+
+		if !s.trackConn(conn, true) {
+			conn.Close()
+			return ErrServerClosed
+		}
+		go s.serveConn(conn)
+	}
+}
+
+// temporary reports whether Accept may succeed later, out of file
+// descriptors included.
+func temporary(err error) bool {
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		return true
+	}
+
+	return errors.Is(err, syscall.EMFILE) || errors.Is(err, syscall.ENFILE)
+}
+
+// Shutdown stops accepting new connections and waits for live ones to
+// finish, then cancels the handler context. When ctx expires first, the
+// handler context is canceled, remaining connections are closed and ctx.Err()
+// is returned without waiting for their handlers, Close waits for them.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.inShutdown.Store(true)
+	s.mu.Lock()
+	s.closeListenersLocked()
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		s.mu.Lock()
+		if s.cancel != nil {
+			s.cancel()
+		}
+		s.mu.Unlock()
+		return nil
+	case <-ctx.Done():
+		s.closeConns()
+		return ctx.Err()
+	}
+}
+
+func (s *Server) Close() error {
+	s.inShutdown.Store(true)
+	s.mu.Lock()
+	err := s.closeListenersLocked()
+	s.mu.Unlock()
+	s.closeConns()
+	s.wg.Wait()
+
+	return err
+}
+
+func (s *Server) serveConn(conn net.Conn) {
+	defer s.wg.Done()
+	defer s.trackConn(conn, false)
+
+	h := s.Handler
+	if h.ExitHandler == nil {
+		h.ExitHandler = closeConn
+	}
+	proxyIP := addrIP(conn.LocalAddr())
+	dialerTCP, dialerUDP := s.DialerTCP, s.DialerUDP
+	if s.Egress != nil {
+		dialerTCP, dialerUDP = s.Egress.TCP(proxyIP), s.Egress.UDP(proxyIP)
+	}
+	h.Handle(s.ctx, conn, dialerTCP, dialerUDP, s.ProxyConfig, proxyIP, addrIP(conn.RemoteAddr()))
+}
+
+func (s *Server) trackListener(ln net.Listener, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if add {
+		if s.inShutdown.Load() {
+			return false
+		}
+		if s.listeners == nil {
+			s.listeners = make(map[net.Listener]struct{})
+		}
+		s.listeners[ln] = struct{}{}
+	} else {
+		delete(s.listeners, ln)
+	}
+
+	return true
+}
+
+func (s *Server) trackConn(conn net.Conn, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if add {
+		if s.inShutdown.Load() {
+			return false
+		}
+		if s.conns == nil {
+			s.conns = make(map[net.Conn]struct{})
+		}
+		if s.ctx == nil {
+			base := s.BaseContext
+			if base == nil {
+				base = context.Background()
+			}
+			s.ctx, s.cancel = context.WithCancel(base)
+		}
+		s.conns[conn] = struct{}{}
+		s.wg.Add(1)
+	} else {
+		delete(s.conns, conn)
+	}
+
+	return true
+}
+
+func (s *Server) closeListenersLocked() error {
+	var err error
+	for ln := range s.listeners {
+		if cerr := ln.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+
+	return err
+}
+
+func (s *Server) closeConns() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cancel != nil {
+		s.cancel()
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+}
+
+func closeConn(conn net.Conn) {
+	conn.Close()
+}
+
+func addrIP(addr net.Addr) string {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP.String()
+	case *net.UDPAddr:
+		return a.IP.String()
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+
+	return host
+}
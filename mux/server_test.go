@@ -0,0 +1,251 @@
+package mux
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/duratarskeyk/proxymux/corestructs"
+	"github.com/duratarskeyk/proxymux/httpprotocol"
+	"github.com/duratarskeyk/proxymux/socks4protocol"
+	"github.com/duratarskeyk/proxymux/socks5protocol"
+)
+
+type serverHandlers struct {
+	mu      sync.Mutex
+	exits   map[net.Conn]int
+	started chan struct{}
+}
+
+func (h *serverHandlers) socks5(ctx context.Context, req *socks5protocol.Socks5Request) {
+	h.started <- struct{}{}
+	<-ctx.Done()
+}
+
+func (h *serverHandlers) exit(c net.Conn) {
+	h.mu.Lock()
+	h.exits[c]++
+	h.mu.Unlock()
+	c.Close()
+}
+
+func newTestServer(h *serverHandlers) *Server {
+	return &Server{
+		Handler: Handler{
+			SOCKS4Handler: func(ctx context.Context, req *socks4protocol.Socks4Request) {},
+			SOCKS5Handler: h.socks5,
+			HTTPHandler:   func(ctx context.Context, req *httpprotocol.HTTPRequest) {},
+			ExitHandler:   h.exit,
+			Timeouts:      &corestructs.Timeouts{Handshake: 5 * time.Second},
+		},
+	}
+}
+
+func TestServerShutdown(t *testing.T) {
+	h := &serverHandlers{exits: make(map[net.Conn]int), started: make(chan struct{})}
+	srv := newTestServer(h)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serveErr := make(chan error)
+	go func() {
+		serveErr <- srv.Serve(ln)
+	}()
+
+	clients := make([]net.Conn, 3)
+	for i := range clients {
+		clients[i], err = net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		clients[i].Write([]byte{5})
+		<-h.started
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := srv.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected Shutdown to return %s, got %v", context.DeadlineExceeded, err)
+	}
+	if err := <-serveErr; err != ErrServerClosed {
+		t.Errorf("Expected Serve to return %s, got %v", ErrServerClosed, err)
+	}
+	// handlers finish in the background
+	srv.Close()
+	if len(h.exits) != len(clients) {
+		t.Errorf("Expected ExitHandler to be called for %d conns, got %d", len(clients), len(h.exits))
+	}
+	for _, n := range h.exits {
+		if n != 1 {
+			t.Errorf("Expected ExitHandler to be called once per conn, got %d", n)
+		}
+	}
+	if _, err := net.Dial("tcp", ln.Addr().String()); err == nil {
+		t.Error("Expected listener to be closed after Shutdown")
+	}
+	if err := srv.Serve(ln); err != ErrServerClosed {
+		t.Errorf("Expected Serve after Shutdown to return %s, got %v", ErrServerClosed, err)
+	}
+	for _, c := range clients {
+		c.Close()
+	}
+}
+
+func TestServerShutdownDrains(t *testing.T) {
+	h := &serverHandlers{exits: make(map[net.Conn]int), started: make(chan struct{})}
+	srv := newTestServer(h)
+	release := make(chan struct{})
+	var handlerCtx context.Context
+	srv.Handler.SOCKS5Handler = func(ctx context.Context, req *socks5protocol.Socks5Request) {
+		handlerCtx = ctx
+		h.started <- struct{}{}
+		<-release
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(ln)
+
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.Write([]byte{5})
+	<-h.started
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		close(release)
+	}()
+	if err := srv.Shutdown(context.Background()); err != nil {
+		t.Errorf("Expected Shutdown to return nil, got %s", err)
+	}
+	if len(h.exits) != 1 {
+		t.Errorf("Expected ExitHandler to be called once, got %d", len(h.exits))
+	}
+	if handlerCtx.Err() == nil {
+		t.Error("Expected the handler context to be canceled after Shutdown")
+	}
+}
+
+func TestServerShutdownStuck(t *testing.T) {
+	h := &serverHandlers{exits: make(map[net.Conn]int), started: make(chan struct{})}
+	srv := newTestServer(h)
+	release := make(chan struct{})
+	srv.Handler.SOCKS5Handler = func(ctx context.Context, req *socks5protocol.Socks5Request) {
+		h.started <- struct{}{}
+		// ignores both the context and the closed conn
+		<-release
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(ln)
+
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.Write([]byte{5})
+	<-h.started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	shutdownErr := make(chan error, 1)
+	go func() {
+		shutdownErr <- srv.Shutdown(ctx)
+	}()
+	select {
+	case err := <-shutdownErr:
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("Expected Shutdown to return %s, got %v", context.DeadlineExceeded, err)
+		}
+	case <-time.After(time.Second):
+		t.Error("Shutdown waited for a handler past its deadline")
+	}
+	close(release)
+	srv.Close()
+	if len(h.exits) != 1 {
+		t.Errorf("Expected ExitHandler to be called once, got %d", len(h.exits))
+	}
+}
+
+type fdLimitListener struct {
+	net.Listener
+	failures int
+}
+
+func (ln *fdLimitListener) Accept() (net.Conn, error) {
+	if ln.failures > 0 {
+		ln.failures--
+		return nil, &net.OpError{Op: "accept", Net: "tcp", Err: os.NewSyscallError("accept", syscall.EMFILE)}
+	}
+	return ln.Listener.Accept()
+}
+
+func TestServerAcceptEMFILE(t *testing.T) {
+	h := &serverHandlers{exits: make(map[net.Conn]int), started: make(chan struct{})}
+	srv := newTestServer(h)
+	tcpLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- srv.Serve(&fdLimitListener{Listener: tcpLn, failures: 3})
+	}()
+
+	c, err := net.Dial("tcp", tcpLn.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.Write([]byte{5})
+	select {
+	case <-h.started:
+	case err := <-serveErr:
+		t.Fatalf("Expected Serve to keep accepting, got %v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Connection wasn't served")
+	}
+	srv.Close()
+}
+
+func TestServerClose(t *testing.T) {
+	h := &serverHandlers{exits: make(map[net.Conn]int), started: make(chan struct{})}
+	srv := newTestServer(h)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serveErr := make(chan error)
+	go func() {
+		serveErr <- srv.Serve(ln)
+	}()
+
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.Write([]byte{5})
+	<-h.started
+
+	srv.Close()
+	if err := <-serveErr; err != ErrServerClosed {
+		t.Errorf("Expected Serve to return %s, got %v", ErrServerClosed, err)
+	}
+	if len(h.exits) != 1 {
+		t.Errorf("Expected ExitHandler to be called once, got %d", len(h.exits))
+	}
+}
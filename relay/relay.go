@@ -0,0 +1,165 @@
+package relay
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/duratarskeyk/proxymux/corestructs"
+)
+
+const bufferSize = 32 * 1024
+
+var bufferPool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, bufferSize)
+		return &b
+	},
+}
+
+type closeWriter interface {
+	CloseWrite() error
+}
+
+type tunnel struct {
+	timeouts     *corestructs.Timeouts
+	lastActivity atomic.Int64
+	aborted      atomic.Bool
+	// ended is set when one direction finished on a conn that can't be
+	// half-closed and the tunnel was aborted to end the other one
+	ended atomic.Bool
+}
+
+var nilTime time.Time
+
+// Tunnel pumps bytes between fields.Conn and target until both directions
+// are finished, ctx is canceled or the tunnel stays idle longer than
+// Timeouts.Read. Bytes sent to target are added to fields.Upload, bytes sent
+// to the client are added to fields.Download. Neither conn is closed. When
+// one direction finishes and the other conn can't be half-closed, the
+// tunnel ends unless Timeouts.Read will time the other direction out.
+//
+// On Linux a non-zero Timeouts.Splice enables splice(2) between plain TCP
+// conns, using it as the chunk size. Other conns are copied in userspace.
+func Tunnel(ctx context.Context, fields *corestructs.Fields, target net.Conn) error {
+	t := &tunnel{timeouts: fields.Timeouts}
+	t.touch()
+
+	stop := make(chan struct{})
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		select {
+		case <-ctx.Done():
+			t.abort(fields.Conn, target)
+		case <-stop:
+		}
+	}()
+
+	errCh := make(chan error, 2)
+	go func() {
+		errCh <- t.pump(target, fields.Conn, &fields.Upload)
+	}()
+	go func() {
+		errCh <- t.pump(fields.Conn, target, &fields.Download)
+	}()
+	var err error
+	for i := 0; i < 2; i++ {
+		if pumpErr := <-errCh; pumpErr != nil && err == nil {
+			err = pumpErr
+			// the other direction won't be able to finish on its own
+			t.abort(fields.Conn, target)
+		}
+	}
+	close(stop)
+	<-exited
+	fields.Conn.SetDeadline(nilTime)
+	target.SetDeadline(nilTime)
+
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+	return err
+}
+
+func (t *tunnel) abort(conns ...net.Conn) {
+	t.aborted.Store(true)
+	now := time.Now()
+	for _, c := range conns {
+		c.SetDeadline(now)
+	}
+}
+
+func (t *tunnel) touch() {
+	t.lastActivity.Store(time.Now().UnixNano())
+}
+
+func (t *tunnel) idle() bool {
+	return time.Since(time.Unix(0, t.lastActivity.Load())) >= t.timeouts.Read
+}
+
+func (t *tunnel) pump(dst, src net.Conn, counter *int64) error {
+	if t.timeouts.Splice > 0 {
+		if handled, err := t.splice(dst, src, counter); handled {
+			return err
+		}
+	}
+
+	bufPtr := bufferPool.Get().(*[]byte)
+	defer bufferPool.Put(bufPtr)
+	buf := *bufPtr
+
+	for {
+		if t.timeouts.Read > 0 {
+			src.SetReadDeadline(time.Now().Add(t.timeouts.Read))
+		}
+		n, err := src.Read(buf)
+		if n > 0 {
+			t.touch()
+			if werr := t.write(dst, buf[:n], counter); werr != nil {
+				return werr
+			}
+		}
+		if err != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) && !t.aborted.Load() && !t.idle() {
+				// the other direction is still moving data
+				continue
+			}
+			if errors.Is(err, os.ErrDeadlineExceeded) && t.ended.Load() {
+				return nil
+			}
+			if err == io.EOF {
+				if cw, ok := dst.(closeWriter); ok {
+					cw.CloseWrite()
+				} else if t.timeouts.Read == 0 {
+					// nothing would ever end the other direction
+					t.ended.Store(true)
+					t.abort(dst, src)
+				}
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+func (t *tunnel) write(dst net.Conn, p []byte, counter *int64) error {
+	if t.timeouts.Write > 0 {
+		dst.SetWriteDeadline(time.Now().Add(t.timeouts.Write))
+	}
+	n, err := dst.Write(p)
+	atomic.AddInt64(counter, int64(n))
+	if err == nil && n != len(p) {
+		err = io.ErrShortWrite
+	}
+	if n > 0 {
+		t.touch()
+	}
+
+	return err
+}
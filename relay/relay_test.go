@@ -0,0 +1,178 @@
+package relay
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/duratarskeyk/proxymux/corestructs"
+)
+
+func tcpPair(t *testing.T) (net.Conn, net.Conn) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	acceptCh := make(chan net.Conn)
+	go func() {
+		c, _ := ln.Accept()
+		acceptCh <- c
+	}()
+	c1, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return c1, <-acceptCh
+}
+
+func TestTunnelCounts(t *testing.T) {
+	client, clientSide := tcpPair(t)
+	target, targetSide := tcpPair(t)
+	defer client.Close()
+	defer clientSide.Close()
+	defer target.Close()
+	defer targetSide.Close()
+
+	fields := &corestructs.Fields{
+		Conn:     clientSide,
+		Timeouts: &corestructs.Timeouts{Read: 5 * time.Second, Write: 5 * time.Second},
+		Upload:   10,
+		Download: 20,
+	}
+	errCh := make(chan error)
+	go func() {
+		errCh <- Tunnel(context.Background(), fields, target)
+	}()
+
+	upload := bytes.Repeat([]byte{'u'}, 100000)
+	download := bytes.Repeat([]byte{'d'}, 70000)
+	go func() {
+		client.Write(upload)
+		client.(*net.TCPConn).CloseWrite()
+	}()
+	got, _ := io.ReadAll(targetSide)
+	if !bytes.Equal(got, upload) {
+		t.Errorf("Expected target to receive %d bytes, got %d", len(upload), len(got))
+	}
+	// half-closed tunnel must still carry the other direction
+	targetSide.Write(download)
+	targetSide.Close()
+	got, _ = io.ReadAll(client)
+	if !bytes.Equal(got, download) {
+		t.Errorf("Expected client to receive %d bytes, got %d", len(download), len(got))
+	}
+
+	if err := <-errCh; err != nil {
+		t.Errorf("Expected nil error, got %s", err)
+	}
+	if fields.Upload != int64(len(upload))+10 {
+		t.Errorf("Expected Upload to be %d, got %d", len(upload)+10, fields.Upload)
+	}
+	if fields.Download != int64(len(download))+20 {
+		t.Errorf("Expected Download to be %d, got %d", len(download)+20, fields.Download)
+	}
+}
+
+func TestTunnelIdleTimeout(t *testing.T) {
+	client, clientSide := tcpPair(t)
+	target, targetSide := tcpPair(t)
+	defer client.Close()
+	defer clientSide.Close()
+	defer target.Close()
+	defer targetSide.Close()
+
+	fields := &corestructs.Fields{
+		Conn:     clientSide,
+		Timeouts: &corestructs.Timeouts{Read: 200 * time.Millisecond, Write: time.Second},
+	}
+	errCh := make(chan error)
+	go func() {
+		errCh <- Tunnel(context.Background(), fields, target)
+	}()
+
+	// one-directional traffic keeps the whole tunnel alive
+	go io.Copy(io.Discard, client)
+	for i := 0; i < 5; i++ {
+		targetSide.Write([]byte("ping"))
+		time.Sleep(100 * time.Millisecond)
+	}
+	select {
+	case err := <-errCh:
+		t.Fatalf("Tunnel exited while active: %v", err)
+	default:
+	}
+
+	start := time.Now()
+	err := <-errCh
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("Expected %s, got %v", os.ErrDeadlineExceeded, err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Idle tunnel took %s to time out", elapsed)
+	}
+	if fields.Download != 20 {
+		t.Errorf("Expected Download to be 20, got %d", fields.Download)
+	}
+}
+
+func TestTunnelContextCancel(t *testing.T) {
+	client, clientSide := tcpPair(t)
+	target, targetSide := tcpPair(t)
+	defer client.Close()
+	defer clientSide.Close()
+	defer target.Close()
+	defer targetSide.Close()
+
+	fields := &corestructs.Fields{
+		Conn:     clientSide,
+		Timeouts: &corestructs.Timeouts{},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error)
+	go func() {
+		errCh <- Tunnel(ctx, fields, target)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	if err := <-errCh; err != context.Canceled {
+		t.Errorf("Expected %s, got %v", context.Canceled, err)
+	}
+}
+
+func TestTunnelNoHalfClose(t *testing.T) {
+	client, clientSide := net.Pipe()
+	target, targetSide := net.Pipe()
+	defer clientSide.Close()
+	defer targetSide.Close()
+
+	fields := &corestructs.Fields{
+		Conn:     clientSide,
+		Timeouts: &corestructs.Timeouts{},
+	}
+	errCh := make(chan error)
+	go func() {
+		errCh <- Tunnel(context.Background(), fields, target)
+	}()
+	go io.Copy(io.Discard, targetSide)
+	client.Write([]byte("request"))
+	client.Close()
+
+	select {
+	case err := <-errCh:
+		if err != nil {
+			t.Errorf("Expected nil error, got %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Tunnel didn't end after EOF on a conn without CloseWrite")
+	}
+	if fields.Upload != 7 {
+		t.Errorf("Expected Upload to be 7, got %d", fields.Upload)
+	}
+}
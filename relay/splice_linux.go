@@ -0,0 +1,122 @@
+package relay
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const (
+	spliceMove     = 0x1
+	spliceNonblock = 0x2
+
+	fcntlSetPipeSize = 1031
+)
+
+// splice moves data from src to dst through a pipe without copying it to
+// userspace. It reports false when the conns can't be spliced, in which case
+// nothing has been read from src.
+func (t *tunnel) splice(dst, src net.Conn, counter *int64) (bool, error) {
+	srcTCP, ok := src.(*net.TCPConn)
+	if !ok {
+		return false, nil
+	}
+	dstTCP, ok := dst.(*net.TCPConn)
+	if !ok {
+		return false, nil
+	}
+	rc, err := srcTCP.SyscallConn()
+	if err != nil {
+		return false, nil
+	}
+	wc, err := dstTCP.SyscallConn()
+	if err != nil {
+		return false, nil
+	}
+
+	var p [2]int
+	if err := syscall.Pipe2(p[:], syscall.O_CLOEXEC|syscall.O_NONBLOCK); err != nil {
+		return false, nil
+	}
+	pr, pw := p[0], p[1]
+	defer syscall.Close(pr)
+	defer syscall.Close(pw)
+
+	chunk := int(t.timeouts.Splice)
+	syscall.Syscall(syscall.SYS_FCNTL, uintptr(pw), fcntlSetPipeSize, uintptr(chunk))
+
+	first := true
+	for {
+		if t.timeouts.Read > 0 {
+			src.SetReadDeadline(time.Now().Add(t.timeouts.Read))
+		}
+		var (
+			n    int64
+			serr error
+		)
+		err = rc.Read(func(fd uintptr) bool {
+			n, serr = syscall.Splice(int(fd), nil, pw, nil, chunk, spliceMove|spliceNonblock)
+			return serr != syscall.EAGAIN
+		})
+		if err == nil {
+			err = serr
+		}
+		if err != nil {
+			if first && (errors.Is(err, syscall.EINVAL) || errors.Is(err, syscall.ENOSYS)) {
+				return false, nil
+			}
+			if errors.Is(err, os.ErrDeadlineExceeded) && !t.aborted.Load() && !t.idle() {
+				continue
+			}
+			return true, err
+		}
+		first = false
+		if n == 0 {
+			if cw, ok := dst.(closeWriter); ok {
+				cw.CloseWrite()
+			}
+			return true, nil
+		}
+		t.touch()
+
+		if err := t.drain(dst, wc, pr, n, counter); err != nil {
+			return true, err
+		}
+	}
+}
+
+func (t *tunnel) drain(dst net.Conn, wc syscall.RawConn, pr int, n int64, counter *int64) error {
+	if t.timeouts.Write > 0 {
+		dst.SetWriteDeadline(time.Now().Add(t.timeouts.Write))
+	}
+	for n > 0 {
+		var (
+			m    int64
+			serr error
+		)
+		err := wc.Write(func(fd uintptr) bool {
+			m, serr = syscall.Splice(pr, nil, int(fd), nil, int(n), spliceMove|spliceNonblock)
+			return serr != syscall.EAGAIN
+		})
+		if err == nil {
+			err = serr
+		}
+		if m > 0 {
+			atomic.AddInt64(counter, m)
+			n -= m
+			t.touch()
+		}
+		if err != nil {
+			return err
+		}
+		if m == 0 {
+			return io.ErrShortWrite
+		}
+	}
+
+	return nil
+}
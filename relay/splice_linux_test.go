@@ -0,0 +1,81 @@
+package relay
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/duratarskeyk/proxymux/corestructs"
+)
+
+func TestSpliceTunnel(t *testing.T) {
+	client, clientSide := tcpPair(t)
+	target, targetSide := tcpPair(t)
+	defer client.Close()
+	defer clientSide.Close()
+	defer target.Close()
+	defer targetSide.Close()
+
+	fields := &corestructs.Fields{
+		Conn:     clientSide,
+		Timeouts: &corestructs.Timeouts{Read: 5 * time.Second, Write: 5 * time.Second, Splice: 16384},
+	}
+	errCh := make(chan error)
+	go func() {
+		errCh <- Tunnel(context.Background(), fields, target)
+	}()
+
+	upload := bytes.Repeat([]byte("upload"), 200000)
+	download := bytes.Repeat([]byte("download"), 100000)
+	go func() {
+		client.Write(upload)
+		client.(*net.TCPConn).CloseWrite()
+	}()
+	go func() {
+		targetSide.Write(download)
+		targetSide.(*net.TCPConn).CloseWrite()
+	}()
+	gotUpload := make(chan []byte)
+	go func() {
+		b, _ := io.ReadAll(targetSide)
+		gotUpload <- b
+	}()
+	gotDownload, _ := io.ReadAll(client)
+	if b := <-gotUpload; !bytes.Equal(b, upload) {
+		t.Errorf("Expected target to receive %d bytes, got %d", len(upload), len(b))
+	}
+	if !bytes.Equal(gotDownload, download) {
+		t.Errorf("Expected client to receive %d bytes, got %d", len(download), len(gotDownload))
+	}
+
+	if err := <-errCh; err != nil {
+		t.Errorf("Expected nil error, got %s", err)
+	}
+	if fields.Upload != int64(len(upload)) {
+		t.Errorf("Expected Upload to be %d, got %d", len(upload), fields.Upload)
+	}
+	if fields.Download != int64(len(download)) {
+		t.Errorf("Expected Download to be %d, got %d", len(download), fields.Download)
+	}
+}
+
+func TestSpliceFallback(t *testing.T) {
+	tn := &tunnel{timeouts: &corestructs.Timeouts{Splice: 4096}}
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	target, targetSide := tcpPair(t)
+	defer target.Close()
+	defer targetSide.Close()
+
+	var counter int64
+	if handled, _ := tn.splice(target, c1, &counter); handled {
+		t.Error("Expected splice to refuse non-TCP source")
+	}
+	if handled, _ := tn.splice(c1, target, &counter); handled {
+		t.Error("Expected splice to refuse non-TCP destination")
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package relay
+
+import "net"
+
+func (t *tunnel) splice(dst, src net.Conn, counter *int64) (bool, error) {
+	return false, nil
+}
@@ -0,0 +1,90 @@
+package resolver
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+type cacheEntry struct {
+	ips     []net.IP
+	err     error
+	expires time.Time
+}
+
+// Cache is an in-process TTL cache in front of another resolver. Failed
+// lookups are cached for NegativeTTL, zero disables negative caching.
+type Cache struct {
+	Upstream    Resolver
+	TTL         time.Duration
+	NegativeTTL time.Duration
+	MaxEntries  int
+
+	mu      sync.Mutex
+	entries map[string]*cacheEntry
+}
+
+func NewCache(upstream Resolver, ttl, negativeTTL time.Duration, maxEntries int) *Cache {
+	return &Cache{
+		Upstream:    upstream,
+		TTL:         ttl,
+		NegativeTTL: negativeTTL,
+		MaxEntries:  maxEntries,
+		entries:     make(map[string]*cacheEntry),
+	}
+}
+
+func (c *Cache) LookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	now := time.Now()
+	c.mu.Lock()
+	entry, ok := c.entries[host]
+	c.mu.Unlock()
+	if ok && now.Before(entry.expires) {
+		return entry.ips, entry.err
+	}
+
+	ips, err := c.Upstream.LookupIP(ctx, host)
+	ttl := c.TTL
+	if err != nil {
+		if ctx.Err() != nil {
+			// the caller gave up, the name itself may be fine
+			return nil, err
+		}
+		ttl = c.NegativeTTL
+	}
+	if ttl > 0 {
+		c.store(host, &cacheEntry{ips: ips, err: err, expires: now.Add(ttl)})
+	}
+
+	return ips, err
+}
+
+func (c *Cache) Flush() {
+	c.mu.Lock()
+	c.entries = make(map[string]*cacheEntry)
+	c.mu.Unlock()
+}
+
+func (c *Cache) store(host string, entry *cacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.entries == nil {
+		c.entries = make(map[string]*cacheEntry)
+	}
+	if c.MaxEntries > 0 && len(c.entries) >= c.MaxEntries {
+		now := time.Now()
+		for k, v := range c.entries {
+			if now.After(v.expires) {
+				delete(c.entries, k)
+			}
+		}
+		for k := range c.entries {
+			if len(c.entries) < c.MaxEntries {
+				break
+			}
+			delete(c.entries, k)
+		}
+	}
+	c.entries[host] = entry
+}
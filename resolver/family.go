@@ -0,0 +1,42 @@
+package resolver
+
+import "net"
+
+type Family int
+
+const (
+	FamilyAny Family = iota
+	FamilyIPv4Only
+	FamilyIPv6Only
+	FamilyPreferIPv4
+	FamilyPreferIPv6
+)
+
+// Select filters and orders ips according to the family policy. The
+// relative order of addresses within a family is kept.
+func (f Family) Select(ips []net.IP) []net.IP {
+	if f == FamilyAny {
+		return ips
+	}
+
+	v4 := make([]net.IP, 0, len(ips))
+	v6 := make([]net.IP, 0, len(ips))
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			v4 = append(v4, ip)
+		} else {
+			v6 = append(v6, ip)
+		}
+	}
+
+	switch f {
+	case FamilyIPv4Only:
+		return v4
+	case FamilyIPv6Only:
+		return v6
+	case FamilyPreferIPv6:
+		return append(v6, v4...)
+	}
+
+	return append(v4, v6...)
+}
@@ -0,0 +1,75 @@
+package resolver
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+
+	"github.com/duratarskeyk/proxymux/corestructs"
+)
+
+type Resolver interface {
+	LookupIP(ctx context.Context, host string) ([]net.IP, error)
+}
+
+type netResolver struct {
+	resolver *net.Resolver
+}
+
+func (r *netResolver) LookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	return r.resolver.LookupIP(ctx, "ip", host)
+}
+
+// NewUpstream returns a resolver querying servers ("ip:port") in round-robin
+// order. With no servers the system configuration is used.
+func NewUpstream(servers []string) Resolver {
+	if len(servers) == 0 {
+		return &netResolver{resolver: net.DefaultResolver}
+	}
+
+	var next atomic.Uint32
+	return &netResolver{
+		resolver: &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+				server := servers[int(next.Add(1)-1)%len(servers)]
+				var d net.Dialer
+				return d.DialContext(ctx, network, server)
+			},
+		},
+	}
+}
+
+// Resolve looks up a hostname target and stores the first address allowed by
+// family in fields.HostIP. IP targets are left untouched. When no address is
+// left after applying family a *net.DNSError is returned.
+func Resolve(ctx context.Context, r Resolver, fields *corestructs.Fields, family Family) error {
+	ips, err := LookupFamily(ctx, r, fields, family)
+	if err != nil {
+		return err
+	}
+	if ips != nil {
+		fields.HostIP = ips[0]
+	}
+
+	return nil
+}
+
+// LookupFamily returns every address of a hostname target allowed by family,
+// preferred ones first. It returns nil for IP targets.
+func LookupFamily(ctx context.Context, r Resolver, fields *corestructs.Fields, family Family) ([]net.IP, error) {
+	if fields.HostType != corestructs.HostTypeHostname {
+		return nil, nil
+	}
+
+	ips, err := r.LookupIP(ctx, fields.Host)
+	if err != nil {
+		return nil, err
+	}
+	ips = family.Select(ips)
+	if len(ips) == 0 {
+		return nil, &net.DNSError{Err: "no address of the requested family", Name: fields.Host, IsNotFound: true}
+	}
+
+	return ips, nil
+}
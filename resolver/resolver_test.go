@@ -0,0 +1,123 @@
+package resolver
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/duratarskeyk/proxymux/corestructs"
+)
+
+type staticResolver struct {
+	hosts map[string][]net.IP
+	calls int
+}
+
+func (r *staticResolver) LookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	r.calls++
+	ips, ok := r.hosts[host]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return ips, nil
+}
+
+var dualStack = []net.IP{
+	net.ParseIP("2001:db8::1"),
+	net.ParseIP("192.0.2.1"),
+	net.ParseIP("2001:db8::2"),
+	net.ParseIP("192.0.2.2"),
+}
+
+func TestFamilySelect(t *testing.T) {
+	families := []Family{FamilyAny, FamilyIPv4Only, FamilyIPv6Only, FamilyPreferIPv4, FamilyPreferIPv6}
+	results := [][]string{
+		{"2001:db8::1", "192.0.2.1", "2001:db8::2", "192.0.2.2"},
+		{"192.0.2.1", "192.0.2.2"},
+		{"2001:db8::1", "2001:db8::2"},
+		{"192.0.2.1", "192.0.2.2", "2001:db8::1", "2001:db8::2"},
+		{"2001:db8::1", "2001:db8::2", "192.0.2.1", "192.0.2.2"},
+	}
+	for nr, family := range families {
+		ips := family.Select(dualStack)
+		if len(ips) != len(results[nr]) {
+			t.Errorf("Test #%d: Expected %d addresses, got %d", nr+1, len(results[nr]), len(ips))
+			continue
+		}
+		for i, ip := range ips {
+			if ip.String() != results[nr][i] {
+				t.Errorf("Test #%d: Address %d: expected %s, got %s", nr+1, i+1, results[nr][i], ip)
+			}
+		}
+	}
+}
+
+func TestResolve(t *testing.T) {
+	upstream := &staticResolver{hosts: map[string][]net.IP{
+		"dual.example": dualStack,
+		"v4.example":   {net.ParseIP("192.0.2.3")},
+	}}
+	cache := NewCache(upstream, time.Minute, time.Minute, 0)
+
+	fields := &corestructs.Fields{Host: "dual.example", HostType: corestructs.HostTypeHostname}
+	if err := Resolve(context.Background(), cache, fields, FamilyPreferIPv4); err != nil {
+		t.Fatal(err)
+	}
+	if !fields.HostIP.Equal(net.ParseIP("192.0.2.1")) {
+		t.Errorf("Expected HostIP 192.0.2.1, got %s", fields.HostIP)
+	}
+
+	fields = &corestructs.Fields{Host: "v4.example", HostType: corestructs.HostTypeHostname}
+	err := Resolve(context.Background(), cache, fields, FamilyIPv6Only)
+	var dnsErr *net.DNSError
+	if !errors.As(err, &dnsErr) {
+		t.Errorf("Expected DNS error, got %v", err)
+	}
+	if fields.HostIP != nil {
+		t.Errorf("Expected HostIP to stay nil, got %s", fields.HostIP)
+	}
+
+	fields = &corestructs.Fields{Host: "192.0.2.9", HostIP: net.ParseIP("192.0.2.9"), HostType: corestructs.HostTypeIPv4}
+	if err := Resolve(context.Background(), cache, fields, FamilyIPv6Only); err != nil {
+		t.Errorf("Expected IP targets to be left alone, got %s", err)
+	}
+	if upstream.calls != 2 {
+		t.Errorf("Expected 2 upstream lookups, got %d", upstream.calls)
+	}
+}
+
+func TestCache(t *testing.T) {
+	upstream := &staticResolver{hosts: map[string][]net.IP{"a.example": {net.ParseIP("192.0.2.1")}}}
+	cache := NewCache(upstream, 50*time.Millisecond, time.Minute, 2)
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		if _, err := cache.LookupIP(ctx, "a.example"); err != nil {
+			t.Fatal(err)
+		}
+		cache.LookupIP(ctx, "missing.example")
+	}
+	if upstream.calls != 2 {
+		t.Errorf("Expected positive and negative answers to be cached, got %d lookups", upstream.calls)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	cache.LookupIP(ctx, "a.example")
+	if upstream.calls != 3 {
+		t.Errorf("Expected expired entry to be looked up again, got %d lookups", upstream.calls)
+	}
+
+	cache.LookupIP(ctx, "b.example")
+	cache.LookupIP(ctx, "c.example")
+	if len(cache.entries) > 2 {
+		t.Errorf("Expected at most 2 cache entries, got %d", len(cache.entries))
+	}
+
+	cache.Flush()
+	cache.LookupIP(ctx, "missing.example")
+	if upstream.calls != 6 {
+		t.Errorf("Expected flushed entry to be looked up again, got %d lookups", upstream.calls)
+	}
+}
@@ -0,0 +1,230 @@
+package session
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/duratarskeyk/proxymux/corestructs"
+	"github.com/duratarskeyk/proxymux/upstream"
+)
+
+var ErrBadTTL = errors.New("bad session ttl")
+var ErrTooManySessions = errors.New("too many sessions")
+
+const (
+	defaultTTL         = 10 * time.Minute
+	defaultMaxTTL      = 24 * time.Hour
+	defaultMaxSessions = 1 << 16
+)
+
+type Key struct {
+	UserID    int
+	PackageID int
+	Session   string
+}
+
+// Choice is the egress a session is pinned to, apply EgressIP with
+// egress.Binder.BindIP and dial through Upstream when it's not empty.
+type Choice struct {
+	EgressIP string
+	Upstream upstream.Chain
+}
+
+type Session struct {
+	Key     Key
+	Choice  Choice
+	Created time.Time
+	Expires time.Time
+}
+
+// Manager pins sessions, named by the SessionOption login option, to the
+// Choice made for their first request until they expire. The next request
+// of an expired session gets a new Choice. The lifetime is TTL, or the
+// TTLOption login option capped at MaxTTL, 24h when zero. Once MaxSessions,
+// 1<<16 when zero, sessions are stored new ones are refused with
+// ErrTooManySessions until expired ones are swept.
+type Manager struct {
+	Choose func(fields *corestructs.Fields) (Choice, error)
+
+	TTL           time.Duration
+	MaxTTL        time.Duration
+	MaxSessions   int
+	SessionOption string
+	TTLOption     string
+
+	mu        sync.Mutex
+	sessions  map[Key]*Session
+	nextSweep time.Time
+	now       func() time.Time
+}
+
+// KeyFromFields returns the session key of an authorized request, false
+// when it doesn't name a session or is made by a system user.
+func (m *Manager) KeyFromFields(fields *corestructs.Fields) (Key, bool) {
+	name := m.SessionOption
+	if name == "" {
+		name = "session"
+	}
+	session, ok := fields.LoginOptions.Get(name)
+	if !ok || fields.SystemUser {
+		return Key{}, false
+	}
+
+	return Key{UserID: fields.UserID, PackageID: fields.PackageID, Session: session}, true
+}
+
+// Get returns the Choice of the request's session, calling Choose for new
+// and expired sessions. Requests without a session always get a new Choice.
+func (m *Manager) Get(fields *corestructs.Fields) (Choice, error) {
+	key, ok := m.KeyFromFields(fields)
+	if !ok {
+		return m.Choose(fields)
+	}
+
+	now := m.clock()
+	m.mu.Lock()
+	m.sweepLocked(now)
+	if s, ok := m.sessions[key]; ok && now.Before(s.Expires) {
+		choice := s.Choice
+		m.mu.Unlock()
+		return choice, nil
+	}
+	m.mu.Unlock()
+
+	ttl, err := m.ttl(fields)
+	if err != nil {
+		return Choice{}, err
+	}
+	choice, err := m.Choose(fields)
+	if err != nil {
+		return Choice{}, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if s, ok := m.sessions[key]; ok && now.Before(s.Expires) {
+		// a concurrent request of the same session won
+		return s.Choice, nil
+	}
+	if m.sessions == nil {
+		m.sessions = make(map[Key]*Session)
+	}
+	if _, ok := m.sessions[key]; !ok && len(m.sessions) >= m.maxSessions() {
+		return Choice{}, ErrTooManySessions
+	}
+	m.sessions[key] = &Session{Key: key, Choice: choice, Created: now, Expires: now.Add(ttl)}
+
+	return choice, nil
+}
+
+func (m *Manager) Lookup(key Key) (Session, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.sessions[key]
+	if !ok || !m.clock().Before(s.Expires) {
+		return Session{}, false
+	}
+
+	return *s, true
+}
+
+// Sessions returns the live sessions, optionally only the ones of userID
+// when it's not 0.
+func (m *Manager) Sessions(userID int) []Session {
+	now := m.clock()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	sessions := make([]Session, 0, len(m.sessions))
+	for _, s := range m.sessions {
+		if (userID == 0 || s.Key.UserID == userID) && now.Before(s.Expires) {
+			sessions = append(sessions, *s)
+		}
+	}
+
+	return sessions
+}
+
+// Evict removes a session, its next request gets a new Choice.
+func (m *Manager) Evict(key Key) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, ok := m.sessions[key]
+	delete(m.sessions, key)
+
+	return ok
+}
+
+// EvictUser removes all sessions of userID and returns their count.
+func (m *Manager) EvictUser(userID int) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n := 0
+	for key := range m.sessions {
+		if key.UserID == userID {
+			delete(m.sessions, key)
+			n++
+		}
+	}
+
+	return n
+}
+
+func (m *Manager) ttl(fields *corestructs.Fields) (time.Duration, error) {
+	ttl := m.TTL
+	if ttl <= 0 {
+		ttl = defaultTTL
+	}
+	name := m.TTLOption
+	if name == "" {
+		name = "ttl"
+	}
+	if value, ok := fields.LoginOptions.Get(name); ok {
+		var err error
+		if ttl, err = time.ParseDuration(value); err != nil || ttl <= 0 {
+			return 0, ErrBadTTL
+		}
+		maxTTL := m.MaxTTL
+		if maxTTL <= 0 {
+			maxTTL = defaultMaxTTL
+		}
+		if ttl > maxTTL {
+			ttl = maxTTL
+		}
+	}
+
+	return ttl, nil
+}
+
+func (m *Manager) maxSessions() int {
+	if m.MaxSessions > 0 {
+		return m.MaxSessions
+	}
+
+	return defaultMaxSessions
+}
+
+// sweepLocked drops expired sessions at most once per TTL.
+func (m *Manager) sweepLocked(now time.Time) {
+	if now.Before(m.nextSweep) {
+		return
+	}
+	for key, s := range m.sessions {
+		if !now.Before(s.Expires) {
+			delete(m.sessions, key)
+		}
+	}
+	interval := m.TTL
+	if interval <= 0 {
+		interval = defaultTTL
+	}
+	m.nextSweep = now.Add(interval)
+}
+
+func (m *Manager) clock() time.Time {
+	if m.now != nil {
+		return m.now()
+	}
+
+	return time.Now()
+}
@@ -0,0 +1,125 @@
+package session
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/duratarskeyk/proxymux/corestructs"
+	"github.com/duratarskeyk/proxymux/loginparams"
+)
+
+func TestManager(t *testing.T) {
+	now := time.Unix(1000, 0)
+	chosen := 0
+	m := &Manager{
+		Choose: func(fields *corestructs.Fields) (Choice, error) {
+			chosen++
+			return Choice{EgressIP: fmt.Sprintf("10.0.0.%d", chosen)}, nil
+		},
+		TTL:    time.Minute,
+		MaxTTL: time.Hour,
+		now:    func() time.Time { return now },
+	}
+	fields := func(userID int, opts ...loginparams.Option) *corestructs.Fields {
+		return &corestructs.Fields{UserID: userID, PackageID: 1, LoginOptions: opts}
+	}
+	session := loginparams.Option{Key: "session", Value: "abc"}
+
+	steps := []struct {
+		fields  *corestructs.Fields
+		advance time.Duration
+		egress  string
+		err     error
+	}{
+		{fields(1, session), 0, "10.0.0.1", nil},
+		{fields(1, session), 30 * time.Second, "10.0.0.1", nil},
+		{fields(2, session), 0, "10.0.0.2", nil},
+		{fields(1), 0, "10.0.0.3", nil},
+		{fields(1, session), 30 * time.Second, "10.0.0.4", nil},
+		{fields(1, loginparams.Option{Key: "session", Value: "long"}, loginparams.Option{Key: "ttl", Value: "2h"}), 0, "10.0.0.5", nil},
+		{fields(1, loginparams.Option{Key: "session", Value: "bad"}, loginparams.Option{Key: "ttl", Value: "x"}), 0, "", ErrBadTTL},
+		{&corestructs.Fields{SystemUser: true, LoginOptions: loginparams.Options{session}}, 0, "10.0.0.6", nil},
+	}
+	for nr, step := range steps {
+		now = now.Add(step.advance)
+		choice, err := m.Get(step.fields)
+		if !errors.Is(err, step.err) {
+			t.Errorf("Test #%d: Expected error %v, got %v", nr+1, step.err, err)
+		} else if choice.EgressIP != step.egress {
+			t.Errorf("Test #%d: Expected egress %s, got %s", nr+1, step.egress, choice.EgressIP)
+		}
+	}
+
+	long, ok := m.Lookup(Key{UserID: 1, PackageID: 1, Session: "long"})
+	if !ok || long.Expires.Sub(long.Created) != time.Hour {
+		t.Errorf("Expected session ttl to be capped at an hour, got %v", long.Expires.Sub(long.Created))
+	}
+	if n := len(m.Sessions(1)); n != 2 {
+		t.Errorf("Expected 2 sessions of user 1, got %d", n)
+	}
+	if n := len(m.Sessions(0)); n != 3 {
+		t.Errorf("Expected 3 sessions, got %d", n)
+	}
+
+	key := Key{UserID: 1, PackageID: 1, Session: "abc"}
+	if !m.Evict(key) || m.Evict(key) {
+		t.Error("Expected Evict to remove the session once")
+	}
+	if choice, _ := m.Get(fields(1, session)); choice.EgressIP != "10.0.0.7" {
+		t.Errorf("Expected evicted session to rotate, got %s", choice.EgressIP)
+	}
+	if n := m.EvictUser(1); n != 2 {
+		t.Errorf("Expected 2 sessions evicted, got %d", n)
+	}
+
+	now = now.Add(2 * time.Minute)
+	m.Get(fields(3))
+	if _, ok := m.Lookup(Key{UserID: 2, PackageID: 1, Session: "abc"}); ok {
+		t.Error("Expected expired session to be gone")
+	}
+	m.Get(fields(3, session))
+	if len(m.sessions) != 1 {
+		t.Errorf("Expected expired sessions to be swept, %d left", len(m.sessions))
+	}
+}
+
+func TestManagerLimits(t *testing.T) {
+	now := time.Unix(1000, 0)
+	m := &Manager{
+		Choose:      func(fields *corestructs.Fields) (Choice, error) { return Choice{EgressIP: "10.0.0.1"}, nil },
+		MaxSessions: 2,
+		now:         func() time.Time { return now },
+	}
+	get := func(session, ttl string) error {
+		opts := loginparams.Options{{Key: "session", Value: session}}
+		if ttl != "" {
+			opts = append(opts, loginparams.Option{Key: "ttl", Value: ttl})
+		}
+		_, err := m.Get(&corestructs.Fields{UserID: 1, PackageID: 1, LoginOptions: opts})
+		return err
+	}
+
+	if err := get("a", "87600h"); err != nil {
+		t.Fatal(err)
+	}
+	a, _ := m.Lookup(Key{UserID: 1, PackageID: 1, Session: "a"})
+	if ttl := a.Expires.Sub(a.Created); ttl != defaultMaxTTL {
+		t.Errorf("Expected ttl to be capped at %s, got %s", defaultMaxTTL, ttl)
+	}
+	if err := get("b", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := get("c", ""); !errors.Is(err, ErrTooManySessions) {
+		t.Errorf("Expected %v, got %v", ErrTooManySessions, err)
+	}
+	// known sessions still work, expired ones make room
+	if err := get("a", ""); err != nil {
+		t.Errorf("Expected a live session to be served, got %s", err)
+	}
+	now = now.Add(defaultTTL)
+	if err := get("c", ""); err != nil {
+		t.Errorf("Expected an expired session to make room, got %s", err)
+	}
+}
@@ -0,0 +1,47 @@
+package socks4protocol
+
+import (
+	"context"
+	"net"
+
+	"github.com/duratarskeyk/go-common-utils/idlenet"
+	"github.com/duratarskeyk/proxymux/internal/bindlistener"
+	"github.com/duratarskeyk/proxymux/relay"
+)
+
+// Bind serves a BIND request. It listens on the egress IP, sends the first
+// reply with the bound port and IP and waits Timeouts.Connect for one inbound
+// connection from the requested peer. After the second reply both conns are
+// handed to relay.Tunnel.
+func Bind(ctx context.Context, req *Socks4Request) error {
+	fields := req.Fields
+	if req.Command != BindCommand {
+		return ErrUnsuportedCommand
+	}
+
+	ln, bound, err := bindlistener.Listen("tcp4", fields)
+	if err != nil {
+		idlenet.WriteWithTimeout(fields.Conn, fields.Timeouts.Write, ResponseRejected)
+		return err
+	}
+	defer ln.Close()
+
+	if _, err = idlenet.WriteWithTimeout(fields.Conn, fields.Timeouts.Write, responseWithAddr(bound.IP.To4(), uint16(bound.Port))); err != nil {
+		return err
+	}
+
+	peer, err := bindlistener.Accept(ctx, ln, fields.HostIP, fields.Timeouts.Connect, fields.Destinations)
+	if err != nil {
+		idlenet.WriteWithTimeout(fields.Conn, fields.Timeouts.Write, ResponseRejected)
+		return err
+	}
+	defer peer.Close()
+	ln.Close()
+
+	peerAddr := peer.RemoteAddr().(*net.TCPAddr)
+	if _, err = idlenet.WriteWithTimeout(fields.Conn, fields.Timeouts.Write, responseWithAddr(peerAddr.IP.To4(), uint16(peerAddr.Port))); err != nil {
+		return err
+	}
+
+	return relay.Tunnel(ctx, fields, peer)
+}
@@ -0,0 +1,105 @@
+package socks4protocol
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/duratarskeyk/go-common-utils/authorizer"
+	"github.com/duratarskeyk/proxymux/corestructs"
+	"github.com/duratarskeyk/proxymux/internal/authmock"
+)
+
+func readResponse(t *testing.T, conn net.Conn) (byte, *net.TCPAddr) {
+	resp := make([]byte, 8)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		t.Fatal(err)
+	}
+
+	return resp[1], &net.TCPAddr{IP: net.IP(resp[4:8]), Port: int(resp[2])<<8 | int(resp[3])}
+}
+
+func TestBind(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	server, err := ln.Accept()
+	ln.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	req := GetSocks4Request()
+	fields := req.Fields
+	fields.UserIP = "127.0.0.1"
+	fields.ProxyIP = "127.0.0.1"
+	fields.Conn = server
+	fields.ProxyConfig = &authmock.Mock{
+		IPAuthRet:          authorizer.BadAuthResult,
+		CredentialsAuthRet: authorizer.AuthResult{OK: true, PackageID: 1, UserID: 11},
+	}
+	fields.Timeouts = &corestructs.Timeouts{Handshake: time.Second, Connect: time.Second, Read: time.Second, Write: time.Second}
+	errCh := make(chan error)
+	go func() {
+		if err := req.Read(); err != nil {
+			errCh <- err
+			return
+		}
+		errCh <- Bind(context.Background(), req)
+	}()
+
+	client.Write([]byte{2, 0, 21, 127, 0, 0, 1, 'a', '.', 'b', 0})
+	code, bound := readResponse(t, client)
+	if code != grantedCode {
+		t.Fatalf("Expected first response to be granted, got %x", code)
+	}
+	if req.Command != BindCommand {
+		t.Errorf("Expected command %d, got %d", BindCommand, req.Command)
+	}
+	peer, err := net.Dial("tcp", bound.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	code, peerAddr := readResponse(t, client)
+	if code != grantedCode {
+		t.Fatalf("Expected second response to be granted, got %x", code)
+	}
+	if peerAddr.String() != peer.LocalAddr().String() {
+		t.Errorf("Expected peer address %s, got %s", peer.LocalAddr(), peerAddr)
+	}
+
+	peer.Write([]byte("220 ready"))
+	buf := make([]byte, 9)
+	io.ReadFull(client, buf)
+	if !bytes.Equal(buf, []byte("220 ready")) {
+		t.Errorf("Expected client to receive %q, got %q", "220 ready", buf)
+	}
+
+	client.Close()
+	peer.Close()
+	if err := <-errCh; err != nil {
+		t.Errorf("Expected nil error, got %s", err)
+	}
+	PutSocks4Request(req)
+}
+
+func TestBindWrongCommand(t *testing.T) {
+	req := GetSocks4Request()
+	req.Command = ConnectCommand
+	if err := Bind(context.Background(), req); err != ErrUnsuportedCommand {
+		t.Errorf("Expected %s, got %v", ErrUnsuportedCommand, err)
+	}
+	PutSocks4Request(req)
+}
@@ -0,0 +1,63 @@
+package socks4protocol
+
+import (
+	"io"
+	"net"
+)
+
+// ClientConnect runs the client side of a SOCKS4 CONNECT handshake on conn.
+// Hostnames are sent SOCKS4a style. The password, if any, is appended to the
+// userid after a dot, the way Read splits it. Hostnames with control bytes,
+// spaces or slashes are rejected with ErrBadHost.
+func ClientConnect(conn net.Conn, username, password, host string, port uint16) error {
+	userID := username
+	if password != "" {
+		userID += "." + password
+	}
+
+	request := make([]byte, 0, 10+len(userID)+len(host))
+	request = append(request, 4, ConnectCommand, byte(port>>8), byte(port&0xFF))
+	ip := net.ParseIP(host).To4()
+	if ip != nil {
+		request = append(request, ip...)
+	} else {
+		request = append(request, 0, 0, 0, 1)
+	}
+	request = append(request, userID...)
+	request = append(request, 0)
+	if ip == nil {
+		if !validHost(host) {
+			return ErrBadHost
+		}
+		request = append(request, host...)
+		request = append(request, 0)
+	}
+	if _, err := conn.Write(request); err != nil {
+		return err
+	}
+
+	response := make([]byte, 8)
+	if _, err := io.ReadFull(conn, response); err != nil {
+		return err
+	}
+	if response[1] != grantedCode {
+		return ErrRejected
+	}
+
+	return nil
+}
+
+// validHost reports whether host can be sent as a SOCKS4a hostname, a NUL
+// would cut it short.
+func validHost(host string) bool {
+	if host == "" {
+		return false
+	}
+	for i := 0; i < len(host); i++ {
+		if c := host[i]; c <= ' ' || c == 0x7f || c == '/' {
+			return false
+		}
+	}
+
+	return true
+}
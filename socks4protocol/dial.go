@@ -0,0 +1,21 @@
+package socks4protocol
+
+import (
+	"context"
+	"net"
+
+	"github.com/duratarskeyk/go-common-utils/idlenet"
+	"github.com/duratarskeyk/proxymux/dialer"
+)
+
+// Dial connects to the requested target. On failure the client gets
+// ResponseRejected, SOCKS4 has no finer grained codes.
+func Dial(ctx context.Context, req *Socks4Request) (net.Conn, error) {
+	conn, err := dialer.Dial(ctx, req.Fields)
+	if err != nil {
+		idlenet.WriteWithTimeout(req.Fields.Conn, req.Fields.Timeouts.Write, ResponseRejected)
+		return nil, err
+	}
+
+	return conn, nil
+}
@@ -5,6 +5,9 @@ import "errors"
 var ErrUnsuportedCommand = errors.New("unsupported command")
 var ErrBadCredentials = errors.New("ip and credentials auth failed")
 var ErrIPAuthFailed = errors.New("ip auth failed")
+var ErrRejected = errors.New("request rejected")
+var ErrIPv6Addr = errors.New("ipv6 destinations are not allowed")
+var ErrBadHost = errors.New("bad hostname")
 
 type ErrBadRequest struct {
 	err error
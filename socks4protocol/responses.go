@@ -1,4 +1,18 @@
 package socks4protocol
 
-var ResponseOK = []byte{0, 0x5A, 0, 0, 0, 0, 0, 0}
-var ResponseRejected = []byte{0, 0x5B, 0, 0, 0, 0, 0, 0}
+const (
+	ConnectCommand = byte(1)
+	BindCommand    = byte(2)
+)
+
+const (
+	grantedCode  = byte(0x5A)
+	rejectedCode = byte(0x5B)
+)
+
+var ResponseOK = []byte{0, grantedCode, 0, 0, 0, 0, 0, 0}
+var ResponseRejected = []byte{0, rejectedCode, 0, 0, 0, 0, 0, 0}
+
+func responseWithAddr(ip []byte, port uint16) []byte {
+	return []byte{0, grantedCode, byte(port >> 8), byte(port & 0xFF), ip[0], ip[1], ip[2], ip[3]}
+}
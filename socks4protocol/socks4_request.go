@@ -2,14 +2,15 @@ package socks4protocol
 
 import (
 	"bufio"
-	"fmt"
+	"context"
 	"io"
 	"net"
 	"strconv"
 	"strings"
 
-	"github.com/duratarskeyk/go-common-utils/authorizer"
 	"github.com/duratarskeyk/go-common-utils/idlenet"
+	"github.com/duratarskeyk/proxymux/auth"
+	"github.com/duratarskeyk/proxymux/backconnect"
 	"github.com/duratarskeyk/proxymux/corestructs"
 	"go.uber.org/zap"
 )
@@ -20,13 +21,21 @@ type Socks4Request struct {
 	connWrapper   reader
 	limitedReader io.LimitedReader
 	buffer        *bufio.Reader
+
+	Command byte
 }
 
-// 512 - 8 + 12 = 516, 8 bytes already read when we need to read ident and possibly a domain name
-// and package/user id and client ip for backconnect
-const requestSizeLimit = 516
+// 512 - 8 + backconnect.MaxSize, 8 bytes already read when we need to read ident and possibly
+// a domain name and the backconnect envelope
+const requestSizeLimit = 512 - 8 + backconnect.MaxSize
 
 func (req *Socks4Request) Read() error {
+	return req.ReadContext(context.Background())
+}
+
+// ReadContext reads the request passing ctx to the auth backend. Errors of
+// an unavailable backend match auth.ErrBackendUnavailable.
+func (req *Socks4Request) ReadContext(ctx context.Context) error {
 	fields := req.Fields
 	fields.LogFields = append(fields.LogFields,
 		zap.String("user_ip", fields.UserIP),
@@ -36,9 +45,10 @@ func (req *Socks4Request) Read() error {
 	if _, err := idlenet.ReadWithTimeout(fields.Conn, fields.Timeouts.Handshake, reqBytes); err != nil {
 		return &ErrBadRequest{err: err}
 	}
-	if reqBytes[0] != 1 {
+	if reqBytes[0] != ConnectCommand && reqBytes[0] != BindCommand {
 		return &ErrBadRequest{err: ErrUnsuportedCommand}
 	}
+	req.Command = reqBytes[0]
 	fields.PortNum = uint16(reqBytes[1])<<8 | uint16(reqBytes[2])
 	fields.Port = strconv.Itoa(int(fields.PortNum))
 	socks4a := false
@@ -79,13 +89,27 @@ func (req *Socks4Request) Read() error {
 		}
 		fields.Host = fields.Host[:len(fields.Host)-1]
 		fields.HostType = corestructs.HostTypeHostname
+		if ip := net.ParseIP(fields.Host); ip != nil {
+			if ip4 := ip.To4(); ip4 != nil {
+				fields.HostIP = ip4
+				fields.HostType = corestructs.HostTypeIPv4
+			} else {
+				fields.HostIP = ip
+				fields.HostType = corestructs.HostTypeIPv6
+			}
+			fields.Host = fields.HostIP.String()
+		}
+		if fields.IPv6Denied() {
+			return &ErrBadRequest{err: ErrIPv6Addr}
+		}
 	}
 
 	fields.Login = ""
+	fields.LoginOptions = fields.LoginOptions[:0]
 	fields.Password = ""
-	var result authorizer.AuthResult
-	auth := fields.ProxyConfig.(authorizer.Authorizer)
-	if result = auth.IPAuth(fields.ProxyIP, fields.UserIP); result.OK {
+	backend := auth.From(fields.ProxyConfig)
+	result, ipAuthErr := backend.IPAuth(ctx, fields.ProxyIP, fields.UserIP)
+	if result.OK {
 		fields.PackageID = result.PackageID
 		fields.UserID = result.UserID
 		fields.Backconnect = false
@@ -94,11 +118,20 @@ func (req *Socks4Request) Read() error {
 		pos := strings.IndexByte(identd, '.')
 		if pos == -1 {
 			fields.Login = identd
-			result = auth.CredentialsAuth(fields.ProxyIP, identd, "")
 		} else {
 			fields.Login = identd[:pos]
 			fields.Password = identd[pos+1:]
-			result = auth.CredentialsAuth(fields.ProxyIP, fields.Login, fields.Password)
+		}
+		if err = fields.ParseLogin(); err != nil {
+			return &ErrAuthorization{err: err}
+		}
+		var isToken bool
+		if result, isToken, err = fields.TokenAuth(ctx); isToken {
+			if err != nil {
+				return &ErrAuthorization{err: err}
+			}
+		} else if result, err = backend.CredentialsAuth(ctx, fields.ProxyIP, fields.Login, fields.Password); err != nil {
+			return &ErrAuthorization{err: auth.NewErrBackend(err)}
 		}
 		if !result.OK {
 			return &ErrAuthorization{err: ErrBadCredentials}
@@ -108,26 +141,21 @@ func (req *Socks4Request) Read() error {
 		fields.SystemUser = result.SystemUser
 		fields.Backconnect = result.Backconnect
 		if fields.Backconnect {
-			backconnectData := make([]byte, 12)
-			if _, err := req.buffer.Read(backconnectData); err != nil {
+			fields.PackageID, fields.UserID, fields.UserIP, err = fields.BackconnectVerifier.Read(req.buffer)
+			if err != nil {
 				return &ErrBadRequest{err: err}
 			}
-			packageID := uint(backconnectData[0])<<24 | uint(backconnectData[1])<<16 | uint(backconnectData[2])<<8 | uint(backconnectData[3])
-			userID := uint(backconnectData[4])<<24 | uint(backconnectData[5])<<16 | uint(backconnectData[6])<<8 | uint(backconnectData[7])
-			fields.PackageID = int(packageID)
-			fields.UserID = int(userID)
-			fields.UserIP = fmt.Sprintf("%d.%d.%d.%d", backconnectData[8], backconnectData[9], backconnectData[10], backconnectData[11])
 			fields.LogFields[0].String = fields.UserIP
 		}
+	} else if ipAuthErr != nil {
+		return &ErrAuthorization{err: auth.NewErrBackend(ipAuthErr)}
 	} else {
 		return &ErrAuthorization{err: ErrIPAuthFailed}
 	}
 
 	fields.FillLogFields()
 
-	proxyIPOctets := []byte(net.ParseIP(fields.ProxyIP).To4())
-	fields.ProxyIPNum = (uint32(proxyIPOctets[0]) << 24) | (uint32(proxyIPOctets[1]) << 16) |
-		(uint32(proxyIPOctets[2]) << 8) | uint32(proxyIPOctets[3])
+	fields.SetProxyAddr()
 
 	fields.Upload = req.connWrapper.total + 8
 
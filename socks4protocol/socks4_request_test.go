@@ -2,17 +2,22 @@ package socks4protocol
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"io"
 	"net"
 	"os"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 
 	"github.com/duratarskeyk/go-common-utils/authorizer"
+	"github.com/duratarskeyk/proxymux/auth"
+	"github.com/duratarskeyk/proxymux/backconnect"
 	"github.com/duratarskeyk/proxymux/corestructs"
 	"github.com/duratarskeyk/proxymux/internal/authmock"
+	"github.com/duratarskeyk/proxymux/loginparams"
 )
 
 type goodTestCase struct {
@@ -147,6 +152,7 @@ func TestGoodRequests(t *testing.T) {
 		fields.UserID = 0
 		fields.Conn = c1
 		fields.ProxyConfig = testCase.authMock
+		fields.BackconnectVerifier = &backconnect.Verifier{Legacy: true}
 		fields.Timeouts = &corestructs.Timeouts{Handshake: 30 * time.Second}
 		var wg sync.WaitGroup
 		wg.Add(2)
@@ -189,8 +195,8 @@ func TestGoodRequests(t *testing.T) {
 func TestBadRequests(t *testing.T) {
 	badRequests := [][]byte{
 		{1, 0, 0},
-		{2, 0, 22, 1, 2, 3, 4, 0},
-		append([]byte{1, 0, 22, 1, 2, 3, 4}, bytes.Repeat([]byte{'a'}, 540)...),
+		{3, 0, 22, 1, 2, 3, 4, 0},
+		append([]byte{1, 0, 22, 1, 2, 3, 4}, bytes.Repeat([]byte{'a'}, requestSizeLimit+8)...),
 		{1, 0, 22, 1, 1, 1, 1, 'a', '.', 0},
 		{1, 0, 22, 1, 1, 1, 1, 'a', 'a', 0},
 		{1, 0, 22, 1, 1, 1, 1, 0},
@@ -235,3 +241,262 @@ func TestBadRequests(t *testing.T) {
 		PutSocks4Request(req)
 	}
 }
+
+func TestDualStackRequests(t *testing.T) {
+	backconnectV6 := []byte{0, 0, 0, 2, 0, 0, 0, 22, 0, 0, 0, 0, 0x20, 1, 0xd, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 5}
+	testCases := []struct {
+		policy  corestructs.IPv6Policy
+		request []byte
+
+		host     string
+		hostType int
+		userIP   string
+		err      error
+	}{
+		{
+			corestructs.IPv6Allow,
+			append([]byte("\x01\x00\x50\x00\x00\x00\x01a.b\x002001:db8::2\x00"), backconnectV6...),
+			"2001:db8::2",
+			corestructs.HostTypeIPv6,
+			"2001:db8::5",
+			nil,
+		},
+		{
+			corestructs.IPv6Deny,
+			[]byte("\x01\x00\x50\x00\x00\x00\x01a.b\x001.2.3.4\x00\x00\x00\x00\x02\x00\x00\x00\x16\x05\x05\x05\x05"),
+			"1.2.3.4",
+			corestructs.HostTypeIPv4,
+			"5.5.5.5",
+			nil,
+		},
+		{
+			corestructs.IPv6Deny,
+			append([]byte("\x01\x00\x50\x00\x00\x00\x01a.b\x002001:db8::2\x00"), backconnectV6...),
+			"",
+			0,
+			"",
+			ErrIPv6Addr,
+		},
+	}
+	errChan := make(chan error)
+	for nr, testCase := range testCases {
+		c1, c2 := net.Pipe()
+		req := GetSocks4Request()
+		fields := req.Fields
+		fields.UserIP = "2001:db8::3"
+		fields.ProxyIP = "2001:db8::1"
+		fields.IPv6Policy = testCase.policy
+		fields.Conn = c1
+		fields.ProxyConfig = &authmock.Mock{
+			IPAuthRet:          authorizer.BadAuthResult,
+			CredentialsAuthRet: authorizer.AuthResult{OK: true, Backconnect: true},
+		}
+		fields.BackconnectVerifier = &backconnect.Verifier{Legacy: true}
+		fields.Timeouts = &corestructs.Timeouts{Handshake: 1 * time.Second}
+		go c2.Write(testCase.request)
+		go func() {
+			errChan <- req.Read()
+		}()
+		err := <-errChan
+		c1.Close()
+		c2.Close()
+		if !errors.Is(err, testCase.err) {
+			t.Errorf("Test #%d: Expected %v, got %v", nr+1, testCase.err, err)
+		} else if err == nil {
+			if fields.Host != testCase.host || fields.HostType != testCase.hostType || fields.UserIP != testCase.userIP {
+				t.Errorf("Test #%d: Expected %s type %d from %s, got %s type %d from %s", nr+1, testCase.host, testCase.hostType, testCase.userIP, fields.Host, fields.HostType, fields.UserIP)
+			}
+			if fields.ProxyAddr.String() != "2001:db8::1" {
+				t.Errorf("Test #%d: Bad proxy addr %s", nr+1, fields.ProxyAddr)
+			}
+		}
+		PutSocks4Request(req)
+	}
+}
+
+func TestLoginOptions(t *testing.T) {
+	requests := [][]byte{
+		[]byte("\x01\x00\x50\x01\x02\x03\x04user-session-abc-country-de.pass\x00"),
+		[]byte("\x01\x00\x50\x01\x02\x03\x04user-session.pass\x00"),
+	}
+	results := []struct {
+		err     error
+		session string
+	}{
+		{nil, "abc"},
+		{loginparams.ErrMissingValue, ""},
+	}
+	errChan := make(chan error)
+	for nr, request := range requests {
+		c1, c2 := net.Pipe()
+		mock := &authmock.Mock{
+			IPAuthRet:          authorizer.BadAuthResult,
+			CredentialsAuthRet: authorizer.AuthResult{OK: true, PackageID: 1, UserID: 11},
+		}
+		req := GetSocks4Request()
+		fields := req.Fields
+		fields.UserIP = "4.3.2.1"
+		fields.ProxyIP = "1.2.3.4"
+		fields.Conn = c1
+		fields.ProxyConfig = mock
+		fields.LoginParser = &loginparams.Parser{Keys: []string{"session", "country"}}
+		fields.Timeouts = &corestructs.Timeouts{Handshake: 1 * time.Second}
+		go c2.Write(request)
+		go func() {
+			errChan <- req.Read()
+		}()
+		err := <-errChan
+		c1.Close()
+		c2.Close()
+		if !errors.Is(err, results[nr].err) {
+			t.Errorf("Test #%d: Expected %v, got %v", nr+1, results[nr].err, err)
+		} else if err == nil {
+			session, _ := fields.LoginOptions.Get("session")
+			if mock.Username != "user" || mock.Password != "pass" || fields.Login != "user" || session != results[nr].session {
+				t.Errorf("Test #%d: Expected user/pass with session %s, got %s/%s with %v", nr+1, results[nr].session, mock.Username, mock.Password, fields.LoginOptions)
+			}
+		}
+		PutSocks4Request(req)
+	}
+}
+
+func TestBackendUnavailable(t *testing.T) {
+	down := errors.New("down")
+	backends := []*authmock.Backend{
+		{IPAuthErr: down},
+		{CredentialsAuthErr: down},
+	}
+	requests := [][]byte{
+		[]byte("\x01\x00\x50\x01\x02\x03\x04\x00"),
+		[]byte("\x01\x00\x50\x01\x02\x03\x04a.b\x00"),
+	}
+	errChan := make(chan error)
+	for nr, backend := range backends {
+		c1, c2 := net.Pipe()
+		req := GetSocks4Request()
+		fields := req.Fields
+		fields.UserIP = "4.3.2.1"
+		fields.ProxyIP = "1.2.3.4"
+		fields.Conn = c1
+		fields.ProxyConfig = backend
+		fields.Timeouts = &corestructs.Timeouts{Handshake: 1 * time.Second}
+		go c2.Write(requests[nr])
+		go func() {
+			errChan <- req.ReadContext(context.Background())
+		}()
+		err := <-errChan
+		c1.Close()
+		c2.Close()
+		var authErr *ErrAuthorization
+		if !errors.Is(err, auth.ErrBackendUnavailable) || !errors.As(err, &authErr) {
+			t.Errorf("Test #%d: Expected ErrBackendUnavailable, got %v", nr+1, err)
+		}
+		PutSocks4Request(req)
+	}
+}
+
+var errBadTestToken = errors.New("bad test token")
+
+type testTokens map[string]auth.TokenResult
+
+func (tokens testTokens) IsToken(s string) bool {
+	return strings.HasPrefix(s, "tok.")
+}
+
+func (tokens testTokens) VerifyToken(ctx context.Context, proxyIP, token string) (auth.TokenResult, error) {
+	result, ok := tokens[token]
+	if !ok {
+		return result, errBadTestToken
+	}
+
+	return result, nil
+}
+
+func TestTokenAuth(t *testing.T) {
+	tokens := testTokens{"tok.good.v1": {AuthResult: authorizer.AuthResult{OK: true, PackageID: 2, UserID: 22}}}
+	testCases := []struct {
+		identd string
+		err    error
+		userID int
+	}{
+		{"user.tok.good.v1", nil, 22},
+		{"user.tok.bad", errBadTestToken, 0},
+		{"user.pass", nil, 11},
+	}
+	errChan := make(chan error)
+	for nr, tc := range testCases {
+		c1, c2 := net.Pipe()
+		mock := &authmock.Mock{
+			IPAuthRet:          authorizer.BadAuthResult,
+			CredentialsAuthRet: authorizer.AuthResult{OK: true, PackageID: 1, UserID: 11},
+		}
+		req := GetSocks4Request()
+		fields := req.Fields
+		fields.UserIP = "4.3.2.1"
+		fields.ProxyIP = "1.2.3.4"
+		fields.Conn = c1
+		fields.ProxyConfig = mock
+		fields.TokenVerifier = tokens
+		fields.Timeouts = &corestructs.Timeouts{Handshake: 1 * time.Second}
+		go c2.Write([]byte("\x01\x00\x50\x01\x02\x03\x04" + tc.identd + "\x00"))
+		go func() {
+			errChan <- req.Read()
+		}()
+		err := <-errChan
+		c1.Close()
+		c2.Close()
+		var authErr *ErrAuthorization
+		if !errors.Is(err, tc.err) || (err != nil && !errors.As(err, &authErr)) {
+			t.Errorf("Test #%d: Expected %v, got %v", nr+1, tc.err, err)
+		} else if err == nil && (fields.UserID != tc.userID || fields.Login != "user") {
+			t.Errorf("Test #%d: Expected user %d, got %s %d", nr+1, tc.userID, fields.Login, fields.UserID)
+		}
+		PutSocks4Request(req)
+	}
+}
+
+func TestSignedBackconnect(t *testing.T) {
+	secret := []byte("0123456789abcdef0123456789abcdef")
+	verifier := &backconnect.Verifier{Keys: []backconnect.Key{{ID: 1, HMAC: secret}}}
+	request, err := (&backconnect.Signer{KeyID: 1, HMAC: secret}).Append([]byte("\x01\x00\x50\x01\x02\x03\x04a.b\x00"), 2, 22, net.ParseIP("2001:db8::5"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCases := []struct {
+		verifier *backconnect.Verifier
+		err      error
+	}{
+		{verifier, nil},
+		{verifier, backconnect.ErrReplayed},
+		{nil, backconnect.ErrNotConfigured},
+	}
+	errChan := make(chan error)
+	for nr, tc := range testCases {
+		c1, c2 := net.Pipe()
+		req := GetSocks4Request()
+		fields := req.Fields
+		fields.UserIP = "4.3.2.1"
+		fields.ProxyIP = "1.2.3.4"
+		fields.Conn = c1
+		fields.ProxyConfig = &authmock.Mock{
+			IPAuthRet:          authorizer.BadAuthResult,
+			CredentialsAuthRet: authorizer.AuthResult{OK: true, PackageID: 1, UserID: 11, Backconnect: true},
+		}
+		fields.BackconnectVerifier = tc.verifier
+		fields.Timeouts = &corestructs.Timeouts{Handshake: 1 * time.Second}
+		go c2.Write(request)
+		go func() {
+			errChan <- req.Read()
+		}()
+		err := <-errChan
+		c1.Close()
+		c2.Close()
+		var rejected *backconnect.ErrRejected
+		if !errors.Is(err, tc.err) || (errors.Is(err, backconnect.ErrReplayed) && !errors.As(err, &rejected)) {
+			t.Errorf("Test #%d: Expected %v, got %v", nr+1, tc.err, err)
+		} else if err == nil && (fields.PackageID != 2 || fields.UserID != 22 || fields.UserIP != "2001:db8::5") {
+			t.Errorf("Test #%d: Expected 2 22 2001:db8::5, got %d %d %s", nr+1, fields.PackageID, fields.UserID, fields.UserIP)
+		}
+		PutSocks4Request(req)
+	}
+}
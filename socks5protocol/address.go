@@ -28,3 +28,37 @@ func (addr *Address) fillValues() {
 		addr.StrAddrWithPort = fmt.Sprintf("%s:%d", addr.StrAddr, addr.Port)
 	}
 }
+
+func AddressFromHost(host string, port uint16) *Address {
+	addr := &Address{Port: port}
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			addr.Type = IPv4Address
+			addr.Value = ip4
+		} else {
+			addr.Type = IPv6Address
+			addr.Value = ip.To16()
+		}
+	} else {
+		addr.Type = HostnameAddress
+		addr.Value = []byte(host)
+	}
+	addr.fillValues()
+
+	return addr
+}
+
+// appendBytes appends addr in the wire format, hostnames longer than 255
+// bytes don't fit in it.
+func (addr *Address) appendBytes(b []byte) ([]byte, error) {
+	b = append(b, addr.Type)
+	if addr.Type == HostnameAddress {
+		if len(addr.Value) > 255 {
+			return nil, ErrHostTooLong
+		}
+		b = append(b, byte(len(addr.Value)))
+	}
+	b = append(b, addr.Value...)
+
+	return append(b, byte(addr.Port>>8), byte(addr.Port&0xFF)), nil
+}
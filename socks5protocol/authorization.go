@@ -1,8 +1,16 @@
 package socks5protocol
 
-import "github.com/duratarskeyk/go-common-utils/authorizer"
+import (
+	"context"
 
-func authorize(req *Socks5Request) error {
+	"github.com/duratarskeyk/proxymux/auth"
+)
+
+// authorize runs method selection and authorization. When the auth backend
+// is unavailable a client that chose no authentication is let through to
+// the request stage and sent a general failure reply, a client that sent
+// credentials gets a failure status.
+func authorize(ctx context.Context, req *Socks5Request) error {
 	fields := req.Fields
 	proxyIP := fields.ProxyIP
 
@@ -33,9 +41,10 @@ func authorize(req *Socks5Request) error {
 	}
 
 	fields.Login = ""
+	fields.LoginOptions = fields.LoginOptions[:0]
 	fields.Password = ""
-	auth := fields.ProxyConfig.(authorizer.Authorizer)
-	result := auth.IPAuth(proxyIP, fields.UserIP)
+	backend := auth.From(fields.ProxyConfig)
+	result, ipAuthErr := backend.IPAuth(ctx, proxyIP, fields.UserIP)
 	doFakeCredentialsAuth := false
 	if result.OK {
 		fields.PackageID = result.PackageID
@@ -74,7 +83,20 @@ func authorize(req *Socks5Request) error {
 		fields.Password = string(password)
 
 		if !doFakeCredentialsAuth {
-			result = auth.CredentialsAuth(proxyIP, fields.Login, fields.Password)
+			if err = fields.ParseLogin(); err != nil {
+				req.handshakeConn.Write(authFailure)
+				return err
+			}
+			var isToken bool
+			if result, isToken, err = fields.TokenAuth(ctx); isToken {
+				if err != nil {
+					req.handshakeConn.Write(authFailure)
+					return err
+				}
+			} else if result, err = backend.CredentialsAuth(ctx, proxyIP, fields.Login, fields.Password); err != nil {
+				req.handshakeConn.Write(authFailure)
+				return auth.NewErrBackend(err)
+			}
 			if !result.OK {
 				if _, err = req.handshakeConn.Write(authFailure); err != nil {
 					return err
@@ -91,6 +113,16 @@ func authorize(req *Socks5Request) error {
 		return err
 	}
 
+	if ipAuthErr != nil && noAuthMethodPresent {
+		if _, err = req.handshakeConn.Write(noAuth); err != nil {
+			return err
+		}
+		if readCommand(req) == nil {
+			SendFailReply(req, ServerFailure)
+		}
+		return auth.NewErrBackend(ipAuthErr)
+	}
+
 	if _, err = req.handshakeConn.Write(noAcceptable); err != nil {
 		return err
 	}
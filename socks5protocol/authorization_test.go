@@ -2,6 +2,7 @@ package socks5protocol
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"net"
 	"testing"
@@ -41,7 +42,7 @@ func TestAuthorize(t *testing.T) {
 		},
 		handshakeConn: readWriter{conn: c1, timeout: 30 * time.Second},
 	}
-	err := authorize(req)
+	err := authorize(context.Background(), req)
 	if err != nil {
 		t.Fatalf("Expected err to be nil, got %s", err)
 	}
@@ -84,7 +85,7 @@ func TestAuthorize(t *testing.T) {
 			},
 			handshakeConn: readWriter{conn: c1, timeout: 30 * time.Second},
 		}
-		err := authorize(req)
+		err := authorize(context.Background(), req)
 		idChan <- req.Fields.PackageID
 		errChan <- err
 	}()
@@ -133,7 +134,7 @@ func TestAuthorize(t *testing.T) {
 			},
 			handshakeConn: readWriter{conn: c1, timeout: 30 * time.Second},
 		}
-		err := authorize(req)
+		err := authorize(context.Background(), req)
 		idChan <- req.Fields.PackageID
 		errChan <- err
 	}()
@@ -176,7 +177,7 @@ func TestAuthorize(t *testing.T) {
 		},
 		handshakeConn: readWriter{conn: c1, timeout: 30 * time.Second},
 	}
-	err = authorize(req)
+	err = authorize(context.Background(), req)
 	ret = <-retChan
 	if !bytes.Equal(ret, noAcceptable) {
 		t.Fatalf("Expected no acceptable auth to be returned")
@@ -219,7 +220,7 @@ func TestAuthorize(t *testing.T) {
 			},
 			handshakeConn: readWriter{conn: c1, timeout: 30 * time.Second},
 		}
-		err := authorize(req)
+		err := authorize(context.Background(), req)
 		idChan <- req.Fields.PackageID
 		errChan <- err
 	}()
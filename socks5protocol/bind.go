@@ -0,0 +1,52 @@
+package socks5protocol
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+
+	"github.com/duratarskeyk/proxymux/internal/bindlistener"
+	"github.com/duratarskeyk/proxymux/relay"
+)
+
+// Bind serves a BIND request. It listens on the egress IP, sends the first
+// reply with the bound address and waits Timeouts.Connect for one inbound
+// connection from the requested peer, one Fields.Destinations allows. After
+// the second reply both conns are handed to relay.Tunnel.
+func Bind(ctx context.Context, req *Socks5Request) error {
+	fields := req.Fields
+	if req.Command != BindCommand {
+		return ErrUnkownCommand
+	}
+
+	ln, bound, err := bindlistener.Listen("tcp", fields)
+	if err != nil {
+		SendFailReply(req, ServerFailure)
+		return err
+	}
+	defer ln.Close()
+
+	if err = SendSuccessReply(req, addressFromIP(bound.IP, uint16(bound.Port))); err != nil {
+		return err
+	}
+
+	peer, err := bindlistener.Accept(ctx, ln, fields.HostIP, fields.Timeouts.Connect, fields.Destinations)
+	if err != nil {
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			SendFailReply(req, TTLExpired)
+		} else {
+			SendFailReply(req, ServerFailure)
+		}
+		return err
+	}
+	defer peer.Close()
+	ln.Close()
+
+	peerAddr := peer.RemoteAddr().(*net.TCPAddr)
+	if err = SendSuccessReply(req, addressFromIP(peerAddr.IP, uint16(peerAddr.Port))); err != nil {
+		return err
+	}
+
+	return relay.Tunnel(ctx, fields, peer)
+}
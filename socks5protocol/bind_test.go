@@ -0,0 +1,169 @@
+package socks5protocol
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/duratarskeyk/proxymux/acl"
+	"github.com/duratarskeyk/proxymux/corestructs"
+)
+
+func controlPair(t *testing.T) (net.Conn, net.Conn) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return client, server
+}
+
+func readReply(t *testing.T, conn net.Conn) (byte, *net.TCPAddr) {
+	reply := make([]byte, 10)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatal(err)
+	}
+
+	return reply[1], &net.TCPAddr{IP: net.IP(reply[4:8]), Port: int(reply[8])<<8 | int(reply[9])}
+}
+
+func TestBind(t *testing.T) {
+	client, server := controlPair(t)
+	defer client.Close()
+	defer server.Close()
+
+	req := GetSocks5Request()
+	req.Command = BindCommand
+	req.Fields.Conn = server
+	req.Fields.ProxyIP = "127.0.0.1"
+	req.Fields.HostIP = net.IPv4(127, 0, 0, 1)
+	req.Fields.Timeouts = &corestructs.Timeouts{Connect: time.Second, Read: time.Second, Write: time.Second}
+	var controls atomic.Int32
+	req.Fields.DialerTCP = &net.Dialer{Control: func(network, address string, c syscall.RawConn) error {
+		controls.Add(1)
+		return nil
+	}}
+	errCh := make(chan error)
+	go func() {
+		errCh <- Bind(context.Background(), req)
+	}()
+
+	code, bound := readReply(t, client)
+	if code != SuccessReply {
+		t.Fatalf("Expected first reply to succeed, got %d", code)
+	}
+	if controls.Load() != 1 {
+		t.Errorf("Expected DialerTCP.Control to run for the listener, ran %d times", controls.Load())
+	}
+	peer, err := net.Dial("tcp", bound.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	code, peerAddr := readReply(t, client)
+	if code != SuccessReply {
+		t.Fatalf("Expected second reply to succeed, got %d", code)
+	}
+	if peerAddr.String() != peer.LocalAddr().String() {
+		t.Errorf("Expected peer address %s, got %s", peer.LocalAddr(), peerAddr)
+	}
+
+	peer.Write([]byte("from peer"))
+	buf := make([]byte, 9)
+	io.ReadFull(client, buf)
+	if !bytes.Equal(buf, []byte("from peer")) {
+		t.Errorf("Expected client to receive %q, got %q", "from peer", buf)
+	}
+	client.Write([]byte("hi"))
+	io.ReadFull(peer, buf[:2])
+	if !bytes.Equal(buf[:2], []byte("hi")) {
+		t.Errorf("Expected peer to receive %q, got %q", "hi", buf[:2])
+	}
+
+	client.Close()
+	peer.Close()
+	if err := <-errCh; err != nil {
+		t.Errorf("Expected nil error, got %s", err)
+	}
+	if req.Fields.Upload != 2 || req.Fields.Download != 9 {
+		t.Errorf("Expected upload 2 and download 9, got %d and %d", req.Fields.Upload, req.Fields.Download)
+	}
+	PutSocks5Request(req)
+}
+
+func TestBindTimeout(t *testing.T) {
+	client, server := controlPair(t)
+	defer client.Close()
+	defer server.Close()
+
+	req := GetSocks5Request()
+	req.Command = BindCommand
+	req.Fields.Conn = server
+	req.Fields.ProxyIP = "127.0.0.1"
+	req.Fields.HostIP = net.IPv4(127, 0, 0, 2)
+	req.Fields.Timeouts = &corestructs.Timeouts{Connect: 200 * time.Millisecond, Write: time.Second}
+	errCh := make(chan error)
+	go func() {
+		errCh <- Bind(context.Background(), req)
+	}()
+
+	_, bound := readReply(t, client)
+	// connections from unexpected peers are dropped
+	if peer, err := net.Dial("tcp", bound.String()); err == nil {
+		defer peer.Close()
+	}
+	code, _ := readReply(t, client)
+	if code != TTLExpired {
+		t.Errorf("Expected reply code %d, got %d", TTLExpired, code)
+	}
+	if err := <-errCh; !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("Expected %s, got %v", os.ErrDeadlineExceeded, err)
+	}
+	PutSocks5Request(req)
+}
+
+func TestBindDeniedPeer(t *testing.T) {
+	client, server := controlPair(t)
+	defer client.Close()
+	defer server.Close()
+
+	req := GetSocks5Request()
+	req.Command = BindCommand
+	req.Fields.Conn = server
+	req.Fields.ProxyIP = "127.0.0.1"
+	req.Fields.HostIP = net.IPv4zero
+	req.Fields.Destinations = &acl.List{}
+	req.Fields.Timeouts = &corestructs.Timeouts{Connect: 200 * time.Millisecond, Write: time.Second}
+	errCh := make(chan error)
+	go func() {
+		errCh <- Bind(context.Background(), req)
+	}()
+
+	_, bound := readReply(t, client)
+	// a loopback peer is denied
+	if peer, err := net.Dial("tcp", bound.String()); err == nil {
+		defer peer.Close()
+	}
+	if code, _ := readReply(t, client); code != TTLExpired {
+		t.Errorf("Expected reply code %d, got %d", TTLExpired, code)
+	}
+	<-errCh
+	PutSocks5Request(req)
+}
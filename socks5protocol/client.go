@@ -0,0 +1,100 @@
+package socks5protocol
+
+import (
+	"io"
+	"net"
+)
+
+// ClientConnect runs the client side of a CONNECT handshake on conn, which
+// is connected to a SOCKS5 server. Username/password auth is offered when
+// username is not empty. It returns the address bound by the server.
+// Hostnames too long for the request fail with ErrHostTooLong before
+// anything is sent.
+func ClientConnect(conn net.Conn, username, password string, addr *Address) (*Address, error) {
+	request, err := addr.appendBytes([]byte{socks5Version, ConnectCommand, 0})
+	if err != nil {
+		return nil, err
+	}
+	greeting := []byte{socks5Version, 1, noAuthID}
+	if username != "" {
+		greeting = []byte{socks5Version, 2, noAuthID, userPassAuthID}
+	}
+	if _, err := conn.Write(greeting); err != nil {
+		return nil, err
+	}
+
+	header := []byte{0, 0, 0, 0}
+	if _, err := io.ReadFull(conn, header[:2]); err != nil {
+		return nil, err
+	}
+	if header[0] != socks5Version {
+		return nil, ErrVersionMismatch
+	}
+	switch header[1] {
+	case noAuthID:
+	case userPassAuthID:
+		if len(username) > 255 || len(password) > 255 {
+			return nil, ErrBadCredentials
+		}
+		auth := make([]byte, 0, 3+len(username)+len(password))
+		auth = append(auth, userAuthVersion, byte(len(username)))
+		auth = append(auth, username...)
+		auth = append(auth, byte(len(password)))
+		auth = append(auth, password...)
+		if _, err := conn.Write(auth); err != nil {
+			return nil, err
+		}
+		if _, err := io.ReadFull(conn, header[:2]); err != nil {
+			return nil, err
+		}
+		if header[0] != userAuthVersion {
+			return nil, ErrUserAuthVersionMismatch
+		}
+		if header[1] != authSuccessStatus {
+			return nil, ErrBadCredentials
+		}
+	default:
+		return nil, ErrNoAcceptableAuthMethod
+	}
+
+	if _, err := conn.Write(request); err != nil {
+		return nil, err
+	}
+
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return nil, err
+	}
+	if header[0] != socks5Version {
+		return nil, ErrVersionMismatch
+	}
+	if header[1] != SuccessReply {
+		return nil, &ErrReply{Code: header[1]}
+	}
+
+	var buf []byte
+	switch header[3] {
+	case IPv4Address:
+		buf = make([]byte, 7)
+	case IPv6Address:
+		buf = make([]byte, 19)
+	case HostnameAddress:
+		buf = make([]byte, 2)
+		if _, err := io.ReadFull(conn, buf[1:]); err != nil {
+			return nil, err
+		}
+		buf = append(buf, make([]byte, int(buf[1])+2)...)
+	default:
+		return nil, ErrUnknownAddressType
+	}
+	buf[0] = header[3]
+	start := 1
+	if header[3] == HostnameAddress {
+		start = 2
+	}
+	if _, err := io.ReadFull(conn, buf[start:]); err != nil {
+		return nil, err
+	}
+	bound, _, err := AddressFromSlice(buf)
+
+	return bound, err
+}
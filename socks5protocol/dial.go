@@ -0,0 +1,37 @@
+package socks5protocol
+
+import (
+	"context"
+	"net"
+
+	"github.com/duratarskeyk/proxymux/dialer"
+)
+
+// Dial connects to the requested target. On failure the matching reply is
+// sent to the client.
+func Dial(ctx context.Context, req *Socks5Request) (net.Conn, error) {
+	conn, err := dialer.Dial(ctx, req.Fields)
+	if err != nil {
+		SendFailReply(req, DialReplyCode(err))
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+func DialReplyCode(err error) byte {
+	switch dialer.Classify(err) {
+	case dialer.KindResolution, dialer.KindHostUnreachable:
+		return HostUnreachable
+	case dialer.KindConnectionRefused:
+		return ConnectionRefused
+	case dialer.KindNetworkUnreachable:
+		return NetworkUnreachable
+	case dialer.KindTimeout:
+		return TTLExpired
+	case dialer.KindDenied:
+		return RuleFailure
+	}
+
+	return ServerFailure
+}
@@ -13,6 +13,9 @@ var ErrUnknownAddressType = errors.New("unknown address type")
 var ErrUnkownCommand = errors.New("unknown command code received")
 var ErrSliceTooShort = errors.New("slice is too short")
 var ErrNoAuthMethodsOffered = errors.New("no auth methods offered")
+var ErrFragmentedDatagram = errors.New("fragmented udp datagram")
+var ErrIPv6Addr = errors.New("ipv6 destinations are not allowed")
+var ErrHostTooLong = errors.New("hostname longer than 255 bytes")
 
 type ErrAuthFailure struct {
 	err error
@@ -37,3 +40,11 @@ func (e *ErrCommandReadFailure) Error() string {
 func (e *ErrCommandReadFailure) Unwrap() error {
 	return e.err
 }
+
+type ErrReply struct {
+	Code byte
+}
+
+func (e *ErrReply) Error() string {
+	return fmt.Sprintf("SOCKS5 server replied with code %d", e.Code)
+}
@@ -1,8 +1,7 @@
 package socks5protocol
 
 import (
-	"fmt"
-	"net"
+	"context"
 
 	"github.com/duratarskeyk/proxymux/corestructs"
 	"go.uber.org/zap"
@@ -17,6 +16,13 @@ type Socks5Request struct {
 }
 
 func (req *Socks5Request) Read() error {
+	return req.ReadContext(context.Background())
+}
+
+// ReadContext reads the request passing ctx to the auth backend. Errors of
+// an unavailable backend match auth.ErrBackendUnavailable, a client that
+// chose no authentication is sent a general failure reply for them.
+func (req *Socks5Request) ReadContext(ctx context.Context) error {
 	fields := req.Fields
 	req.handshakeConn.conn = fields.Conn
 	req.handshakeConn.timeout = fields.Timeouts.Handshake
@@ -29,7 +35,7 @@ func (req *Socks5Request) Read() error {
 		zap.String("type", "SOCKS5"),
 	)
 
-	err := authorize(req)
+	err := authorize(ctx, req)
 	if err != nil {
 		return &ErrAuthFailure{err: err}
 	}
@@ -39,17 +45,17 @@ func (req *Socks5Request) Read() error {
 		return &ErrCommandReadFailure{err: err}
 	}
 
-	if req.Fields.Backconnect {
-		backconnectData := make([]byte, 12)
-		if _, err := req.handshakeConn.Read(backconnectData); err != nil {
+	if fields.IPv6Denied() {
+		SendFailReply(req, AddrTypeNotSupported)
+		return &ErrCommandReadFailure{err: ErrIPv6Addr}
+	}
+
+	if fields.Backconnect {
+		fields.PackageID, fields.UserID, fields.UserIP, err = fields.BackconnectVerifier.Read(&req.handshakeConn)
+		if err != nil {
 			return &ErrCommandReadFailure{err: err}
 		}
-		packageID := uint(backconnectData[0])<<24 | uint(backconnectData[1])<<16 | uint(backconnectData[2])<<8 | uint(backconnectData[3])
-		userID := uint(backconnectData[4])<<24 | uint(backconnectData[5])<<16 | uint(backconnectData[6])<<8 | uint(backconnectData[7])
-		req.Fields.PackageID = int(packageID)
-		req.Fields.UserID = int(userID)
-		req.Fields.UserIP = fmt.Sprintf("%d.%d.%d.%d", backconnectData[8], backconnectData[9], backconnectData[10], backconnectData[11])
-		req.Fields.LogFields[0].String = req.Fields.UserIP
+		fields.LogFields[0].String = fields.UserIP
 	}
 
 	fields.FillLogFields()
@@ -57,9 +63,7 @@ func (req *Socks5Request) Read() error {
 	fields.Download = req.handshakeConn.download
 	fields.Upload = req.handshakeConn.upload + 1 // first byte 5
 
-	proxyIPOctets := []byte(net.ParseIP(fields.ProxyIP).To4())
-	fields.ProxyIPNum = (uint32(proxyIPOctets[0]) << 24) | (uint32(proxyIPOctets[1]) << 16) |
-		(uint32(proxyIPOctets[2]) << 8) | uint32(proxyIPOctets[3])
+	fields.SetProxyAddr()
 
 	return nil
 }
@@ -1,16 +1,22 @@
 package socks5protocol
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"net"
 	"os"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 
 	"github.com/duratarskeyk/go-common-utils/authorizer"
+	"github.com/duratarskeyk/proxymux/auth"
+	"github.com/duratarskeyk/proxymux/backconnect"
 	"github.com/duratarskeyk/proxymux/corestructs"
 	"github.com/duratarskeyk/proxymux/internal/authmock"
+	"github.com/duratarskeyk/proxymux/loginparams"
 )
 
 type goodTestCase struct {
@@ -82,6 +88,7 @@ func TestGoodRequests(t *testing.T) {
 		fields.UserID = 0
 		fields.Conn = c1
 		fields.ProxyConfig = testCase.authMock
+		fields.BackconnectVerifier = &backconnect.Verifier{Legacy: true}
 		fields.Timeouts = &corestructs.Timeouts{Handshake: 30 * time.Second}
 		var wg sync.WaitGroup
 		wg.Add(1)
@@ -210,6 +217,7 @@ func TestBadRequests(t *testing.T) {
 			PackageID:   1,
 		},
 	}
+	fields.BackconnectVerifier = &backconnect.Verifier{Legacy: true}
 	fields.Timeouts = &corestructs.Timeouts{Handshake: 1 * time.Second}
 	go func() {
 		errCh <- req.Read()
@@ -227,3 +235,337 @@ func TestBadRequests(t *testing.T) {
 	c1.Close()
 	c2.Close()
 }
+
+func TestDualStackRequests(t *testing.T) {
+	v6Command := []byte{5, 1, 0, 4, 0x20, 1, 0xd, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 2, 0, 80}
+	testCases := []struct {
+		policy  corestructs.IPv6Policy
+		command []byte
+
+		host   string
+		userIP string
+		reply  byte
+		err    error
+	}{
+		{
+			corestructs.IPv6Allow,
+			append(append([]byte{}, v6Command...), 0, 0, 0, 2, 0, 0, 0, 22, 0, 0, 0, 0, 0x20, 1, 0xd, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 5),
+			"2001:db8::2",
+			"2001:db8::5",
+			0,
+			nil,
+		},
+		{
+			corestructs.IPv6Allow,
+			[]byte{5, 1, 0, 1, 2, 2, 2, 2, 0, 80, 0, 0, 0, 2, 0, 0, 0, 22, 5, 5, 5, 5},
+			"2.2.2.2",
+			"5.5.5.5",
+			0,
+			nil,
+		},
+		{
+			corestructs.IPv6Deny,
+			v6Command,
+			"",
+			"",
+			AddrTypeNotSupported,
+			ErrIPv6Addr,
+		},
+	}
+	errCh := make(chan error)
+	for nr, testCase := range testCases {
+		c1, c2 := net.Pipe()
+		req := GetSocks5Request()
+		fields := req.Fields
+		fields.UserIP = "2001:db8::3"
+		fields.ProxyIP = "2001:db8::1"
+		fields.IPv6Policy = testCase.policy
+		fields.Conn = c1
+		fields.ProxyConfig = &authmock.Mock{
+			IPAuthRet: authorizer.BadAuthResult,
+			CredentialsAuthRet: authorizer.AuthResult{
+				OK:          true,
+				Backconnect: true,
+			},
+		}
+		fields.BackconnectVerifier = &backconnect.Verifier{Legacy: true}
+		fields.Timeouts = &corestructs.Timeouts{Handshake: 5 * time.Second, Write: 5 * time.Second}
+		go func() {
+			errCh <- req.Read()
+		}()
+		c2.Write([]byte{1, 2})
+		c2.Read([]byte{0, 0})
+		c2.Write([]byte{1, 1, 'a', 1, 'b'})
+		c2.Read([]byte{0, 0})
+		go c2.Write(testCase.command)
+		var reply []byte
+		if testCase.reply != 0 {
+			reply = make([]byte, 10)
+			c2.Read(reply)
+		}
+		err := <-errCh
+		c1.Close()
+		c2.Close()
+		if !errors.Is(err, testCase.err) {
+			t.Errorf("Test #%d: Expected %v, got %v", nr+1, testCase.err, err)
+		} else if err == nil {
+			if fields.Host != testCase.host || fields.UserIP != testCase.userIP {
+				t.Errorf("Test #%d: Expected host %s and user ip %s, got %s and %s", nr+1, testCase.host, testCase.userIP, fields.Host, fields.UserIP)
+			}
+			if fields.ProxyIPNum != 0 || fields.ProxyAddr.String() != "2001:db8::1" {
+				t.Errorf("Test #%d: Bad proxy addr %s, num %d", nr+1, fields.ProxyAddr, fields.ProxyIPNum)
+			}
+		} else if reply[1] != testCase.reply {
+			t.Errorf("Test #%d: Expected reply %d, got %d", nr+1, testCase.reply, reply[1])
+		}
+		PutSocks5Request(req)
+	}
+}
+
+func TestLoginOptions(t *testing.T) {
+	usernames := []string{"user-country-de", "user-country", "user-country"}
+	results := []struct {
+		ipAuth  bool
+		err     error
+		status  byte
+		country string
+	}{
+		{false, nil, authSuccessStatus, "de"},
+		{false, loginparams.ErrMissingValue, authFailureStatus, ""},
+		// the username isn't parsed for clients authorized by IP
+		{true, nil, authSuccessStatus, ""},
+	}
+	errCh := make(chan error)
+	for nr, username := range usernames {
+		c1, c2 := net.Pipe()
+		mock := &authmock.Mock{
+			IPAuthRet:          authorizer.BadAuthResult,
+			CredentialsAuthRet: authorizer.AuthResult{OK: true, PackageID: 1, UserID: 11},
+		}
+		if results[nr].ipAuth {
+			mock.IPAuthRet = authorizer.AuthResult{OK: true, PackageID: 1, UserID: 11}
+		}
+		req := GetSocks5Request()
+		fields := req.Fields
+		fields.UserIP = "4.3.2.1"
+		fields.ProxyIP = "1.2.3.4"
+		fields.Conn = c1
+		fields.ProxyConfig = mock
+		fields.LoginParser = &loginparams.Parser{Keys: []string{"country"}}
+		fields.Timeouts = &corestructs.Timeouts{Handshake: 5 * time.Second}
+		go func() {
+			errCh <- req.Read()
+		}()
+		c2.Write([]byte{1, 2})
+		c2.Read([]byte{0, 0})
+		c2.Write(append(append([]byte{1, byte(len(username))}, username...), 1, 'p'))
+		status := []byte{0, 0}
+		c2.Read(status)
+		if status[1] == authSuccessStatus {
+			c2.Write([]byte{5, 1, 0, 1, 2, 2, 2, 2, 0, 80})
+		}
+		err := <-errCh
+		c1.Close()
+		c2.Close()
+		if !errors.Is(err, results[nr].err) || status[1] != results[nr].status {
+			t.Errorf("Test #%d: Expected %v and status %d, got %v and %d", nr+1, results[nr].err, results[nr].status, err, status[1])
+		} else if err == nil && !results[nr].ipAuth {
+			country, _ := fields.LoginOptions.Get("country")
+			if mock.Username != "user" || fields.Login != "user" || country != results[nr].country {
+				t.Errorf("Test #%d: Expected user with country %s, got %s with %v", nr+1, results[nr].country, mock.Username, fields.LoginOptions)
+			}
+		}
+		PutSocks5Request(req)
+	}
+}
+
+func TestBackendUnavailable(t *testing.T) {
+	down := errors.New("down")
+	testCases := []struct {
+		backend     *authmock.Backend
+		methods     []byte
+		authProcess []byte
+	}{
+		{&authmock.Backend{IPAuthErr: down}, []byte{1, 0}, nil},
+		{&authmock.Backend{IPAuthErr: down, CredentialsAuthErr: down}, []byte{2, 0, 2}, []byte{1, 1, 'a', 1, 'b'}},
+		{&authmock.Backend{CredentialsAuthErr: down}, []byte{1, 2}, []byte{1, 1, 'a', 1, 'b'}},
+	}
+	errCh := make(chan error)
+	for nr, testCase := range testCases {
+		c1, c2 := net.Pipe()
+		req := GetSocks5Request()
+		fields := req.Fields
+		fields.UserIP = "4.3.2.1"
+		fields.ProxyIP = "1.2.3.4"
+		fields.Conn = c1
+		fields.ProxyConfig = testCase.backend
+		fields.Timeouts = &corestructs.Timeouts{Handshake: 5 * time.Second, Write: 5 * time.Second}
+		go func() {
+			errCh <- req.ReadContext(context.Background())
+		}()
+		c2.Write(testCase.methods)
+		c2.Read([]byte{0, 0})
+		if testCase.authProcess != nil {
+			// the failure status ends the connection, no command follows
+			status := []byte{0, 0}
+			c2.Write(testCase.authProcess)
+			c2.Read(status)
+			if err := <-errCh; !errors.Is(err, auth.ErrBackendUnavailable) || !errors.Is(err, down) {
+				t.Errorf("Test #%d: Expected ErrBackendUnavailable, got %v", nr+1, err)
+			}
+			if status[1] != authFailureStatus {
+				t.Errorf("Test #%d: Expected failure status, got %d", nr+1, status[1])
+			}
+			c1.Close()
+			c2.Close()
+			PutSocks5Request(req)
+			continue
+		}
+		c2.Write([]byte{5, 1, 0, 1, 2, 2, 2, 2, 0, 80})
+		reply := make([]byte, 10)
+		c2.Read(reply)
+		err := <-errCh
+		c1.Close()
+		c2.Close()
+		if !errors.Is(err, auth.ErrBackendUnavailable) || !errors.Is(err, down) {
+			t.Errorf("Test #%d: Expected ErrBackendUnavailable, got %v", nr+1, err)
+		}
+		if reply[1] != ServerFailure {
+			t.Errorf("Test #%d: Expected general failure reply, got %d", nr+1, reply[1])
+		}
+		PutSocks5Request(req)
+	}
+}
+
+var errBadTestToken = errors.New("bad test token")
+
+type testTokens map[string]auth.TokenResult
+
+func (tokens testTokens) IsToken(s string) bool {
+	return strings.HasPrefix(s, "tok.")
+}
+
+func (tokens testTokens) VerifyToken(ctx context.Context, proxyIP, token string) (auth.TokenResult, error) {
+	result, ok := tokens[token]
+	if !ok {
+		return result, errBadTestToken
+	}
+
+	return result, nil
+}
+
+func TestTokenAuth(t *testing.T) {
+	tokens := testTokens{"tok.good": {
+		AuthResult: authorizer.AuthResult{OK: true, PackageID: 2, UserID: 22, Backconnect: false},
+		Login:      "tokenuser",
+		Options:    loginparams.Options{{Key: "country", Value: "us"}},
+	}}
+	testCases := []struct {
+		username string
+		password string
+		err      error
+		status   byte
+		login    string
+		userID   int
+		options  string
+	}{
+		{"any-session-s1", "tok.good", nil, authSuccessStatus, "tokenuser", 22, "[{country us} {session s1}]"},
+		// the token's options win
+		{"any-country-de", "tok.good", nil, authSuccessStatus, "tokenuser", 22, "[{country us}]"},
+		{"user", "tok.bad", errBadTestToken, authFailureStatus, "", 0, ""},
+		// passwords still go to the backend
+		{"user", "pass", nil, authSuccessStatus, "user", 11, "[]"},
+	}
+	errCh := make(chan error)
+	for nr, tc := range testCases {
+		c1, c2 := net.Pipe()
+		mock := &authmock.Mock{
+			IPAuthRet:          authorizer.BadAuthResult,
+			CredentialsAuthRet: authorizer.AuthResult{OK: true, PackageID: 1, UserID: 11},
+		}
+		req := GetSocks5Request()
+		fields := req.Fields
+		fields.UserIP = "4.3.2.1"
+		fields.ProxyIP = "1.2.3.4"
+		fields.Conn = c1
+		fields.ProxyConfig = mock
+		fields.LoginParser = &loginparams.Parser{Keys: []string{"country", "session"}}
+		fields.TokenVerifier = tokens
+		fields.Timeouts = &corestructs.Timeouts{Handshake: 5 * time.Second}
+		go func() {
+			errCh <- req.Read()
+		}()
+		c2.Write([]byte{1, 2})
+		c2.Read([]byte{0, 0})
+		c2.Write(append(append(append([]byte{1, byte(len(tc.username))}, tc.username...), byte(len(tc.password))), tc.password...))
+		status := []byte{0, 0}
+		c2.Read(status)
+		if status[1] == authSuccessStatus {
+			c2.Write([]byte{5, 1, 0, 1, 2, 2, 2, 2, 0, 80})
+		}
+		err := <-errCh
+		c1.Close()
+		c2.Close()
+		if !errors.Is(err, tc.err) || status[1] != tc.status {
+			t.Errorf("Test #%d: Expected %v and status %d, got %v and %d", nr+1, tc.err, tc.status, err, status[1])
+		} else if err == nil {
+			if fields.Login != tc.login || fields.UserID != tc.userID || fmt.Sprint(fields.LoginOptions) != tc.options {
+				t.Errorf("Test #%d: Expected %s (%d) with %s, got %s (%d) with %v", nr+1, tc.login, tc.userID, tc.options, fields.Login, fields.UserID, fields.LoginOptions)
+			}
+			if tc.password != "pass" && mock.Username != "" {
+				t.Errorf("Test #%d: Expected the token not to reach the backend", nr+1)
+			}
+		}
+		PutSocks5Request(req)
+	}
+}
+
+func TestSignedBackconnect(t *testing.T) {
+	secret := []byte("0123456789abcdef0123456789abcdef")
+	verifier := &backconnect.Verifier{Keys: []backconnect.Key{{ID: 1, HMAC: secret}}}
+	envelope, err := (&backconnect.Signer{KeyID: 1, HMAC: secret}).Append([]byte{5, 1, 0, 1, 2, 2, 2, 2, 0, 78}, 2, 22, net.ParseIP("5.5.5.5"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCases := []struct {
+		verifier *backconnect.Verifier
+		err      error
+	}{
+		{verifier, nil},
+		{verifier, backconnect.ErrReplayed},
+		{nil, backconnect.ErrNotConfigured},
+	}
+	errCh := make(chan error)
+	for nr, tc := range testCases {
+		c1, c2 := net.Pipe()
+		req := GetSocks5Request()
+		fields := req.Fields
+		fields.UserIP = "4.3.2.1"
+		fields.ProxyIP = "1.2.3.4"
+		fields.Conn = c1
+		fields.ProxyConfig = &authmock.Mock{
+			IPAuthRet:          authorizer.BadAuthResult,
+			CredentialsAuthRet: authorizer.AuthResult{OK: true, PackageID: 1, UserID: 11, Backconnect: true},
+		}
+		fields.BackconnectVerifier = tc.verifier
+		fields.Timeouts = &corestructs.Timeouts{Handshake: 5 * time.Second}
+		go func() {
+			errCh <- req.Read()
+		}()
+		c2.Write([]byte{1, 2})
+		c2.Read([]byte{0, 0})
+		c2.Write([]byte{1, 1, 'a', 1, 'b'})
+		c2.Read([]byte{0, 0})
+		go c2.Write(envelope)
+		err := <-errCh
+		c1.Close()
+		c2.Close()
+		var rejected *backconnect.ErrRejected
+		if !errors.Is(err, tc.err) || (errors.Is(err, backconnect.ErrReplayed) && !errors.As(err, &rejected)) {
+			t.Errorf("Test #%d: Expected %v, got %v", nr+1, tc.err, err)
+		} else if err == nil && (fields.PackageID != 2 || fields.UserID != 22 || fields.UserIP != "5.5.5.5") {
+			t.Errorf("Test #%d: Expected 2 22 5.5.5.5, got %d %d %s", nr+1, fields.PackageID, fields.UserID, fields.UserIP)
+		}
+		PutSocks5Request(req)
+	}
+}
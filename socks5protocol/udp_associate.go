@@ -0,0 +1,403 @@
+package socks5protocol
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/duratarskeyk/proxymux/corestructs"
+	"github.com/duratarskeyk/proxymux/resolver"
+)
+
+const (
+	maxUDPDatagram = 65535
+	// maxUDPTargets bounds the targets and the resolved hostnames of an
+	// association, datagrams to new ones are dropped while it's full
+	maxUDPTargets = 1024
+	// udpTargetTTL is how long a target is remembered after the last
+	// datagram sent to it and a resolved hostname is reused
+	udpTargetTTL = 2 * time.Minute
+	// maxUDPLookups bounds the hostnames resolved at once, datagrams to
+	// other new hostnames are dropped meanwhile
+	maxUDPLookups    = 8
+	udpLookupTimeout = 5 * time.Second
+)
+
+type resolvedTarget struct {
+	target  netip.AddrPort
+	expires time.Time
+}
+
+type udpAssociation struct {
+	req *Socks5Request
+	ctx context.Context
+
+	relayConn  *net.UDPConn
+	egressConn *net.UDPConn
+
+	clientIP   netip.Addr
+	clientPort uint16
+
+	mu         sync.Mutex
+	clientAddr netip.AddrPort
+	targets    map[netip.AddrPort]time.Time
+	resolved   map[string]resolvedTarget
+	lookups    map[string]struct{}
+	nextSweep  time.Time
+	wg         sync.WaitGroup
+}
+
+// UDPAssociate serves a UDP ASSOCIATE request. It binds a relay socket on the
+// proxy IP, replies with its address and relays RFC 1928 encapsulated
+// datagrams until the control connection is closed or ctx is canceled.
+// Datagrams to targets Fields.Destinations denies are dropped. Hostnames are
+// resolved with Fields.Resolver when set, in the background, the datagram
+// that started a lookup is sent once it's done.
+// Datagram sizes, headers included, are added to Fields.Upload and
+// Fields.Download.
+func UDPAssociate(ctx context.Context, req *Socks5Request) error {
+	fields := req.Fields
+	if req.Command != AssociateCommand {
+		return ErrUnkownCommand
+	}
+
+	// lookups end with the association
+	lookupCtx, cancelLookups := context.WithCancel(ctx)
+	defer cancelLookups()
+	a := &udpAssociation{
+		req:      req,
+		ctx:      lookupCtx,
+		targets:  make(map[netip.AddrPort]time.Time),
+		resolved: make(map[string]resolvedTarget),
+		lookups:  make(map[string]struct{}),
+	}
+	if tcpAddr, ok := fields.Conn.RemoteAddr().(*net.TCPAddr); ok {
+		a.clientIP, _ = netip.AddrFromSlice(tcpAddr.IP)
+		a.clientIP = a.clientIP.Unmap()
+	}
+	a.clientPort = fields.PortNum
+
+	relayIP := net.ParseIP(fields.ProxyIP)
+	if relayIP == nil {
+		if tcpAddr, ok := fields.Conn.LocalAddr().(*net.TCPAddr); ok {
+			relayIP = tcpAddr.IP
+		}
+	}
+	// the socket options of DialerUDP, freebind included, apply to both
+	var lc net.ListenConfig
+	egressAddr := &net.UDPAddr{}
+	if fields.DialerUDP != nil {
+		lc.Control = fields.DialerUDP.Control
+		if localAddr, ok := fields.DialerUDP.LocalAddr.(*net.UDPAddr); ok {
+			egressAddr = localAddr
+		}
+	}
+	var err error
+	a.relayConn, err = listenUDP(ctx, &lc, &net.UDPAddr{IP: relayIP})
+	if err != nil {
+		SendFailReply(req, ServerFailure)
+		return err
+	}
+	defer a.relayConn.Close()
+
+	a.egressConn, err = listenUDP(ctx, &lc, egressAddr)
+	if err != nil {
+		SendFailReply(req, ServerFailure)
+		return err
+	}
+	defer a.egressConn.Close()
+
+	bound := a.relayConn.LocalAddr().(*net.UDPAddr)
+	if err = SendSuccessReply(req, addressFromIP(bound.IP, uint16(bound.Port))); err != nil {
+		return err
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			fields.Conn.SetReadDeadline(time.Now())
+		case <-done:
+		}
+	}()
+
+	a.wg.Add(2)
+	go func() {
+		defer a.wg.Done()
+		a.fromClient()
+	}()
+	go func() {
+		defer a.wg.Done()
+		a.fromTargets()
+	}()
+
+	// the association lives as long as the control connection
+	buf := []byte{0}
+	for {
+		if _, err = fields.Conn.Read(buf); err != nil {
+			break
+		}
+	}
+	cancelLookups()
+	a.relayConn.Close()
+	a.egressConn.Close()
+	a.wg.Wait()
+
+	return ctx.Err()
+}
+
+func listenUDP(ctx context.Context, lc *net.ListenConfig, addr *net.UDPAddr) (*net.UDPConn, error) {
+	conn, err := lc.ListenPacket(ctx, "udp", addr.String())
+	if err != nil {
+		return nil, err
+	}
+
+	return conn.(*net.UDPConn), nil
+}
+
+func (a *udpAssociation) fromClient() {
+	buf := make([]byte, maxUDPDatagram)
+	for {
+		n, from, err := a.relayConn.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			return
+		}
+		from = netip.AddrPortFrom(from.Addr().Unmap(), from.Port())
+		if !a.acceptClient(from) {
+			continue
+		}
+		addr, payload, err := ParseUDPHeader(buf[:n])
+		if err != nil {
+			continue
+		}
+		if addr.Type != HostnameAddress {
+			ip, _ := netip.AddrFromSlice(addr.Value)
+			a.send(netip.AddrPortFrom(ip.Unmap(), addr.Port), payload, n)
+		} else if target, ok := a.cached(addr.StrAddrWithPort); ok {
+			a.send(target, payload, n)
+		} else {
+			a.resolve(addr, payload, n)
+		}
+	}
+}
+
+// send relays a datagram of size bytes, headers included, to target unless
+// it's denied or the association is tracking too many targets.
+func (a *udpAssociation) send(target netip.AddrPort, payload []byte, size int) {
+	if a.req.Fields.IPv6Policy == corestructs.IPv6Deny && !target.Addr().Is4() {
+		return
+	}
+	if !a.allowed(target) || !a.track(target) {
+		return
+	}
+	atomic.AddInt64(&a.req.Fields.Upload, int64(size))
+	a.egressConn.WriteToUDPAddrPort(payload, target)
+}
+
+// track lets replies of target through for udpTargetTTL, false when too
+// many other targets are tracked.
+func (a *udpAssociation) track(target netip.AddrPort) bool {
+	now := time.Now()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, ok := a.targets[target]; !ok && len(a.targets) >= maxUDPTargets {
+		if a.sweepLocked(now); len(a.targets) >= maxUDPTargets {
+			return false
+		}
+	}
+	a.targets[target] = now.Add(udpTargetTTL)
+
+	return true
+}
+
+// sweepLocked drops expired targets and hostnames, at most once a second.
+func (a *udpAssociation) sweepLocked(now time.Time) {
+	if now.Before(a.nextSweep) {
+		return
+	}
+	for target, expires := range a.targets {
+		if !now.Before(expires) {
+			delete(a.targets, target)
+		}
+	}
+	for host, r := range a.resolved {
+		if !now.Before(r.expires) {
+			delete(a.resolved, host)
+		}
+	}
+	a.nextSweep = now.Add(time.Second)
+}
+
+func (a *udpAssociation) fromTargets() {
+	buf := make([]byte, maxUDPDatagram)
+	for {
+		// leave room for the largest header in front of the payload
+		n, from, err := a.egressConn.ReadFromUDPAddrPort(buf[22:])
+		if err != nil {
+			return
+		}
+		from = netip.AddrPortFrom(from.Addr().Unmap(), from.Port())
+		a.mu.Lock()
+		expires, known := a.targets[from]
+		client := a.clientAddr
+		a.mu.Unlock()
+		if !known || !time.Now().Before(expires) || !client.IsValid() {
+			continue
+		}
+
+		headerLen := 10
+		if from.Addr().Is6() {
+			headerLen = 22
+		}
+		datagram := buf[22-headerLen : 22+n]
+		putUDPHeader(datagram, from)
+		if _, err = a.relayConn.WriteToUDPAddrPort(datagram, client); err == nil {
+			atomic.AddInt64(&a.req.Fields.Download, int64(len(datagram)))
+		}
+	}
+}
+
+func (a *udpAssociation) acceptClient(from netip.AddrPort) bool {
+	if a.clientIP.IsValid() && from.Addr() != a.clientIP {
+		return false
+	}
+	if a.clientPort != 0 && from.Port() != a.clientPort {
+		return false
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if !a.clientAddr.IsValid() {
+		a.clientAddr = from
+	}
+
+	return a.clientAddr == from
+}
+
+// allowed checks a datagram target with Fields.Destinations, denied ones
+// are dropped.
+func (a *udpAssociation) allowed(target netip.AddrPort) bool {
+	check := a.req.Fields.Destinations
+	if check == nil {
+		return true
+	}
+
+	return check.CheckAddr(target.Addr().AsSlice(), target.Port()) == nil
+}
+
+// cached returns the target a hostname was resolved to.
+func (a *udpAssociation) cached(hostPort string) (netip.AddrPort, bool) {
+	a.mu.Lock()
+	r, ok := a.resolved[hostPort]
+	a.mu.Unlock()
+
+	return r.target, ok && time.Now().Before(r.expires)
+}
+
+// resolve looks a hostname up in the background and sends the datagram
+// when it's done. Datagrams to a hostname being looked up are dropped.
+func (a *udpAssociation) resolve(addr *Address, payload []byte, size int) {
+	hostPort, host, port := addr.StrAddrWithPort, addr.StrAddr, addr.Port
+	a.mu.Lock()
+	if _, pending := a.lookups[hostPort]; pending || len(a.lookups) >= maxUDPLookups {
+		a.mu.Unlock()
+		return
+	}
+	a.lookups[hostPort] = struct{}{}
+	a.wg.Add(1)
+	a.mu.Unlock()
+
+	payload = append([]byte(nil), payload...)
+	go func() {
+		defer a.wg.Done()
+		target, ok := a.lookup(host, port)
+		now := time.Now()
+		a.mu.Lock()
+		delete(a.lookups, hostPort)
+		if ok && len(a.resolved) >= maxUDPTargets {
+			a.sweepLocked(now)
+		}
+		if ok && len(a.resolved) < maxUDPTargets {
+			a.resolved[hostPort] = resolvedTarget{target: target, expires: now.Add(udpTargetTTL)}
+		}
+		a.mu.Unlock()
+		if ok {
+			a.send(target, payload, size)
+		}
+	}()
+}
+
+// lookup resolves host with Fields.Resolver and ResolverFamily, or the
+// system resolver, and returns the first address, IPv4 only under
+// IPv6Deny.
+func (a *udpAssociation) lookup(host string, port uint16) (netip.AddrPort, bool) {
+	fields := a.req.Fields
+	timeout := udpLookupTimeout
+	if fields.Timeouts != nil && fields.Timeouts.Connect > 0 {
+		timeout = fields.Timeouts.Connect
+	}
+	ctx, cancel := context.WithTimeout(a.ctx, timeout)
+	defer cancel()
+
+	var ips []net.IP
+	var err error
+	if fields.Resolver != nil {
+		ips, err = fields.Resolver.LookupIP(ctx, host)
+		ips = resolver.Family(fields.ResolverFamily).Select(ips)
+	} else {
+		ips, err = net.DefaultResolver.LookupIP(ctx, "ip", host)
+	}
+	if err != nil {
+		return netip.AddrPort{}, false
+	}
+	for _, ip := range ips {
+		addr, ok := netip.AddrFromSlice(ip)
+		addr = addr.Unmap()
+		if ok && (fields.IPv6Policy != corestructs.IPv6Deny || addr.Is4()) {
+			return netip.AddrPortFrom(addr, port), true
+		}
+	}
+
+	return netip.AddrPort{}, false
+}
+
+// ParseUDPHeader splits an RFC 1928 UDP request into its destination and
+// payload. Fragmented datagrams are rejected.
+func ParseUDPHeader(datagram []byte) (*Address, []byte, error) {
+	if len(datagram) < 4 {
+		return nil, nil, ErrSliceTooShort
+	}
+	if datagram[2] != 0 {
+		return nil, nil, ErrFragmentedDatagram
+	}
+	addr, addrLen, err := AddressFromSlice(datagram[3:])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return addr, datagram[3+addrLen:], nil
+}
+
+func putUDPHeader(datagram []byte, from netip.AddrPort) {
+	datagram[0], datagram[1], datagram[2] = 0, 0, 0
+	var i int
+	if from.Addr().Is4() {
+		datagram[3] = IPv4Address
+		ip := from.Addr().As4()
+		i = 4 + copy(datagram[4:], ip[:])
+	} else {
+		datagram[3] = IPv6Address
+		ip := from.Addr().As16()
+		i = 4 + copy(datagram[4:], ip[:])
+	}
+	datagram[i] = byte(from.Port() >> 8)
+	datagram[i+1] = byte(from.Port() & 0xFF)
+}
+
+func addressFromIP(ip net.IP, port uint16) *Address {
+	return AddressFromHost(ip.String(), port)
+}
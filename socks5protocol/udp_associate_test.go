@@ -0,0 +1,313 @@
+package socks5protocol
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/duratarskeyk/proxymux/acl"
+	"github.com/duratarskeyk/proxymux/corestructs"
+	"github.com/duratarskeyk/proxymux/resolver"
+)
+
+func TestParseUDPHeader(t *testing.T) {
+	datagrams := [][]byte{
+		{0, 0, 0, 1, 1, 2, 3, 4, 0, 53, 'h', 'i'},
+		{0, 0, 0, 3, 2, 'y', 'a', 1, 187},
+		{0, 0, 1, 1, 1, 2, 3, 4, 0, 53, 'h', 'i'},
+		{0, 0, 0},
+		{0, 0, 0, 1, 1, 2},
+	}
+	results := []struct {
+		addr    string
+		payload []byte
+		err     error
+	}{
+		{"1.2.3.4:53", []byte("hi"), nil},
+		{"ya:443", []byte{}, nil},
+		{"", nil, ErrFragmentedDatagram},
+		{"", nil, ErrSliceTooShort},
+		{"", nil, ErrSliceTooShort},
+	}
+	for nr, datagram := range datagrams {
+		addr, payload, err := ParseUDPHeader(datagram)
+		if !errors.Is(err, results[nr].err) {
+			t.Errorf("Test #%d: Expected err %v, got %v", nr+1, results[nr].err, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if addr.StrAddrWithPort != results[nr].addr {
+			t.Errorf("Test #%d: Expected addr %s, got %s", nr+1, results[nr].addr, addr.StrAddrWithPort)
+		}
+		if !bytes.Equal(payload, results[nr].payload) {
+			t.Errorf("Test #%d: Expected payload %v, got %v", nr+1, results[nr].payload, payload)
+		}
+	}
+}
+
+func TestUDPAssociate(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	control, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverConn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer serverConn.Close()
+
+	echo, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, from, err := echo.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			echo.WriteToUDP(buf[:n], from)
+		}
+	}()
+
+	req := GetSocks5Request()
+	req.Command = AssociateCommand
+	req.Fields.PortNum = 0
+	req.Fields.Upload, req.Fields.Download = 0, 0
+	req.Fields.Conn = serverConn
+	req.Fields.ProxyIP = "127.0.0.1"
+	req.Fields.Timeouts = &corestructs.Timeouts{Write: time.Second}
+	req.Fields.Resolver = testResolver{"echo.test": {net.IPv4(127, 0, 0, 1)}}
+	var controls atomic.Int32
+	req.Fields.DialerUDP = &net.Dialer{Control: func(network, address string, c syscall.RawConn) error {
+		controls.Add(1)
+		return nil
+	}}
+	errCh := make(chan error)
+	go func() {
+		errCh <- UDPAssociate(context.Background(), req)
+	}()
+
+	reply := make([]byte, 10)
+	control.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := control.Read(reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply[1] != SuccessReply || reply[3] != IPv4Address {
+		t.Fatalf("Bad reply: %v", reply)
+	}
+	if controls.Load() != 2 {
+		t.Errorf("Expected DialerUDP.Control to run for both sockets, ran %d times", controls.Load())
+	}
+	relayAddr := &net.UDPAddr{IP: net.IP(reply[4:8]), Port: int(reply[8])<<8 | int(reply[9])}
+
+	client, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	stranger, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stranger.Close()
+
+	echoAddr := echo.LocalAddr().(*net.UDPAddr)
+	header := []byte{0, 0, 0, IPv4Address, 127, 0, 0, 1, byte(echoAddr.Port >> 8), byte(echoAddr.Port)}
+	fragmented := append([]byte{0, 0, 1}, header[3:]...)
+
+	client.WriteToUDP(append(header, []byte("hello")...), relayAddr)
+	client.WriteToUDP(append(fragmented, []byte("fragment")...), relayAddr)
+	stranger.WriteToUDP(append(header, []byte("stranger")...), relayAddr)
+	client.WriteToUDP(append(header, []byte("world")...), relayAddr)
+
+	buf := make([]byte, 1024)
+	for _, expected := range []string{"hello", "world"} {
+		client.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := client.ReadFromUDP(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf[:n], append(header, []byte(expected)...)) {
+			t.Errorf("Expected %q, got %q", expected, buf[len(header):n])
+		}
+	}
+	// hostnames are resolved in the background, the first datagram waits
+	named := append([]byte{0, 0, 0, HostnameAddress, 9}, "echo.test"...)
+	named = append(named, byte(echoAddr.Port>>8), byte(echoAddr.Port))
+	client.WriteToUDP(append(named, []byte("named")...), relayAddr)
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	if n, _, err := client.ReadFromUDP(buf); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(buf[:n], append(header, []byte("named")...)) {
+		t.Errorf("Expected %q, got %q", "named", buf[len(header):n])
+	}
+	stranger.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, _, err := stranger.ReadFromUDP(buf); err == nil {
+		t.Error("Expected datagrams from unexpected sources to be dropped")
+	}
+
+	control.Close()
+	select {
+	case err := <-errCh:
+		if err != nil {
+			t.Errorf("Expected nil error, got %s", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Association outlived its control connection")
+	}
+	if _, err := client.WriteToUDP(append(header, 'x'), relayAddr); err == nil {
+		client.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		if _, _, err := client.ReadFromUDP(buf); err == nil {
+			t.Error("Expected relay socket to be closed")
+		}
+	}
+
+	download := int64(3 * (len(header) + 5))
+	upload := download - int64(len(header)) + int64(len(named))
+	if req.Fields.Upload != upload || req.Fields.Download != download {
+		t.Errorf("Expected upload %d, download %d, got %d, %d", upload, download, req.Fields.Upload, req.Fields.Download)
+	}
+	PutSocks5Request(req)
+}
+
+func TestUDPAssociateDestinations(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	control, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer control.Close()
+	serverConn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer serverConn.Close()
+
+	target, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+
+	req := GetSocks5Request()
+	req.Command = AssociateCommand
+	req.Fields.PortNum = 0
+	req.Fields.Conn = serverConn
+	req.Fields.ProxyIP = "127.0.0.1"
+	req.Fields.Destinations = &acl.List{}
+	req.Fields.Upload = 0
+	req.Fields.Timeouts = &corestructs.Timeouts{Write: time.Second}
+	errCh := make(chan error)
+	go func() {
+		errCh <- UDPAssociate(context.Background(), req)
+	}()
+
+	reply := make([]byte, 10)
+	control.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := control.Read(reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply[1] != SuccessReply {
+		t.Fatalf("Bad reply: %v", reply)
+	}
+	relayAddr := &net.UDPAddr{IP: net.IP(reply[4:8]), Port: int(reply[8])<<8 | int(reply[9])}
+
+	client, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	targetAddr := target.LocalAddr().(*net.UDPAddr)
+	header := []byte{0, 0, 0, IPv4Address, 127, 0, 0, 1, byte(targetAddr.Port >> 8), byte(targetAddr.Port)}
+	client.WriteToUDP(append(header, []byte("hello")...), relayAddr)
+	hostname := append([]byte{0, 0, 0, HostnameAddress, 9}, []byte("localhost")...)
+	hostname = append(hostname, byte(targetAddr.Port>>8), byte(targetAddr.Port))
+	client.WriteToUDP(append(hostname, []byte("hello")...), relayAddr)
+
+	target.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if n, _, err := target.ReadFromUDP(make([]byte, 1024)); err == nil {
+		t.Errorf("Expected datagrams to denied targets to be dropped, got %d bytes", n)
+	}
+
+	control.Close()
+	<-errCh
+	if req.Fields.Upload != 0 {
+		t.Errorf("Expected no upload, got %d", req.Fields.Upload)
+	}
+	PutSocks5Request(req)
+}
+
+func TestUDPResolveIPv6Deny(t *testing.T) {
+	req := GetSocks5Request()
+	req.Fields.IPv6Policy = corestructs.IPv6Deny
+	a := &udpAssociation{req: req, ctx: context.Background()}
+	// IPv6 literals are dropped by send, hostnames resolve to IPv4
+	if target, ok := a.lookup("localhost", 53); !ok || !target.Addr().Is4() {
+		t.Errorf("Expected an IPv4 target, got %s", target)
+	}
+	req.Fields.Resolver = testResolver{"dual.example": {net.ParseIP("2001:db8::1"), net.IPv4(192, 0, 2, 1)}}
+	if target, ok := a.lookup("dual.example", 53); !ok || target.Addr() != netip.MustParseAddr("192.0.2.1") {
+		t.Errorf("Expected 192.0.2.1, got %s", target)
+	}
+	req.Fields.IPv6Policy = corestructs.IPv6Allow
+	req.Fields.ResolverFamily = int(resolver.FamilyPreferIPv6)
+	if target, ok := a.lookup("dual.example", 53); !ok || target.Addr() != netip.MustParseAddr("2001:db8::1") {
+		t.Errorf("Expected 2001:db8::1 with the resolver family, got %s", target)
+	}
+	if _, ok := a.lookup("missing.example", 53); ok {
+		t.Error("Expected unknown hosts to fail")
+	}
+	PutSocks5Request(req)
+}
+
+type testResolver map[string][]net.IP
+
+func (r testResolver) LookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	ips, ok := r[host]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return ips, nil
+}
+
+func TestUDPTargetLimits(t *testing.T) {
+	req := GetSocks5Request()
+	a := &udpAssociation{req: req, targets: make(map[netip.AddrPort]time.Time)}
+	for i := 0; i < maxUDPTargets; i++ {
+		if !a.track(netip.AddrPortFrom(netip.MustParseAddr("192.0.2.1"), uint16(i+1))) {
+			t.Fatalf("Expected target %d to be tracked", i+1)
+		}
+	}
+	extra := netip.AddrPortFrom(netip.MustParseAddr("192.0.2.2"), 1)
+	if a.track(extra) {
+		t.Error("Expected new targets to be dropped while full")
+	}
+	for target := range a.targets {
+		a.targets[target] = time.Now()
+	}
+	a.nextSweep = time.Time{}
+	if !a.track(extra) || len(a.targets) != 1 {
+		t.Errorf("Expected expired targets to make room, %d tracked", len(a.targets))
+	}
+	PutSocks5Request(req)
+}
@@ -0,0 +1,194 @@
+package upstream
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/duratarskeyk/proxymux/corestructs"
+	"github.com/duratarskeyk/proxymux/dialer"
+	"github.com/duratarskeyk/proxymux/httpprotocol"
+	"github.com/duratarskeyk/proxymux/resolver"
+	"github.com/duratarskeyk/proxymux/socks4protocol"
+	"github.com/duratarskeyk/proxymux/socks5protocol"
+)
+
+// Dial connects to the target of a parsed request through the chain, all
+// within Timeouts.Connect. The first hop is dialed with fields.DialerTCP,
+// hops aren't checked with fields.Destinations but the target is before it
+// is sent to the last hop. An empty chain dials the target directly. Errors
+// are returned as *dialer.ErrDial, classified by what the last hop reported.
+func (c Chain) Dial(ctx context.Context, fields *corestructs.Fields) (net.Conn, error) {
+	if len(c) == 0 {
+		return dialer.Dial(ctx, fields)
+	}
+	d := fields.DialerTCP
+	if d == nil {
+		d = &net.Dialer{}
+	}
+	if fields.Timeouts != nil && fields.Timeouts.Connect > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, fields.Timeouts.Connect)
+		defer cancel()
+	}
+	if err := checkTarget(ctx, fields); err != nil {
+		return nil, err
+	}
+
+	conn, err := d.DialContext(ctx, "tcp", c[0].Addr)
+	if err != nil {
+		return nil, dialer.NewErrDial(dialer.KindUnknown, err)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	done := make(chan struct{})
+	exited := make(chan struct{})
+	go func(conn net.Conn) {
+		defer close(exited)
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Now())
+		case <-done:
+		}
+	}(conn)
+	conn, err = c.handshake(conn, fields)
+	close(done)
+	<-exited
+
+	if err == nil && ctx.Err() != nil {
+		conn.Close()
+		err = dialer.NewErrDial(dialer.KindTimeout, ctx.Err())
+	}
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+
+	return conn, nil
+}
+
+// checkTarget checks the target with fields.Destinations. Hostnames are
+// resolved for that, with fields.Resolver when set, and denied when any of their addresses is, the last hop
+// still gets the hostname.
+func checkTarget(ctx context.Context, fields *corestructs.Fields) error {
+	check := fields.Destinations
+	if check == nil {
+		return nil
+	}
+	ips := []net.IP{fields.HostIP}
+	if fields.HostIP == nil && fields.Resolver != nil {
+		family := resolver.Family(fields.ResolverFamily)
+		if fields.IPv6Policy == corestructs.IPv6Deny {
+			family = resolver.FamilyIPv4Only
+		}
+		var err error
+		if ips, err = resolver.LookupFamily(ctx, fields.Resolver, fields, family); err != nil {
+			return dialer.NewErrDial(dialer.KindResolution, err)
+		}
+	} else if fields.HostIP == nil {
+		network := "ip"
+		if fields.IPv6Policy == corestructs.IPv6Deny {
+			network = "ip4"
+		}
+		var err error
+		if ips, err = net.DefaultResolver.LookupIP(ctx, network, fields.Host); err != nil {
+			return dialer.NewErrDial(dialer.KindResolution, err)
+		}
+	}
+	for _, ip := range ips {
+		if err := check.CheckAddr(ip, fields.PortNum); err != nil {
+			return dialer.NewErrDial(dialer.KindDenied, err)
+		}
+	}
+
+	return nil
+}
+
+func (c Chain) handshake(conn net.Conn, fields *corestructs.Fields) (net.Conn, error) {
+	host := fields.Host
+	if fields.HostIP != nil {
+		host = fields.HostIP.String()
+	}
+	var err error
+	for i, hop := range c {
+		nextHost, nextPort := host, fields.PortNum
+		if i+1 < len(c) {
+			var portStr string
+			nextHost, portStr, _ = net.SplitHostPort(c[i+1].Addr)
+			port, _ := strconv.Atoi(portStr)
+			nextPort = uint16(port)
+		}
+		conn, err = hop.connect(conn, nextHost, nextPort)
+		if err != nil {
+			conn.Close()
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				return nil, dialer.NewErrDial(dialer.KindTimeout, err)
+			}
+			return nil, dialer.NewErrDial(classify(err, i+1 == len(c)), err)
+		}
+	}
+
+	return conn, nil
+}
+
+func (p *Proxy) connect(conn net.Conn, host string, port uint16) (net.Conn, error) {
+	switch p.Type {
+	case TypeSOCKS5:
+		_, err := socks5protocol.ClientConnect(conn, p.Username, p.Password, socks5protocol.AddressFromHost(host, port))
+		return conn, err
+	case TypeSOCKS4:
+		return conn, socks4protocol.ClientConnect(conn, p.Username, p.Password, host, port)
+	case TypeHTTP:
+		newConn, err := httpprotocol.ClientConnect(conn, p.Username, p.Password, host, port)
+		if err != nil {
+			return conn, err
+		}
+		return newConn, nil
+	}
+
+	return conn, ErrUnknownScheme
+}
+
+// classify maps what the last hop reported about the target to dial error
+// kinds, failures of intermediate hops are our own.
+func classify(err error, lastHop bool) dialer.ErrorKind {
+	if !lastHop {
+		return dialer.KindUnknown
+	}
+
+	var replyErr *socks5protocol.ErrReply
+	if errors.As(err, &replyErr) {
+		switch replyErr.Code {
+		case socks5protocol.RuleFailure:
+			return dialer.KindDenied
+		case socks5protocol.NetworkUnreachable:
+			return dialer.KindNetworkUnreachable
+		case socks5protocol.HostUnreachable:
+			return dialer.KindHostUnreachable
+		case socks5protocol.ConnectionRefused:
+			return dialer.KindConnectionRefused
+		case socks5protocol.TTLExpired:
+			return dialer.KindTimeout
+		}
+		return dialer.KindUnknown
+	}
+	var connectErr *httpprotocol.ErrConnectFailed
+	if errors.As(err, &connectErr) {
+		switch connectErr.StatusCode {
+		case 451:
+			return dialer.KindDenied
+		case 570:
+			return dialer.KindResolution
+		case 572:
+			return dialer.KindConnectionRefused
+		case 504:
+			return dialer.KindTimeout
+		}
+	}
+
+	return dialer.KindUnknown
+}
@@ -0,0 +1,248 @@
+package upstream
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/duratarskeyk/proxymux/corestructs"
+	"github.com/duratarskeyk/proxymux/dialer"
+	"github.com/duratarskeyk/proxymux/httpprotocol"
+	"github.com/duratarskeyk/proxymux/socks4protocol"
+	"github.com/duratarskeyk/proxymux/socks5protocol"
+)
+
+// startProxy accepts one connection, runs handshake on it and pipes it to
+// the address handshake returns.
+func startProxy(t *testing.T, handshake func(conn net.Conn, br *bufio.Reader) (string, error)) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		br := bufio.NewReader(conn)
+		next, err := handshake(conn, br)
+		if err != nil {
+			return
+		}
+		target, err := net.Dial("tcp", next)
+		if err != nil {
+			return
+		}
+		defer target.Close()
+		go io.Copy(target, br)
+		io.Copy(conn, target)
+	}()
+
+	return ln.Addr().String()
+}
+
+func socks5Handshake(user, pass string) func(net.Conn, *bufio.Reader) (string, error) {
+	return func(conn net.Conn, br *bufio.Reader) (string, error) {
+		greeting := make([]byte, 4)
+		io.ReadFull(br, greeting)
+		conn.Write([]byte{5, 2})
+		auth := make([]byte, 3+len(user)+len(pass))
+		io.ReadFull(br, auth)
+		if string(auth[2:2+len(user)]) != user || string(auth[3+len(user):]) != pass {
+			conn.Write([]byte{1, 1})
+			return "", errors.New("bad credentials")
+		}
+		conn.Write([]byte{1, 0})
+		request := make([]byte, 10)
+		io.ReadFull(br, request)
+		conn.Write([]byte{5, 0, 0, 1, 127, 0, 0, 1, 0, 1})
+		return fmt.Sprintf("%s:%d", net.IP(request[4:8]), int(request[8])<<8|int(request[9])), nil
+	}
+}
+
+func socks4Handshake(conn net.Conn, br *bufio.Reader) (string, error) {
+	request := make([]byte, 8)
+	if _, err := io.ReadFull(br, request); err != nil {
+		return "", err
+	}
+	userID, _ := br.ReadString(0)
+	host := net.IP(request[4:8]).String()
+	if request[4] == 0 {
+		var err error
+		if host, err = br.ReadString(0); err != nil {
+			return "", err
+		}
+		host = host[:len(host)-1]
+	}
+	if userID != "u.p\x00" {
+		conn.Write([]byte{0, 0x5B, 0, 0, 0, 0, 0, 0})
+		return "", errors.New("bad credentials")
+	}
+	conn.Write([]byte{0, 0x5A, 0, 0, 0, 0, 0, 0})
+	return fmt.Sprintf("%s:%d", host, int(request[2])<<8|int(request[3])), nil
+}
+
+func httpHandshake(status string) func(net.Conn, *bufio.Reader) (string, error) {
+	return func(conn net.Conn, br *bufio.Reader) (string, error) {
+		req, err := http.ReadRequest(br)
+		if err != nil {
+			return "", err
+		}
+		if user, pass, ok := parseBasic(req.Header.Get("Proxy-Authorization")); !ok || user != "u" || pass != "p" {
+			io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\n\r\n")
+			return "", errors.New("bad credentials")
+		}
+		io.WriteString(conn, "HTTP/1.1 "+status+"\r\n\r\n")
+		return req.Host, nil
+	}
+}
+
+func parseBasic(header string) (string, string, bool) {
+	req := &http.Request{Header: http.Header{"Authorization": {header}}}
+	return req.BasicAuth()
+}
+
+func TestChainDial(t *testing.T) {
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	go func() {
+		conn, err := target.Accept()
+		if err != nil {
+			return
+		}
+		conn.Write([]byte("hello"))
+		conn.Close()
+	}()
+
+	chain := Chain{
+		{Type: TypeSOCKS5, Addr: startProxy(t, socks5Handshake("user", "pass")), Username: "user", Password: "pass"},
+		{Type: TypeHTTP, Addr: startProxy(t, httpHandshake("200 Connection established")), Username: "u", Password: "p"},
+		// any 2xx opens the tunnel
+		{Type: TypeHTTP, Addr: startProxy(t, httpHandshake("204 No Content")), Username: "u", Password: "p"},
+		{Type: TypeSOCKS4, Addr: startProxy(t, socks4Handshake), Username: "u", Password: "p"},
+	}
+	targetAddr := target.Addr().(*net.TCPAddr)
+	fields := &corestructs.Fields{
+		Host:     "127.0.0.1",
+		HostIP:   targetAddr.IP,
+		Port:     fmt.Sprint(targetAddr.Port),
+		PortNum:  uint16(targetAddr.Port),
+		Timeouts: &corestructs.Timeouts{Connect: 2 * time.Second},
+	}
+	conn, err := chain.Dial(context.Background(), fields)
+	if err != nil {
+		t.Fatalf("Expected successful dial, got %s", err)
+	}
+	defer conn.Close()
+	got, _ := io.ReadAll(conn)
+	if string(got) != "hello" {
+		t.Errorf("Expected %q through the chain, got %q", "hello", got)
+	}
+}
+
+func TestChainBadCredentials(t *testing.T) {
+	chain := Chain{
+		{Type: TypeSOCKS5, Addr: startProxy(t, socks5Handshake("user", "pass")), Username: "user", Password: "wrong"},
+	}
+	fields := &corestructs.Fields{
+		Host:     "127.0.0.1",
+		HostIP:   net.IPv4(127, 0, 0, 1),
+		Port:     "1",
+		PortNum:  1,
+		Timeouts: &corestructs.Timeouts{Connect: time.Second},
+	}
+	_, err := chain.Dial(context.Background(), fields)
+	var dialErr *dialer.ErrDial
+	if !errors.As(err, &dialErr) {
+		t.Errorf("Expected *dialer.ErrDial, got %v", err)
+	}
+}
+
+func TestChainBadHost(t *testing.T) {
+	testCases := []struct {
+		proxy Proxy
+		host  string
+		err   error
+	}{
+		{Proxy{Type: TypeHTTP, Addr: startProxy(t, httpHandshake("200 OK")), Username: "u", Password: "p"}, "example.org\r\nX-Injected: 1", httpprotocol.ErrBadHost},
+		{Proxy{Type: TypeHTTP, Addr: startProxy(t, httpHandshake("200 OK")), Username: "u", Password: "p"}, "example.org/path", httpprotocol.ErrBadHost},
+		{Proxy{Type: TypeSOCKS4, Addr: startProxy(t, socks4Handshake), Username: "u", Password: "p"}, "example.org\x00evil", socks4protocol.ErrBadHost},
+		{Proxy{Type: TypeSOCKS5, Addr: startProxy(t, socks5Handshake("user", "pass")), Username: "user", Password: "pass"}, strings.Repeat("a", 256), socks5protocol.ErrHostTooLong},
+	}
+	for nr, testCase := range testCases {
+		fields := &corestructs.Fields{
+			Host:     testCase.host,
+			HostType: corestructs.HostTypeHostname,
+			Port:     "80",
+			PortNum:  80,
+			Timeouts: &corestructs.Timeouts{Connect: time.Second},
+		}
+		if _, err := (Chain{testCase.proxy}).Dial(context.Background(), fields); !errors.Is(err, testCase.err) {
+			t.Errorf("Test #%d: Expected %v, got %v", nr+1, testCase.err, err)
+		}
+	}
+}
+
+func TestParseProxy(t *testing.T) {
+	urls := []string{"socks5://u:p@1.2.3.4:1080", "socks4a://5.6.7.8:1080", "http://proxy:3128", "ftp://x:1", "http://nohost"}
+	results := []struct {
+		proxy Proxy
+		err   bool
+	}{
+		{Proxy{Type: TypeSOCKS5, Addr: "1.2.3.4:1080", Username: "u", Password: "p"}, false},
+		{Proxy{Type: TypeSOCKS4, Addr: "5.6.7.8:1080"}, false},
+		{Proxy{Type: TypeHTTP, Addr: "proxy:3128"}, false},
+		{Proxy{}, true},
+		{Proxy{}, true},
+	}
+	for nr, rawURL := range urls {
+		p, err := ParseProxy(rawURL)
+		if (err != nil) != results[nr].err {
+			t.Errorf("Test #%d: Unexpected error: %v", nr+1, err)
+			continue
+		}
+		if err == nil && p != results[nr].proxy {
+			t.Errorf("Test #%d: Expected %+v, got %+v", nr+1, results[nr].proxy, p)
+		}
+	}
+}
+
+func TestTableSelect(t *testing.T) {
+	pkgChain := Chain{{Addr: "pkg:1"}}
+	userChain := Chain{{Addr: "user:1"}}
+	domainChain := Chain{{Addr: "domain:1"}}
+	defaultChain := Chain{{Addr: "default:1"}}
+	table := &Table{
+		ByPackage: map[int]Chain{1: pkgChain},
+		ByUser:    map[int]Chain{2: userChain},
+		ByDomain:  map[string]Chain{"example.com": domainChain},
+		Default:   defaultChain,
+	}
+	testCases := []struct {
+		fields corestructs.Fields
+		chain  Chain
+	}{
+		{corestructs.Fields{PackageID: 1, UserID: 2}, pkgChain},
+		{corestructs.Fields{PackageID: 3, UserID: 2}, userChain},
+		{corestructs.Fields{Host: "www.Example.com", HostType: corestructs.HostTypeHostname}, domainChain},
+		{corestructs.Fields{Host: "example.org", HostType: corestructs.HostTypeHostname}, defaultChain},
+		{corestructs.Fields{PackageID: 1, SystemUser: true}, defaultChain},
+	}
+	for nr, testCase := range testCases {
+		if chain := table.Select(&testCase.fields); chain[0].Addr != testCase.chain[0].Addr {
+			t.Errorf("Test #%d: Expected %s, got %s", nr+1, testCase.chain[0].Addr, chain[0].Addr)
+		}
+	}
+}
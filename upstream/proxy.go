@@ -0,0 +1,58 @@
+package upstream
+
+import (
+	"errors"
+	"net"
+	"net/url"
+)
+
+type Type int
+
+const (
+	TypeSOCKS5 Type = iota
+	TypeSOCKS4
+	TypeHTTP
+)
+
+var ErrUnknownScheme = errors.New("unknown upstream proxy scheme")
+
+type Proxy struct {
+	Type     Type
+	Addr     string
+	Username string
+	Password string
+}
+
+// Chain is a list of proxies traversed in order, the last one connects to
+// the target.
+type Chain []Proxy
+
+// ParseProxy parses socks5://, socks4://, socks4a:// and http:// URLs with
+// optional user info.
+func ParseProxy(rawURL string) (Proxy, error) {
+	var p Proxy
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return p, err
+	}
+	switch u.Scheme {
+	case "socks5", "socks5h":
+		p.Type = TypeSOCKS5
+	case "socks4", "socks4a":
+		p.Type = TypeSOCKS4
+	case "http":
+		p.Type = TypeHTTP
+	default:
+		return p, ErrUnknownScheme
+	}
+	if _, _, err = net.SplitHostPort(u.Host); err != nil {
+		return p, err
+	}
+	p.Addr = u.Host
+	if u.User != nil {
+		p.Username = u.User.Username()
+		p.Password, _ = u.User.Password()
+	}
+
+	return p, nil
+}
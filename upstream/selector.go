@@ -0,0 +1,53 @@
+package upstream
+
+import (
+	"strings"
+
+	"github.com/duratarskeyk/proxymux/corestructs"
+)
+
+type Selector interface {
+	Select(fields *corestructs.Fields) Chain
+}
+
+type SelectorFunc func(fields *corestructs.Fields) Chain
+
+func (f SelectorFunc) Select(fields *corestructs.Fields) Chain {
+	return f(fields)
+}
+
+// Table picks a chain by package, then user, then destination domain,
+// falling back to Default. Domains match themselves and their subdomains,
+// the longest match wins. System users only get Default.
+type Table struct {
+	ByPackage map[int]Chain
+	ByUser    map[int]Chain
+	ByDomain  map[string]Chain
+	Default   Chain
+}
+
+func (t *Table) Select(fields *corestructs.Fields) Chain {
+	if !fields.SystemUser {
+		if chain, ok := t.ByPackage[fields.PackageID]; ok {
+			return chain
+		}
+		if chain, ok := t.ByUser[fields.UserID]; ok {
+			return chain
+		}
+	}
+	if fields.HostType == corestructs.HostTypeHostname && len(t.ByDomain) > 0 {
+		host := strings.ToLower(strings.TrimSuffix(fields.Host, "."))
+		for {
+			if chain, ok := t.ByDomain[host]; ok {
+				return chain
+			}
+			dot := strings.IndexByte(host, '.')
+			if dot == -1 {
+				break
+			}
+			host = host[dot+1:]
+		}
+	}
+
+	return t.Default
+}